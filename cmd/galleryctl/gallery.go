@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taherk/galleryapp/models"
+)
+
+func galleryList(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	email := fs.String("user", "", "only list the galleries of the user with this email")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	var galleries []models.Gallery
+	if *email == "" {
+		galleries, err = app.galleries.All(ctx)
+	} else {
+		var user *models.User
+		user, err = app.users.ByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		galleries, err = app.galleries.ByUserID(ctx, int(user.ID))
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(app.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER ID\tTITLE\tTAKEN DOWN AT")
+	for _, gallery := range galleries {
+		takenDownAt := "-"
+		if gallery.TakenDownAt != nil {
+			takenDownAt = gallery.TakenDownAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\n", gallery.ID, gallery.UserID, gallery.Title, takenDownAt)
+	}
+	return tw.Flush()
+}
+
+func galleryTransfer(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("gallery ID %q is not a number", args[0])
+	}
+
+	user, err := app.users.ByEmail(ctx, args[1])
+	if err != nil {
+		return err
+	}
+	err = app.galleries.Transfer(ctx, id, int(user.ID))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(app.stdout, "transferred gallery %d to user %d %s\n", id, user.ID, user.Email)
+	return nil
+}
+
+func galleryPurge(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	takenDownFor := fs.Duration("taken-down-for", 30*24*time.Hour, "delete galleries taken down at least this long ago")
+	dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	galleries, err := app.galleries.All(ctx)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*takenDownFor)
+	exists := make(map[int]bool, len(galleries))
+	for _, gallery := range galleries {
+		exists[gallery.ID] = true
+		if gallery.TakenDownAt == nil || gallery.TakenDownAt.After(cutoff) {
+			continue
+		}
+		fmt.Fprintf(app.stdout, "deleting gallery %d %q, taken down at %s\n", gallery.ID, gallery.Title, gallery.TakenDownAt.Format(time.DateTime))
+		if *dryRun {
+			continue
+		}
+		err := app.galleries.Delete(ctx, gallery.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// images are deleted after their gallery, so a failure in between leaves
+	// them behind
+	ids, err := app.galleries.StoredGalleryIDs(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if exists[id] {
+			continue
+		}
+		// the gallery may have been created since the list was read
+		_, err := app.galleries.ByID(ctx, id)
+		if !errors.Is(err, models.ErrNotFound) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(app.stdout, "deleting the images of deleted gallery %d\n", id)
+		if *dryRun {
+			continue
+		}
+		err = app.galleries.DeleteImages(ctx, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Command galleryctl administers the gallery app from the command line. It
+// reads the same config as the server, from a config file, the environment
+// and the flags before the command:
+//
+//	galleryctl [flags] <command> [command flags] [args]
+//
+// Only the settings the commands use are required: the database, the image
+// storage, passwords and logging.
+//
+// Run galleryctl without a command for the list of commands.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/taherk/galleryapp/config"
+	"github.com/taherk/galleryapp/logging"
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/passwords"
+)
+
+// command is a subcommand, e.g. "user create". run defines its flags on fs
+// and parses the arguments after the name with them.
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"migrate up", "", "apply every pending migration", migrateUp},
+	{"migrate down", "[-to VERSION]", "roll back the latest migration, or every migration after VERSION", migrateDown},
+	{"migrate status", "", "list the migrations and whether they are applied", migrateStatus},
+	{"migrate create", "[-dir DIR] NAME", "create the next SQL migration in DIR", migrateCreate},
+	{"user create", "[-admin] [-password-stdin] EMAIL", "create a user, with a generated password unless it is read from stdin", userCreate},
+	{"user disable", "[-enable] EMAIL", "disable the account of a user, or enable it again", userDisable},
+	{"user set-password", "[-password-stdin] EMAIL", "set a new password and sign the user out everywhere", userSetPassword},
+	{"user list", "[-q QUERY]", "list the users whose email contains QUERY", userList},
+	{"gallery list", "[-user EMAIL]", "list every gallery, or those of one user", galleryList},
+	{"gallery transfer", "ID EMAIL", "give a gallery to another user", galleryTransfer},
+	{"gallery purge", "[-taken-down-for DURATION] [-dry-run]", "delete galleries taken down long ago and images without a gallery", galleryPurge},
+	{"seed", "[-users N] [-galleries N] [-images N]", "add demo users and galleries with generated images, only with DEV_MODE", seed},
+	{"sessions prune", "[-older-than DURATION]", "delete old sessions and those of disabled users", sessionsPrune},
+}
+
+// app holds the services the commands work with.
+type app struct {
+	cfg       config.Config
+	db        *sql.DB
+	users     *models.UserService
+	sessions  *models.SessionService
+	galleries *models.GalleryService
+	stdin     io.Reader
+	stdout    io.Writer
+}
+
+func main() {
+	cfg, args, err := config.LoadCommand("galleryctl", os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		usage()
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	cmd, args, ok := findCommand(args)
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
+	if err != nil {
+		fatal(cmd, err)
+	}
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app, err := newApp(cfg)
+	if err != nil {
+		fatal(cmd, err)
+	}
+	defer app.db.Close()
+
+	err = cmd.run(ctx, app, cmd.flags(), args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		app.db.Close()
+		fatal(cmd, err)
+	}
+}
+
+func newApp(cfg config.Config) (*app, error) {
+	db, err := models.Open(cfg.PSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	breachedPasswords, err := models.LoadBreachedPasswords(passwords.Breached)
+	if err != nil {
+		return nil, err
+	}
+	passwordHasher, err := models.NewPasswordHasher(cfg.Password.Hasher, cfg.Password.BcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &app{
+		cfg: cfg,
+		db:  db,
+		users: &models.UserService{
+			DB: db,
+			PasswordPolicy: &models.PasswordPolicy{
+				MinLength: cfg.Password.MinLength,
+				Breached:  breachedPasswords,
+			},
+			PasswordHasher: passwordHasher,
+		},
+		sessions: &models.SessionService{
+			DB: db,
+		},
+		galleries: &models.GalleryService{
+			DB:        db,
+			ImagesDir: cfg.Storage.ImagesDir,
+		},
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+	}, nil
+}
+
+// findCommand finds the command named by the first one or two args, and
+// returns the args that follow its name.
+func findCommand(args []string) (command, []string, bool) {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == cmd.name {
+			return cmd, args[len(words):], true
+		}
+	}
+	return command{}, nil, false
+}
+
+// flags returns the flag set of the command, which prints its usage line on
+// -h.
+func (cmd command) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("galleryctl "+cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: galleryctl %s %s\n\n%s\n", cmd.name, cmd.args, cmd.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of a command and checks that n arguments follow
+// them.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != n {
+		fs.Usage()
+		return nil, fmt.Errorf("expected %d arguments, got %d", n, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: galleryctl [flags] <command> [command flags] [args]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-18s %s\n", cmd.name, cmd.usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun galleryctl <command> -h for the flags of a command, and galleryctl -h for\nthe config flags, which are shared with the server.\n")
+}
+
+func fatal(cmd command, err error) {
+	fmt.Fprintf(os.Stderr, "galleryctl %s: %v\n", cmd.name, err)
+	os.Exit(1)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pressly/goose/v3"
+	"github.com/taherk/galleryapp/migrations"
+	"github.com/taherk/galleryapp/models"
+)
+
+func migrateUp(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	// the same as the server does on startup
+	return models.MigrateFS(app.db, migrations.FS, ".")
+}
+
+func migrateDown(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	to := fs.Int64("to", -1, "roll back every migration after this version, 0 for all")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	provider, err := goose.NewProvider(goose.DialectPostgres, app.db, migrations.FS)
+	if err != nil {
+		return err
+	}
+	var results []*goose.MigrationResult
+	if *to < 0 {
+		result, err := provider.Down(ctx)
+		if err != nil {
+			return err
+		}
+		results = append(results, result)
+	} else {
+		results, err = provider.DownTo(ctx, *to)
+		if err != nil {
+			return err
+		}
+	}
+	for _, result := range results {
+		fmt.Fprintf(app.stdout, "rolled back %s (%v)\n", result.Source.Path, result.Duration.Round(time.Millisecond))
+	}
+	return nil
+}
+
+func migrateStatus(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	provider, err := goose.NewProvider(goose.DialectPostgres, app.db, migrations.FS)
+	if err != nil {
+		return err
+	}
+	statuses, err := provider.Status(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(app.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tSTATE\tAPPLIED AT\tFILE")
+	for _, status := range statuses {
+		appliedAt := "-"
+		if status.State == goose.StateApplied {
+			appliedAt = status.AppliedAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", status.Source.Version, status.State, appliedAt, status.Source.Path)
+	}
+	return tw.Flush()
+}
+
+func migrateCreate(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	dir := fs.String("dir", "migrations", "directory of the migrations, embedded into the binaries when they are built")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	// numbered like the existing migrations, not by timestamp
+	goose.SetSequential(true)
+	return goose.Create(nil, *dir, args[0], "sql")
+}
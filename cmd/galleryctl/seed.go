@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+
+	"github.com/taherk/galleryapp/models"
+	cryptorand "github.com/taherk/galleryapp/rand"
+)
+
+func seed(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	users := fs.Int("users", 3, "number of demo users")
+	galleries := fs.Int("galleries", 2, "number of galleries of every demo user")
+	images := fs.Int("images", 4, "number of images in every gallery")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+	if !app.cfg.Server.Dev {
+		return errors.New("seed adds demo accounts, so it only runs with DEV_MODE")
+	}
+
+	// one password for all of them, it is printed anyway
+	password, err := cryptorand.String(12)
+	if err != nil {
+		return err
+	}
+	for i := 1; i <= *users; i++ {
+		email := fmt.Sprintf("demo%d@example.com", i)
+		user, err := app.users.Create(ctx, email, password)
+		if errors.Is(err, models.ErrEmailToken) {
+			fmt.Fprintf(app.stdout, "skipping %s, the user exists\n", email)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(app.stdout, "created user %d %s\n", user.ID, user.Email)
+
+		for j := 1; j <= *galleries; j++ {
+			gallery, err := app.galleries.Create(ctx, fmt.Sprintf("Demo gallery %d", j), int(user.ID))
+			if err != nil {
+				return err
+			}
+			for k := 1; k <= *images; k++ {
+				err := app.seedImage(ctx, gallery.ID, fmt.Sprintf("demo-%d.png", k))
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(app.stdout, "created gallery %d %q with %d images\n", gallery.ID, gallery.Title, *images)
+		}
+	}
+	fmt.Fprintf(app.stdout, "password of the new demo users: %s\n", password)
+	return nil
+}
+
+// seedImage stores a gradient between two random colors as a PNG image.
+func (app *app) seedImage(ctx context.Context, galleryID int, filename string) error {
+	const width, height = 640, 480
+	from := randomColor()
+	to := randomColor()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			// diagonal, from the top left to the bottom right corner
+			t := float64(x+y) / float64(width+height-2)
+			img.Set(x, y, color.RGBA{
+				R: blend(from.R, to.R, t),
+				G: blend(from.G, to.G, t),
+				B: blend(from.B, to.B, t),
+				A: 255,
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return err
+	}
+	_, err = app.galleries.CreateImage(ctx, galleryID, filename, &buf)
+	return err
+}
+
+func randomColor() color.RGBA {
+	return color.RGBA{R: uint8(rand.Intn(256)), G: uint8(rand.Intn(256)), B: uint8(rand.Intn(256))}
+}
+
+func blend(from, to uint8, t float64) uint8 {
+	return uint8(float64(from) + (float64(to)-float64(from))*t)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+func sessionsPrune(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	olderThan := fs.Duration("older-than", 30*24*time.Hour, "delete sessions created longer ago than this")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	pruned, err := app.sessions.Prune(ctx, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(app.stdout, "deleted %d sessions\n", pruned)
+	return nil
+}
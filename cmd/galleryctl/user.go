@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/rand"
+)
+
+func userCreate(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	admin := fs.Bool("admin", false, "make the user an admin")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	password, generated, err := app.password(*passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	var user *models.User
+	err = models.WithTx(ctx, app.db, func(ctx context.Context) error {
+		user, err = app.users.Create(ctx, args[0], password)
+		if err != nil {
+			return err
+		}
+		if !*admin {
+			return nil
+		}
+		user.Role = models.RoleAdmin
+		return app.users.SetRole(ctx, int(user.ID), models.RoleAdmin)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(app.stdout, "created user %d %s\n", user.ID, user.Email)
+	if generated {
+		fmt.Fprintf(app.stdout, "password: %s\n", password)
+	}
+	return nil
+}
+
+func userDisable(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	enable := fs.Bool("enable", false, "enable the account again")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.users.ByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	err = app.users.SetDisabled(ctx, int(user.ID), !*enable)
+	if err != nil {
+		return err
+	}
+
+	if *enable {
+		fmt.Fprintf(app.stdout, "enabled user %d %s\n", user.ID, user.Email)
+	} else {
+		fmt.Fprintf(app.stdout, "disabled user %d %s\n", user.ID, user.Email)
+	}
+	return nil
+}
+
+func userSetPassword(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	password, generated, err := app.password(*passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.users.ByEmail(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	// whoever knew the old password is signed out, like when users change it
+	// themselves
+	err = models.WithTx(ctx, app.db, func(ctx context.Context) error {
+		err := app.users.UpdatePassword(ctx, int(user.ID), password)
+		if err != nil {
+			return err
+		}
+		return app.sessions.DeleteByUserID(ctx, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(app.stdout, "set the password of user %d %s\n", user.ID, user.Email)
+	if generated {
+		fmt.Fprintf(app.stdout, "password: %s\n", password)
+	}
+	return nil
+}
+
+func userList(ctx context.Context, app *app, fs *flag.FlagSet, args []string) error {
+	query := fs.String("q", "", "only list users whose email contains this")
+	_, err := parseArgs(fs, args, 0)
+	if err != nil {
+		return err
+	}
+
+	users, err := app.users.Search(ctx, *query)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(app.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tEMAIL\tROLE\tDISABLED AT")
+	for _, user := range users {
+		disabledAt := "-"
+		if user.DisabledAt != nil {
+			disabledAt = user.DisabledAt.Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", user.ID, user.Email, user.Role, disabledAt)
+	}
+	return tw.Flush()
+}
+
+// password reads the password from the first line of stdin, or generates one
+// so it never shows up in the shell history or the process list.
+func (app *app) password(fromStdin bool) (password string, generated bool, err error) {
+	if !fromStdin {
+		password, err := rand.String(12)
+		return password, true, err
+	}
+
+	scanner := bufio.NewScanner(app.stdin)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", false, err
+		}
+		return "", false, errors.New("no password on stdin")
+	}
+	return strings.TrimSuffix(scanner.Text(), "\r"), false, nil
+}
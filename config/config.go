@@ -0,0 +1,462 @@
+// Package config loads the configuration of the app. Every setting starts
+// from its default and can be overridden by a JSON config file, then by
+// environment variables (including those in a .env file), and finally by
+// command line flags.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/taherk/galleryapp/logging"
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/rand"
+	"github.com/taherk/galleryapp/tracing"
+)
+
+// it is better not to refer the config in the rather pass in the values needed.
+// which is why the config structs of components are defined in their package.
+type Config struct {
+	PSQL          models.PostgresConfig
+	Mail          models.MailConfig
+	CSRF          CSRFConfig
+	Server        ServerConfig
+	Storage       StorageConfig
+	OIDC          []models.OIDCConfig
+	Registration  RegistrationConfig
+	Notifications struct {
+		// Secret signs unsubscribe links
+		Secret string
+	}
+	InboundEmail struct {
+		// Domain of the gallery addresses
+		Domain string
+		// Secret the mail relay authenticates with. Inbound email is turned
+		// off without it.
+		Secret string
+	}
+	Password PasswordConfig
+	Log      LogConfig
+	Tracing  tracing.Config
+}
+
+type LogConfig struct {
+	// Level is the minimum level that is logged: debug, info, warn or error.
+	Level slog.Level
+	// Format is "text" or "json".
+	Format string
+}
+
+type CSRFConfig struct {
+	// Key authenticates the CSRF tokens and has to be 32 bytes long.
+	Key    string
+	Secure bool
+}
+
+type ServerConfig struct {
+	Address string
+	// AdminAddress is where internal endpoints like /metrics are served. It
+	// should not be reachable from the internet. "off" turns it off.
+	AdminAddress string
+	// Dev enables routes that are only useful during development, like
+	// email previews.
+	Dev bool
+
+	ReadHeaderTimeout Duration
+	// ReadTimeout and WriteTimeout bound the whole request, so they have to
+	// leave enough time to upload images over a slow connection.
+	ReadTimeout    Duration
+	WriteTimeout   Duration
+	IdleTimeout    Duration
+	MaxHeaderBytes int
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGTERM. It should be longer than WriteTimeout, so uploads are not cut
+	// off during deploys.
+	ShutdownTimeout Duration
+
+	// TLS is served when both files are set. They are reloaded when they
+	// change on disk, so renewed certificates need no restart.
+	TLS struct {
+		CertFile string
+		KeyFile  string
+	}
+}
+
+type StorageConfig struct {
+	// ImagesDir is where gallery images are stored.
+	ImagesDir string
+}
+
+type RegistrationConfig struct {
+	InviteOnly  bool
+	InviteQuota int
+}
+
+type PasswordConfig struct {
+	MinLength int
+	// Hasher is "bcrypt" or "argon2id"
+	Hasher     string
+	BcryptCost int
+}
+
+func Default() Config {
+	var cfg Config
+	cfg.PSQL = models.DefaultPostgresConfig()
+	cfg.Mail.Transport = models.MailTransportSMTP
+	cfg.Mail.SMTP.Port = models.DefaultSMTPPort
+	cfg.Server.Address = ":3000"
+	cfg.Server.AdminAddress = "localhost:9090"
+	cfg.Server.ReadHeaderTimeout = Duration(10 * time.Second)
+	cfg.Server.ReadTimeout = Duration(5 * time.Minute)
+	cfg.Server.WriteTimeout = Duration(5 * time.Minute)
+	cfg.Server.IdleTimeout = Duration(2 * time.Minute)
+	cfg.Server.MaxHeaderBytes = 1 << 20
+	cfg.Server.ShutdownTimeout = Duration(6 * time.Minute)
+	cfg.Storage.ImagesDir = models.DefaultImagesDir
+	cfg.Password.MinLength = models.DefaultMinPasswordLength
+	cfg.Registration.InviteQuota = models.DefaultInviteQuota
+	cfg.Password.Hasher = "bcrypt"
+	cfg.Log.Level = slog.LevelInfo
+	cfg.Log.Format = logging.FormatText
+	cfg.Tracing.Exporter = tracing.ExporterNone
+	cfg.Tracing.SampleRatio = 1
+	return cfg
+}
+
+// Load layers the config file, the environment and the flags in args, which
+// do not include the program name, on top of the defaults, and validates the
+// result for the server.
+func Load(args []string) (Config, error) {
+	cfg, _, err := load("galleryapp", args)
+	if err != nil {
+		return Config{}, err
+	}
+
+	if cfg.CSRF.Key == "" && cfg.Server.Dev {
+		slog.Warn("CSRF_KEY is not set, using a random key until the server restarts")
+		cfg.CSRF.Key, err = rand.String(24)
+		if err != nil {
+			return Config{}, fmt.Errorf("config.Load: %w", err)
+		}
+	}
+	if cfg.Notifications.Secret == "" && cfg.Server.Dev {
+		slog.Warn("NOTIFICATIONS_SECRET is not set, unsubscribe links stop working when the server restarts")
+		cfg.Notifications.Secret, err = rand.String(32)
+		if err != nil {
+			return Config{}, fmt.Errorf("config.Load: %w", err)
+		}
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// LoadCommand is Load for the command called name, whose own arguments follow
+// the flags. They are returned with the config. Commands don't serve HTTP or
+// send mail, so the config is only validated with ValidateCommand.
+func LoadCommand(name string, args []string) (Config, []string, error) {
+	cfg, args, err := load(name, args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	err = cfg.ValidateCommand()
+	if err != nil {
+		return Config{}, nil, err
+	}
+	return cfg, args, nil
+}
+
+func load(name string, args []string) (Config, []string, error) {
+	// the flags are applied last, but they can name the config file, so they
+	// are parsed once upfront to find it.
+	var path string
+	scratch := Default()
+	err := flagSet(name, settings(&scratch), &path).Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	err = godotenv.Load()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Config{}, nil, fmt.Errorf("config.Load: .env: %w", err)
+	}
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+
+	cfg := Default()
+	if path != "" {
+		err = cfg.readFile(path)
+		if err != nil {
+			return Config{}, nil, fmt.Errorf("config.Load: %w", err)
+		}
+	}
+	err = cfg.readEnv()
+	if err != nil {
+		return Config{}, nil, fmt.Errorf("config.Load: %w", err)
+	}
+	flags := flagSet(name, settings(&cfg), &path)
+	err = flags.Parse(args)
+	if err != nil {
+		return Config{}, nil, fmt.Errorf("config.Load: %w", err)
+	}
+
+	// empty environment variables are ignored, so it takes a word to turn
+	// the admin listener off
+	if cfg.Server.AdminAddress == "off" {
+		cfg.Server.AdminAddress = ""
+	}
+	if cfg.Mail.Transport == models.MailTransportFile && cfg.Mail.Dir == "" {
+		cfg.Mail.Dir = "tmp/emails"
+	}
+	return cfg, flags.Args(), nil
+}
+
+// readFile reads a JSON config file. Keys match the field names of Config,
+// e.g. {"PSQL": {"Host": "db"}}, and unknown keys are an error, so typos are
+// not silently ignored.
+func (cfg *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("reading config file %v: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) readEnv() error {
+	for _, s := range settings(cfg) {
+		if s.env == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(s.env)
+		if !ok || value == "" {
+			continue
+		}
+		err := s.value.Set(value)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %w", s.env, err)
+		}
+	}
+
+	// oidc providers are listed by name in OIDC_PROVIDERS, e.g. "google,okta",
+	// and each one is configured with OIDC_<NAME>_* variables. They replace
+	// the providers of the config file.
+	if providers := os.Getenv("OIDC_PROVIDERS"); providers != "" {
+		cfg.OIDC = nil
+		for _, name := range strings.Split(providers, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			prefix := "OIDC_" + strings.ToUpper(name) + "_"
+			oidcCfg := models.OIDCConfig{
+				Name:         strings.ToLower(name),
+				DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+				IssuerURL:    os.Getenv(prefix + "ISSUER_URL"),
+				ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+				ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+				RedirectURL:  os.Getenv(prefix + "REDIRECT_URL"),
+			}
+			if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+				oidcCfg.Scopes = strings.Fields(scopes)
+			}
+			cfg.OIDC = append(cfg.OIDC, oidcCfg)
+		}
+	}
+	return nil
+}
+
+// ValidationError lists everything that is wrong with a config, so it can be
+// fixed in one go.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks everything the server uses.
+func (cfg Config) Validate() error {
+	var problems ValidationError
+	cfg.validateCommon(&problems)
+	cfg.validateServer(&problems)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// ValidateCommand checks what command line tools use: the database, the
+// image storage, passwords and logging.
+func (cfg Config) ValidateCommand() error {
+	var problems ValidationError
+	cfg.validateCommon(&problems)
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// require adds a problem if the setting called name has no value.
+func (problems *ValidationError) require(value string, name string) {
+	if strings.TrimSpace(value) == "" {
+		*problems = append(*problems, name+" is required")
+	}
+}
+
+func (problems *ValidationError) add(format string, args ...any) {
+	*problems = append(*problems, fmt.Sprintf(format, args...))
+}
+
+func (cfg Config) validateCommon(problems *ValidationError) {
+	problems.require(cfg.PSQL.Host, "PSQL_HOST")
+	problems.require(cfg.PSQL.Port, "PSQL_PORT")
+	problems.require(cfg.PSQL.User, "PSQL_USER")
+	problems.require(cfg.PSQL.Database, "PSQL_DATABASE")
+	problems.require(cfg.Storage.ImagesDir, "IMAGES_DIR")
+
+	switch cfg.Password.Hasher {
+	case "bcrypt", "argon2id":
+	default:
+		problems.add("PASSWORD_HASHER %q is not one of bcrypt or argon2id", cfg.Password.Hasher)
+	}
+	if cfg.Password.MinLength < 1 || cfg.Password.MinLength > models.MaxPasswordBytes {
+		problems.add("PASSWORD_MIN_LENGTH has to be between 1 and %d", models.MaxPasswordBytes)
+	}
+	// 0 picks the default cost, otherwise bcrypt accepts 4 to 31
+	if cfg.Password.BcryptCost != 0 && (cfg.Password.BcryptCost < 4 || cfg.Password.BcryptCost > 31) {
+		problems.add("BCRYPT_COST has to be between 4 and 31")
+	}
+
+	switch cfg.Log.Format {
+	case logging.FormatText, logging.FormatJSON:
+	default:
+		problems.add("LOG_FORMAT %q is not one of text or json", cfg.Log.Format)
+	}
+}
+
+func (cfg Config) validateServer(problems *ValidationError) {
+	problems.require(cfg.Server.Address, "SERVER_ADDRESS")
+	if cfg.Server.AdminAddress != "" && cfg.Server.AdminAddress == cfg.Server.Address {
+		problems.add("ADMIN_ADDRESS has to differ from SERVER_ADDRESS")
+	}
+	if (cfg.Server.TLS.CertFile == "") != (cfg.Server.TLS.KeyFile == "") {
+		problems.add("TLS_CERT_FILE and TLS_KEY_FILE have to be set together")
+	}
+	if cfg.Server.MaxHeaderBytes <= 0 {
+		problems.add("MAX_HEADER_BYTES has to be positive")
+	}
+	if cfg.Server.WriteTimeout != 0 && cfg.Server.ShutdownTimeout < cfg.Server.WriteTimeout {
+		problems.add("SHUTDOWN_TIMEOUT should not be shorter than WRITE_TIMEOUT, or uploads are cut off when the server stops")
+	}
+
+	problems.require(cfg.CSRF.Key, "CSRF_KEY")
+	if cfg.CSRF.Key != "" && len(cfg.CSRF.Key) != 32 {
+		problems.add("CSRF_KEY has to be 32 bytes long, it is %d", len(cfg.CSRF.Key))
+	}
+
+	// unsubscribe links are signed with it, so they have to survive restarts
+	problems.require(cfg.Notifications.Secret, "NOTIFICATIONS_SECRET")
+
+	switch cfg.Mail.Transport {
+	case models.MailTransportSMTP:
+		problems.require(cfg.Mail.SMTP.Host, "SMTP_HOST")
+		if cfg.Mail.SMTP.Port <= 0 || cfg.Mail.SMTP.Port > 65535 {
+			problems.add("SMTP_PORT %d is not a valid port", cfg.Mail.SMTP.Port)
+		}
+	case models.MailTransportFile:
+		problems.require(cfg.Mail.Dir, "MAIL_DIR")
+	case models.MailTransportMemory:
+	default:
+		problems.add("MAIL_TRANSPORT %q is not one of smtp, file or memory", cfg.Mail.Transport)
+	}
+
+	for _, oidcCfg := range cfg.OIDC {
+		prefix := "OIDC_" + strings.ToUpper(oidcCfg.Name) + "_"
+		problems.require(oidcCfg.Name, "the name of every OIDC provider")
+		problems.require(oidcCfg.IssuerURL, prefix+"ISSUER_URL")
+		problems.require(oidcCfg.ClientID, prefix+"CLIENT_ID")
+		problems.require(oidcCfg.RedirectURL, prefix+"REDIRECT_URL")
+	}
+
+	if cfg.Registration.InviteQuota < 0 {
+		problems.add("INVITE_QUOTA cannot be negative")
+	}
+
+	switch cfg.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		problems.add("TRACING_EXPORTER %q is not one of none, otlp or stdout", cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		problems.add("TRACING_SAMPLE_RATIO has to be between 0 and 1")
+	}
+}
+
+// String prints the config as JSON with the secrets redacted, so it can be
+// logged.
+func (cfg Config) String() string {
+	cfg.PSQL.Password = redact(cfg.PSQL.Password)
+	cfg.Mail.SMTP.Password = redact(cfg.Mail.SMTP.Password)
+	cfg.CSRF.Key = redact(cfg.CSRF.Key)
+	cfg.Notifications.Secret = redact(cfg.Notifications.Secret)
+	cfg.InboundEmail.Secret = redact(cfg.InboundEmail.Secret)
+	// the slice is shared with the caller's config
+	providers := make([]models.OIDCConfig, len(cfg.OIDC))
+	for i, oidcCfg := range cfg.OIDC {
+		oidcCfg.ClientSecret = redact(oidcCfg.ClientSecret)
+		providers[i] = oidcCfg
+	}
+	cfg.OIDC = providers
+
+	b, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("config: %v", err)
+	}
+	return string(b)
+}
+
+// GoString keeps %#v from printing the secrets.
+func (cfg Config) GoString() string {
+	return cfg.String()
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// Duration is a time.Duration that is written as "30s" in JSON config files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("duration has to be a string like \"30s\": %w", err)
+	}
+	return (*durationValue)(d).Set(s)
+}
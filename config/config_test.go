@@ -0,0 +1,309 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/taherk/galleryapp/models"
+)
+
+// clearEnv hides the settings of the environment the tests run in. Empty
+// variables are ignored, like unset ones.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	var cfg Config
+	for _, s := range settings(&cfg) {
+		if s.env != "" {
+			t.Setenv(s.env, "")
+		}
+	}
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("OIDC_PROVIDERS", "")
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	defaults := Default()
+	tests := []struct {
+		name       string
+		file       string
+		env        map[string]string
+		flags      []string
+		host       string
+		minLength  int
+		inviteOnly bool
+	}{
+		{
+			name:      "defaults",
+			host:      defaults.PSQL.Host,
+			minLength: defaults.Password.MinLength,
+		},
+		{
+			name:       "file over defaults",
+			file:       `{"PSQL": {"Host": "file"}, "Password": {"MinLength": 10}, "Registration": {"InviteOnly": true}}`,
+			host:       "file",
+			minLength:  10,
+			inviteOnly: true,
+		},
+		{
+			name:       "env over file",
+			file:       `{"PSQL": {"Host": "file"}, "Password": {"MinLength": 10}, "Registration": {"InviteOnly": true}}`,
+			env:        map[string]string{"PSQL_HOST": "env", "PASSWORD_MIN_LENGTH": "11"},
+			host:       "env",
+			minLength:  11,
+			inviteOnly: true,
+		},
+		{
+			name:       "flags over env",
+			file:       `{"PSQL": {"Host": "file"}, "Password": {"MinLength": 10}}`,
+			env:        map[string]string{"PSQL_HOST": "env", "PASSWORD_MIN_LENGTH": "11", "REGISTRATION_INVITE_ONLY": "true"},
+			flags:      []string{"-db-host", "flag", "-password-min-length", "12", "-invite-only=false"},
+			host:       "flag",
+			minLength:  12,
+			inviteOnly: false,
+		},
+		{
+			name:      "empty env is ignored",
+			file:      `{"PSQL": {"Host": "file"}}`,
+			env:       map[string]string{"PSQL_HOST": ""},
+			host:      "file",
+			minLength: defaults.Password.MinLength,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.flags
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			cfg, rest, err := LoadCommand("test", append(args, "command", "arg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.PSQL.Host != tt.host {
+				t.Errorf("PSQL.Host = %q, want %q", cfg.PSQL.Host, tt.host)
+			}
+			if cfg.Password.MinLength != tt.minLength {
+				t.Errorf("Password.MinLength = %d, want %d", cfg.Password.MinLength, tt.minLength)
+			}
+			if cfg.Registration.InviteOnly != tt.inviteOnly {
+				t.Errorf("Registration.InviteOnly = %v, want %v", cfg.Registration.InviteOnly, tt.inviteOnly)
+			}
+			if !slices.Equal(rest, []string{"command", "arg"}) {
+				t.Errorf("arguments = %q, want the command and its argument", rest)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, `{"PSQL": {"Host": "file"}}`))
+
+	cfg, _, err := LoadCommand("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.PSQL.Host != "file" {
+		t.Errorf("PSQL.Host = %q, want the one of CONFIG_FILE", cfg.PSQL.Host)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags []string
+		want  string
+	}{
+		{
+			name: "unknown key",
+			file: `{"PSQL": {"Hots": "db"}}`,
+			want: `unknown field "Hots"`,
+		},
+		{
+			name: "unknown section",
+			file: `{"Database": {}}`,
+			want: `unknown field "Database"`,
+		},
+		{
+			name: "invalid JSON",
+			file: `{"PSQL": `,
+			want: "reading config file",
+		},
+		{
+			name: "invalid env value",
+			env:  map[string]string{"PASSWORD_MIN_LENGTH": "ten"},
+			want: "invalid PASSWORD_MIN_LENGTH",
+		},
+		{
+			name:  "unknown flag",
+			flags: []string{"-db-hots", "db"},
+			want:  "flag provided but not defined: -db-hots",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.flags
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, tt.file)}, args...)
+			}
+
+			_, _, err := LoadCommand("test", args)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadCommand() err = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// validConfig passes Validate.
+func validConfig() Config {
+	cfg := Default()
+	cfg.CSRF.Key = strings.Repeat("k", 32)
+	cfg.Notifications.Secret = "notifications secret"
+	cfg.Mail.SMTP.Host = "smtp.example.com"
+	return cfg
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			change: func(cfg *Config) {},
+		},
+		{
+			name: "several problems at once",
+			change: func(cfg *Config) {
+				cfg.PSQL.Host = ""
+				cfg.CSRF.Key = "short"
+				cfg.Notifications.Secret = ""
+				cfg.Mail.SMTP.Host = ""
+				cfg.Log.Format = "xml"
+			},
+			want: []string{
+				"PSQL_HOST is required",
+				"CSRF_KEY has to be 32 bytes long, it is 5",
+				"NOTIFICATIONS_SECRET is required",
+				"SMTP_HOST is required",
+				`LOG_FORMAT "xml" is not one of text or json`,
+			},
+		},
+		{
+			name: "incomplete OIDC provider",
+			change: func(cfg *Config) {
+				cfg.OIDC = []models.OIDCConfig{{Name: "okta", IssuerURL: "https://okta.example.com"}}
+			},
+			want: []string{"OIDC_OKTA_CLIENT_ID is required", "OIDC_OKTA_REDIRECT_URL is required"},
+		},
+		{
+			name: "out of range",
+			change: func(cfg *Config) {
+				cfg.Registration.InviteQuota = -1
+				cfg.Password.BcryptCost = 40
+				cfg.Tracing.SampleRatio = 2
+			},
+			want: []string{
+				"INVITE_QUOTA cannot be negative",
+				"BCRYPT_COST has to be between 4 and 31",
+				"TRACING_SAMPLE_RATIO has to be between 0 and 1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.change(&cfg)
+
+			err := cfg.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want no problems", err)
+				}
+				return
+			}
+			var problems ValidationError
+			if !errors.As(err, &problems) {
+				t.Fatalf("Validate() = %v, want a ValidationError", err)
+			}
+			for _, want := range tt.want {
+				if !slices.Contains(problems, want) {
+					t.Errorf("problems = %q, want %q among them", problems, want)
+				}
+			}
+			if len(problems) != len(tt.want) {
+				t.Errorf("got %d problems %q, want %d", len(problems), problems, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	// commands don't serve HTTP or send mail
+	cfg := Default()
+	err := cfg.ValidateCommand()
+	if err != nil {
+		t.Errorf("ValidateCommand() = %v, want no problems without CSRF_KEY and SMTP_HOST", err)
+	}
+
+	cfg.PSQL.Host = ""
+	cfg.Password.Hasher = "md5"
+	var problems ValidationError
+	if !errors.As(cfg.ValidateCommand(), &problems) || len(problems) != 2 {
+		t.Errorf("ValidateCommand() = %v, want the database host and the hasher", problems)
+	}
+}
+
+func TestStringRedactsSecrets(t *testing.T) {
+	cfg := validConfig()
+	cfg.PSQL.Password = "secret-psql"
+	cfg.Mail.SMTP.Password = "secret-smtp"
+	cfg.CSRF.Key = "secret-csrf-key-0123456789abcdef"
+	cfg.Notifications.Secret = "secret-notifications"
+	cfg.InboundEmail.Secret = "secret-inbound"
+	cfg.OIDC = []models.OIDCConfig{
+		{Name: "google", ClientID: "google-client", ClientSecret: "secret-google"},
+		{Name: "okta", ClientID: "okta-client", ClientSecret: "secret-okta"},
+	}
+
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s"} {
+		out := fmt.Sprintf(verb, cfg)
+		if strings.Contains(out, "secret-") {
+			t.Errorf("%s prints a secret:\n%s", verb, out)
+		}
+		if !strings.Contains(out, "REDACTED") || !strings.Contains(out, "okta-client") {
+			t.Errorf("%s does not print the redacted config:\n%s", verb, out)
+		}
+	}
+	if cfg.OIDC[1].ClientSecret != "secret-okta" {
+		t.Errorf("String() changed the client secret of the config to %q", cfg.OIDC[1].ClientSecret)
+	}
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"flag"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// setting is a config value that can be set by an environment variable, a
+// flag, or both. Secrets have no flag, because command lines are visible to
+// every user of the machine.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func settings(cfg *Config) []setting {
+	return []setting{
+		{"PSQL_HOST", "db-host", "Postgres host", (*stringValue)(&cfg.PSQL.Host)},
+		{"PSQL_PORT", "db-port", "Postgres port", (*stringValue)(&cfg.PSQL.Port)},
+		{"PSQL_USER", "db-user", "Postgres user", (*stringValue)(&cfg.PSQL.User)},
+		{"PSQL_PASSWORD", "", "", (*stringValue)(&cfg.PSQL.Password)},
+		{"PSQL_DATABASE", "db-name", "Postgres database", (*stringValue)(&cfg.PSQL.Database)},
+		{"PSQL_SSLMODE", "db-sslmode", "Postgres sslmode", (*stringValue)(&cfg.PSQL.SSLMode)},
+
+		{"MAIL_TRANSPORT", "mail-transport", "how emails are sent: smtp, file or memory", (*stringValue)(&cfg.Mail.Transport)},
+		{"MAIL_DIR", "mail-dir", "directory the file mail transport writes to", (*stringValue)(&cfg.Mail.Dir)},
+		{"SMTP_HOST", "smtp-host", "SMTP host", (*stringValue)(&cfg.Mail.SMTP.Host)},
+		{"SMTP_PORT", "smtp-port", "SMTP port", (*intValue)(&cfg.Mail.SMTP.Port)},
+		{"SMTP_USERNAME", "smtp-username", "SMTP username", (*stringValue)(&cfg.Mail.SMTP.Username)},
+		{"SMTP_PASSWORD", "", "", (*stringValue)(&cfg.Mail.SMTP.Password)},
+
+		{"CSRF_KEY", "", "", (*stringValue)(&cfg.CSRF.Key)},
+		{"CSRF_SECURE", "csrf-secure", "only send the CSRF cookie over https", (*boolValue)(&cfg.CSRF.Secure)},
+
+		{"SERVER_ADDRESS", "addr", "address the server listens on", (*stringValue)(&cfg.Server.Address)},
+		{"ADMIN_ADDRESS", "admin-addr", "address of the admin listener serving /metrics, or off", (*stringValue)(&cfg.Server.AdminAddress)},
+		{"DEV_MODE", "dev", "enable development routes", (*boolValue)(&cfg.Server.Dev)},
+		{"READ_HEADER_TIMEOUT", "read-header-timeout", "time to read the request headers", (*durationValue)(&cfg.Server.ReadHeaderTimeout)},
+		{"READ_TIMEOUT", "read-timeout", "time to read the whole request", (*durationValue)(&cfg.Server.ReadTimeout)},
+		{"WRITE_TIMEOUT", "write-timeout", "time to handle a request and write the response", (*durationValue)(&cfg.Server.WriteTimeout)},
+		{"IDLE_TIMEOUT", "idle-timeout", "time keep-alive connections stay open", (*durationValue)(&cfg.Server.IdleTimeout)},
+		{"MAX_HEADER_BYTES", "max-header-bytes", "maximum size of the request headers", (*intValue)(&cfg.Server.MaxHeaderBytes)},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "time in-flight requests get to finish on shutdown", (*durationValue)(&cfg.Server.ShutdownTimeout)},
+		{"TLS_CERT_FILE", "tls-cert", "TLS certificate file, reloaded when it changes", (*stringValue)(&cfg.Server.TLS.CertFile)},
+		{"TLS_KEY_FILE", "tls-key", "TLS key file, reloaded when it changes", (*stringValue)(&cfg.Server.TLS.KeyFile)},
+
+		{"IMAGES_DIR", "images-dir", "directory gallery images are stored in", (*stringValue)(&cfg.Storage.ImagesDir)},
+
+		{"REGISTRATION_INVITE_ONLY", "invite-only", "only allow sign ups with an invite", (*boolValue)(&cfg.Registration.InviteOnly)},
+		{"INVITE_QUOTA", "invite-quota", "number of invites every user that is not an admin can send, 0 turns invites off", (*intValue)(&cfg.Registration.InviteQuota)},
+
+		{"NOTIFICATIONS_SECRET", "", "", (*stringValue)(&cfg.Notifications.Secret)},
+
+		{"INBOUND_EMAIL_DOMAIN", "inbound-email-domain", "domain of the gallery email addresses", (*stringValue)(&cfg.InboundEmail.Domain)},
+		{"INBOUND_EMAIL_SECRET", "", "", (*stringValue)(&cfg.InboundEmail.Secret)},
+
+		{"PASSWORD_MIN_LENGTH", "password-min-length", "minimum password length", (*intValue)(&cfg.Password.MinLength)},
+		{"PASSWORD_HASHER", "password-hasher", "password hasher: bcrypt or argon2id", (*stringValue)(&cfg.Password.Hasher)},
+		{"BCRYPT_COST", "bcrypt-cost", "bcrypt cost, 0 for the default", (*intValue)(&cfg.Password.BcryptCost)},
+
+		{"LOG_LEVEL", "log-level", "minimum log level: debug, info, warn or error", (*levelValue)(&cfg.Log.Level)},
+		{"LOG_FORMAT", "log-format", "log format: text or json", (*stringValue)(&cfg.Log.Format)},
+		{"TRACING_EXPORTER", "tracing-exporter", "where traces are sent: none, otlp or stdout", (*stringValue)(&cfg.Tracing.Exporter)},
+		{"TRACING_ENDPOINT", "tracing-endpoint", "host:port of the OTLP/HTTP collector", (*stringValue)(&cfg.Tracing.Endpoint)},
+		{"TRACING_INSECURE", "tracing-insecure", "send traces to the collector over plain HTTP", (*boolValue)(&cfg.Tracing.Insecure)},
+		{"TRACING_SAMPLE_RATIO", "tracing-sample-ratio", "share of traces that are recorded, from 0 to 1", (*floatValue)(&cfg.Tracing.SampleRatio)},
+	}
+}
+
+// flagSet defines a flag for every setting that has one, writing to the
+// config the settings point to. The path of the config file is written to
+// path.
+func flagSet(name string, settings []setting, path *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(path, "config", "", "path of a JSON config file, also read from CONFIG_FILE")
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		usage := s.usage
+		if s.env != "" {
+			usage += ", also read from " + s.env
+		}
+		fs.Var(s.value, s.flag, usage)
+	}
+	return fs
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(n)
+	return nil
+}
+
+func (v *intValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *boolValue) String() string {
+	return strconv.FormatBool(bool(*v))
+}
+
+// IsBoolFlag allows -dev instead of -dev=true.
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+type floatValue float64
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
+
+type durationValue Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*v = durationValue(d)
+	return nil
+}
+
+func (v *durationValue) String() string {
+	return time.Duration(*v).String()
+}
+
+type levelValue slog.Level
+
+func (v *levelValue) Set(s string) error {
+	return (*slog.Level)(v).UnmarshalText([]byte(s))
+}
+
+func (v *levelValue) String() string {
+	return slog.Level(*v).String()
+}
@@ -13,7 +13,11 @@ import (
 type key string
 
 const (
-	userKey key = "user"
+	userKey     key = "user"
+	apiTokenKey key = "api-token"
+	// the admin that is impersonating the user of a request
+	impersonatorKey key = "impersonator"
+	requestIDKey    key = "request-id"
 )
 
 func WithUser(ctx context.Context, user *models.User) context.Context {
@@ -32,3 +36,48 @@ func User(ctx context.Context) *models.User {
 
 	return user
 }
+
+// WithAPIToken stores the API token a request was authenticated with. Requests
+// authenticated with a session cookie have no API token.
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, apiTokenKey, token)
+}
+
+func APIToken(ctx context.Context) *models.APIToken {
+	val := ctx.Value(apiTokenKey)
+	token, ok := val.(*models.APIToken)
+	if !ok {
+		return nil
+	}
+
+	return token
+}
+
+func WithImpersonator(ctx context.Context, admin *models.User) context.Context {
+	return context.WithValue(ctx, impersonatorKey, admin)
+}
+
+// Impersonator returns the admin that is acting as the current user, or nil
+// if the request is not part of an impersonation.
+func Impersonator(ctx context.Context) *models.User {
+	val := ctx.Value(impersonatorKey)
+	admin, ok := val.(*models.User)
+	if !ok {
+		return nil
+	}
+
+	return admin
+}
+
+// WithRequestID stores the ID that identifies a request in the logs and in the
+// security audit trail.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID of the request, or an empty string outside of a
+// request.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
@@ -0,0 +1,347 @@
+package controllers
+
+import (
+	stdctx "context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	// number of audit log entries shown in the admin console
+	adminAuditLogLimit = 200
+	// number of security events in a CSV export
+	adminSecurityExportLimit = 100000
+)
+
+type Admin struct {
+	Templates struct {
+		Users          Template
+		Galleries      Template
+		AuditLog       Template
+		SecurityEvents Template
+		Emails         Template
+	}
+
+	UserService          UserService
+	SessionService       SessionService
+	GalleryService       GalleryService
+	PasswordResetService PasswordResetService
+	EmailService         EmailService
+	ImpersonationService ImpersonationService
+	AdminAuditService    AdminAuditService
+	SecurityEventService SecurityEventService
+	EmailOutboxService   EmailOutboxService
+}
+
+func (a Admin) Users(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Query string
+		Users []models.User
+	}
+	data.Query = r.FormValue("q")
+
+	users, err := a.UserService.Search(r.Context(), data.Query)
+	if err != nil {
+		logError(r, "searching users", err)
+		a.Templates.Users.Execute(w, r, data, err)
+		return
+	}
+	data.Users = users
+
+	a.Templates.Users.Execute(w, r, data)
+}
+
+func (a Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, true)
+}
+
+func (a Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	a.setUserDisabled(w, r, false)
+}
+
+func (a Admin) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) {
+	admin := context.User(r.Context())
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if user.ID == admin.ID {
+		http.Error(w, "You cannot disable your own account", http.StatusBadRequest)
+		return
+	}
+
+	err = a.UserService.SetDisabled(r.Context(), int(user.ID), disabled)
+	if err != nil {
+		logError(r, "updating disabled user", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	action := models.AdminActionEnableUser
+	if disabled {
+		action = models.AdminActionDisableUser
+		// sessions of disabled users stop working
+		event := securityEvent(r, models.SecurityEventSessionsRevoked, user)
+		event.Details = "account disabled"
+		recordSecurityEvent(r, a.SecurityEventService, event)
+	}
+	a.record(r, admin, action, int(user.ID), 0, "")
+
+	http.Redirect(w, r, "/admin/users?q="+url.QueryEscape(user.Email), http.StatusFound)
+}
+
+// ForcePasswordReset replaces the user's password with a random one, signs
+// them out everywhere and emails them a password reset link.
+func (a Admin) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	password, err := rand.String(models.MinSessionTokenBytes)
+	if err != nil {
+		logError(r, "generating password", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = a.UserService.UpdatePassword(r.Context(), int(user.ID), password)
+	if err != nil {
+		logError(r, "updating password", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = a.SessionService.DeleteByUserID(r.Context(), user.ID)
+	if err != nil {
+		logError(r, "deleting sessions", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.record(r, admin, models.AdminActionForcePasswordReset, int(user.ID), 0, "")
+	event := securityEvent(r, models.SecurityEventPasswordReset, user)
+	event.Details = "forced by an admin"
+	recordSecurityEvent(r, a.SecurityEventService, event)
+	event = securityEvent(r, models.SecurityEventSessionsRevoked, user)
+	event.Details = "forced password reset"
+	recordSecurityEvent(r, a.SecurityEventService, event)
+
+	_, err = a.PasswordResetService.Create(r.Context(), user.Email, func(ctx stdctx.Context, pwReset *models.PasswordReset) error {
+		return a.EmailService.ForgotPassword(ctx, pwReset.TokenHash, user.Email, resetPasswordURL(pwReset))
+	})
+	if err != nil {
+		logError(r, "sending password reset", err)
+		http.Error(w, "The password was reset, but the email could not be sent", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/users?q="+url.QueryEscape(user.Email), http.StatusFound)
+}
+
+func (a Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if user.ID == admin.ID {
+		http.Error(w, "You cannot impersonate yourself", http.StatusBadRequest)
+		return
+	}
+
+	impersonation, err := a.ImpersonationService.Start(r.Context(), int(admin.ID), int(user.ID))
+	if err != nil {
+		logError(r, "starting impersonation", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.record(r, admin, models.AdminActionStartImpersonation, int(user.ID), 0, "")
+
+	setCookie(w, CookieImpersonation, impersonation.Token)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// StopImpersonation is not behind RequireAdmin, because while impersonating
+// the current user is the impersonated user.
+func (a Admin) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+	admin := context.Impersonator(r.Context())
+	if admin == nil {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	user := context.User(r.Context())
+
+	token, err := readCookie(r, CookieImpersonation)
+	if err == nil {
+		err = a.ImpersonationService.Stop(r.Context(), token)
+		if err != nil {
+			logError(r, "stopping impersonation", err)
+		}
+	}
+	deleteCookie(w, CookieImpersonation)
+	a.record(r, admin, models.AdminActionStopImpersonation, int(user.ID), 0, "")
+
+	http.Redirect(w, r, "/admin/users?q="+url.QueryEscape(user.Email), http.StatusFound)
+}
+
+func (a Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Galleries []models.Gallery
+	}
+
+	galleries, err := a.GalleryService.All(r.Context())
+	if err != nil {
+		logError(r, "loading galleries", err)
+		a.Templates.Galleries.Execute(w, r, data, err)
+		return
+	}
+	data.Galleries = galleries
+
+	a.Templates.Galleries.Execute(w, r, data)
+}
+
+func (a Admin) TakeDownGallery(w http.ResponseWriter, r *http.Request) {
+	a.setGalleryTakenDown(w, r, true)
+}
+
+func (a Admin) RestoreGallery(w http.ResponseWriter, r *http.Request) {
+	a.setGalleryTakenDown(w, r, false)
+}
+
+func (a Admin) setGalleryTakenDown(w http.ResponseWriter, r *http.Request, takenDown bool) {
+	admin := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+	gallery, err := a.GalleryService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Gallery not found", http.StatusNotFound)
+			return
+		}
+		logError(r, "loading gallery", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	err = a.GalleryService.SetTakenDown(r.Context(), gallery.ID, takenDown)
+	if err != nil {
+		logError(r, "updating taken down gallery", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	action := models.AdminActionRestoreGallery
+	if takenDown {
+		action = models.AdminActionTakeDownGallery
+	}
+	a.record(r, admin, action, gallery.UserID, gallery.ID, r.FormValue("reason"))
+
+	http.Redirect(w, r, "/admin/galleries", http.StatusFound)
+}
+
+func (a Admin) AuditLog(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Actions []models.AdminAction
+	}
+
+	actions, err := a.AdminAuditService.Recent(r.Context(), adminAuditLogLimit)
+	if err != nil {
+		logError(r, "loading audit log", err)
+		a.Templates.AuditLog.Execute(w, r, data, err)
+		return
+	}
+	data.Actions = actions
+
+	a.Templates.AuditLog.Execute(w, r, data)
+}
+
+func (a Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	user, err := a.UserService.ByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return nil, err
+		}
+		logError(r, "loading user", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// record adds an entry to the admin audit log. Zero IDs are stored as NULL.
+// Failing to record an action that already happened is only logged.
+func (a Admin) record(r *http.Request, admin *models.User, action string, targetUserID int, targetGalleryID int, details string) {
+	var userID, galleryID *int
+	if targetUserID != 0 {
+		userID = &targetUserID
+	}
+	if targetGalleryID != 0 {
+		galleryID = &targetGalleryID
+	}
+
+	err := a.AdminAuditService.Record(r.Context(), admin, action, userID, galleryID, details)
+	if err != nil {
+		logError(r, "recording admin action", err)
+	}
+}
+
+func (a Admin) Emails(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Status   string
+		Statuses []string
+		Messages []models.OutboxMessage
+	}
+	data.Status = r.FormValue("status")
+	data.Statuses = []string{models.OutboxStatusPending, models.OutboxStatusDead, models.OutboxStatusSent}
+
+	messages, err := a.EmailOutboxService.Messages(r.Context(), data.Status, adminAuditLogLimit)
+	if err != nil {
+		logError(r, "loading outbox messages", err)
+		a.Templates.Emails.Execute(w, r, data, err)
+		return
+	}
+	data.Messages = messages
+
+	a.Templates.Emails.Execute(w, r, data)
+}
+
+func (a Admin) RetryEmail(w http.ResponseWriter, r *http.Request) {
+	admin := context.User(r.Context())
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = a.EmailOutboxService.Retry(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Email not found or already sent", http.StatusNotFound)
+			return
+		}
+		logError(r, "retrying email", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	a.record(r, admin, models.AdminActionRetryEmail, 0, 0, fmt.Sprintf("outbox message %d", id))
+
+	http.Redirect(w, r, "/admin/emails?status="+url.QueryEscape(r.FormValue("status")), http.StatusFound)
+}
@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/models"
+)
+
+// isAPIRequest reports whether the request was authenticated with an API
+// token, in which case handlers respond with JSON instead of HTML.
+func isAPIRequest(r *http.Request) bool {
+	return context.APIToken(r.Context()) != nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Error("writing JSON response", "err", err)
+	}
+}
+
+type apiGalleryResponse struct {
+	ID     int                `json:"id"`
+	Title  string             `json:"title"`
+	Images []apiImageResponse `json:"images,omitempty"`
+}
+
+type apiImageResponse struct {
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+func apiGallery(gallery *models.Gallery, images []Image) apiGalleryResponse {
+	resp := apiGalleryResponse{
+		ID:    gallery.ID,
+		Title: gallery.Title,
+	}
+	for _, image := range images {
+		resp.Images = append(resp.Images, apiImageResponse{
+			Filename: image.Filename,
+			URL:      image.URL,
+		})
+	}
+	return resp
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/models"
+)
+
+func (u Users) APITokens(w http.ResponseWriter, r *http.Request) {
+	u.renderAPITokens(w, r, nil)
+}
+
+func (u Users) ProcessCreateAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	err := r.ParseForm()
+	if err != nil {
+		u.renderAPITokens(w, r, nil, err)
+		return
+	}
+	name := r.FormValue("name")
+	scopes := r.Form["scopes"]
+	if name == "" || len(scopes) == 0 {
+		err := errors.Public(fmt.Errorf("missing token name or scopes"), "Please name the token and select at least one scope")
+		u.renderAPITokens(w, r, nil, err)
+		return
+	}
+
+	var expiresAt *time.Time
+	if days := r.FormValue("expires_in_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			err := errors.Public(fmt.Errorf("invalid expiry: %q", days), "The expiry has to be a number of days")
+			u.renderAPITokens(w, r, nil, err)
+			return
+		}
+		t := time.Now().AddDate(0, 0, n)
+		expiresAt = &t
+	}
+
+	token, err := u.APITokenService.Create(r.Context(), int(user.ID), name, scopes, expiresAt)
+	if err != nil {
+		logError(r, "creating API token", err)
+		u.renderAPITokens(w, r, nil, err)
+		return
+	}
+
+	// this is the only time the token is shown, since only its hash is stored
+	u.renderAPITokens(w, r, token)
+}
+
+func (u Users) ProcessDeleteAPIToken(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusNotFound)
+		return
+	}
+
+	err = u.APITokenService.Delete(r.Context(), int(user.ID), id)
+	if err != nil {
+		logError(r, "deleting API token", err)
+		u.renderAPITokens(w, r, nil, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me/tokens", http.StatusFound)
+}
+
+func (u Users) renderAPITokens(w http.ResponseWriter, r *http.Request, newToken *models.APIToken, errs ...error) {
+	user := context.User(r.Context())
+	var data struct {
+		Tokens   []models.APIToken
+		NewToken *models.APIToken
+		Scopes   []string
+	}
+	data.NewToken = newToken
+	data.Scopes = models.Scopes
+
+	tokens, err := u.APITokenService.ByUserID(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "loading API tokens", err)
+		errs = append(errs, err)
+	}
+	data.Tokens = tokens
+
+	u.Templates.APITokens.Execute(w, r, data, errs...)
+}
@@ -0,0 +1,393 @@
+package controllers
+
+import (
+	stdctx "context"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/templates"
+	"github.com/taherk/galleryapp/views"
+)
+
+// Both backends have to satisfy the interfaces the controllers depend on.
+var (
+	_ UserService          = (*models.UserService)(nil)
+	_ UserService          = (*models.MemoryUserService)(nil)
+	_ SessionService       = (*models.SessionService)(nil)
+	_ SessionService       = (*models.MemorySessionService)(nil)
+	_ PasswordResetService = (*models.PasswordResetService)(nil)
+	_ PasswordResetService = (*models.MemoryPasswordResetService)(nil)
+	_ EmailChangeService   = (*models.EmailChangeService)(nil)
+	_ EmailChangeService   = (*models.MemoryEmailChangeService)(nil)
+	_ SignInLinkService    = (*models.SignInLinkService)(nil)
+	_ SignInLinkService    = (*models.MemorySignInLinkService)(nil)
+	_ AccountService       = (*models.AccountService)(nil)
+	_ AccountService       = (*models.MemoryAccountService)(nil)
+	_ APITokenService      = (*models.APITokenService)(nil)
+	_ APITokenService      = (*models.MemoryAPITokenService)(nil)
+	_ IdentityService      = (*models.IdentityService)(nil)
+	_ IdentityService      = (*models.MemoryIdentityService)(nil)
+	_ InviteService        = (*models.InviteService)(nil)
+	_ InviteService        = (*models.MemoryInviteService)(nil)
+	_ SecurityEventService = (*models.SecurityEventService)(nil)
+	_ SecurityEventService = (*models.MemorySecurityEventService)(nil)
+	_ NotificationService  = (*models.NotificationService)(nil)
+	_ NotificationService  = (*models.MemoryNotificationService)(nil)
+	_ EmailService         = (*models.EmailService)(nil)
+	_ GalleryService       = (*models.GalleryService)(nil)
+	_ GalleryService       = (*models.MemoryGalleryService)(nil)
+	_ InboundEmailService  = (*models.InboundEmailService)(nil)
+	_ InboundEmailService  = (*models.MemoryInboundEmailService)(nil)
+	_ ShareLinkService     = (*models.ShareLinkService)(nil)
+	_ ShareLinkService     = (*models.MemoryShareLinkService)(nil)
+	_ ImpersonationService = (*models.ImpersonationService)(nil)
+	_ ImpersonationService = (*models.MemoryImpersonationService)(nil)
+	_ AdminAuditService    = (*models.AdminAuditService)(nil)
+	_ AdminAuditService    = (*models.MemoryAdminAuditService)(nil)
+	_ EmailOutboxService   = (*models.EmailOutboxService)(nil)
+	_ EmailOutboxService   = (*models.MemoryEmailOutboxService)(nil)
+	_ Transactor           = models.Transactor{}
+	_ Transactor           = (*models.MemoryStore)(nil)
+)
+
+const testPassword = "correct horse battery"
+
+// testApp serves the users and galleries routes of main.go, backed by the
+// in-memory services.
+type testApp struct {
+	*httptest.Server
+	t *testing.T
+
+	mailer         *models.MemoryMailer
+	users          *models.MemoryUserService
+	sessions       *models.MemorySessionService
+	galleries      *models.MemoryGalleryService
+	invites        *models.MemoryInviteService
+	apiTokens      *models.MemoryAPITokenService
+	securityEvents *models.MemorySecurityEventService
+	notifications  *models.MemoryNotificationService
+	shareLinks     *models.MemoryShareLinkService
+}
+
+// newTestApp starts the app. The options can change the Users controller
+// before the routes are set up.
+func newTestApp(t *testing.T, opts ...func(*Users)) *testApp {
+	t.Helper()
+
+	store := &models.MemoryStore{}
+	app := &testApp{
+		t:      t,
+		mailer: &models.MemoryMailer{},
+		users: &models.MemoryUserService{
+			Store: store,
+			// the lowest cost keeps the tests fast
+			PasswordHasher: &models.BcryptHasher{Cost: bcrypt.MinCost},
+		},
+		sessions:       &models.MemorySessionService{Store: store},
+		galleries:      &models.MemoryGalleryService{Store: store, ImagesDir: t.TempDir()},
+		invites:        &models.MemoryInviteService{Store: store},
+		apiTokens:      &models.MemoryAPITokenService{Store: store},
+		securityEvents: &models.MemorySecurityEventService{Store: store},
+		notifications:  &models.MemoryNotificationService{Store: store, Secret: []byte("test secret")},
+		shareLinks:     &models.MemoryShareLinkService{Store: store},
+	}
+	emailService, err := models.NewEmailService(app.mailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	umw := UserMiddleware{
+		SessionService:       app.sessions,
+		APITokenService:      app.apiTokens,
+		ImpersonationService: &models.MemoryImpersonationService{Store: store},
+		AdminAuditService:    &models.MemoryAdminAuditService{Store: store},
+	}
+
+	usersC := Users{
+		Tx:                   store,
+		UserService:          app.users,
+		SessionService:       app.sessions,
+		PasswordResetService: &models.MemoryPasswordResetService{Store: store},
+		EmailChangeService:   &models.MemoryEmailChangeService{Store: store},
+		AccountService: &models.MemoryAccountService{
+			Store:          store,
+			UserService:    app.users,
+			GalleryService: app.galleries,
+			SessionService: app.sessions,
+		},
+		SignInLinkService:    &models.MemorySignInLinkService{Store: store},
+		APITokenService:      app.apiTokens,
+		IdentityService:      &models.MemoryIdentityService{Store: store},
+		InviteService:        app.invites,
+		SecurityEventService: app.securityEvents,
+		NotificationService:  app.notifications,
+		EmailService:         emailService,
+	}
+	usersC.Templates.New = mustParse(t, "sign-up.gohtml")
+	usersC.Templates.SignIn = mustParse(t, "sign-in.gohtml")
+	usersC.Templates.ForgotPassword = mustParse(t, "forgot-pw.gohtml")
+	usersC.Templates.ResetPassword = mustParse(t, "reset-pw.gohtml")
+	usersC.Templates.CheckYourEmail = mustParse(t, "check-your-email.gohtml")
+	usersC.Templates.Settings = mustParse(t, "settings.gohtml")
+	for _, opt := range opts {
+		opt(&usersC)
+	}
+
+	galleriesC := Galleries{
+		GalleryService:       app.galleries,
+		SecurityEventService: app.securityEvents,
+		InboundEmailService: &models.MemoryInboundEmailService{
+			Store:          store,
+			GalleryService: app.galleries,
+		},
+		NotificationService: app.notifications,
+		ShareLinkService:    app.shareLinks,
+	}
+	galleriesC.Templates.New = mustParse(t, "galleries/new.gohtml")
+	galleriesC.Templates.Edit = mustParse(t, "galleries/edit.gohtml")
+	galleriesC.Templates.Index = mustParse(t, "galleries/index.gohtml")
+	galleriesC.Templates.Show = mustParse(t, "galleries/show.gohtml")
+
+	r := chi.NewRouter()
+	r.Use(umw.SetUser)
+	r.Get("/signup", usersC.New)
+	r.Get("/signin", usersC.SignIn)
+	r.Route("/users/me", func(r chi.Router) {
+		r.Use(umw.RequireUser)
+		r.Get("/", usersC.CurrentUser)
+		r.Post("/password", usersC.ProcessUpdatePassword)
+		r.Post("/email", usersC.ProcessUpdateEmail)
+		r.Get("/export", usersC.ExportData)
+	})
+	r.Post("/users", usersC.Create)
+	r.Post("/signin", usersC.ProcessSignIn)
+	r.Post("/signin/link", usersC.ProcessSignInLink)
+	r.Get("/signin/link", usersC.SignInWithLink)
+	r.Post("/signout", usersC.ProcessSignout)
+	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
+	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.Get("/confirm-email", usersC.ConfirmEmail)
+	r.Route("/galleries", func(r chi.Router) {
+		r.Use(umw.SetTokenUser)
+		r.With(umw.RequireScope(models.ScopeGalleriesRead)).Get("/{id}", galleriesC.Show)
+		r.Get("/{id}/images/{filename}", galleriesC.Image)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireScope(models.ScopeGalleriesRead))
+				r.Get("/", galleriesC.Index)
+				r.Get("/{id}/edit", galleriesC.Edit)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireScope(models.ScopeGalleriesWrite))
+				r.Post("/", galleriesC.Create)
+				r.Post("/{id}", galleriesC.Update)
+				r.Post("/{id}/delete", galleriesC.Delete)
+				r.Post("/{id}/inbound-address", galleriesC.ResetInboundAddress)
+				r.Post("/{id}/share-links", galleriesC.CreateShareLink)
+				r.Post("/{id}/share-links/{linkID}/delete", galleriesC.DeleteShareLink)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireScope(models.ScopeImagesWrite))
+				r.Post("/{id}/images", galleriesC.UploadImage)
+				r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			})
+		})
+	})
+	r.Get("/share/{token}", galleriesC.Shared)
+
+	app.Server = httptest.NewServer(r)
+	t.Cleanup(app.Close)
+	return app
+}
+
+func mustParse(t *testing.T, pattern string) Template {
+	t.Helper()
+	tpl, err := views.ParseFS(templates.FS, pattern, "tailwind.gohtml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tpl
+}
+
+// createUser signs up a user directly through the user service.
+func (app *testApp) createUser(email string) *models.User {
+	app.t.Helper()
+	user, err := app.users.Create(stdctx.Background(), email, testPassword)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return user
+}
+
+// client returns a browser without any cookies.
+func (app *testApp) client() *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return &testClient{
+		t:    app.t,
+		base: app.URL,
+		http: &http.Client{
+			Jar: jar,
+			// redirects are checked by the tests
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// signedIn returns a browser with a session of the user.
+func (app *testApp) signedIn(user *models.User) *testClient {
+	app.t.Helper()
+	session, err := app.sessions.Create(stdctx.Background(), user.ID)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	c := app.client()
+	c.setCookie(CookieSession, session.Token)
+	return c
+}
+
+// withToken returns an API client with a token of the user that has the
+// scopes.
+func (app *testApp) withToken(user *models.User, scopes ...string) *testClient {
+	app.t.Helper()
+	token, err := app.apiTokens.Create(stdctx.Background(), int(user.ID), "test", scopes, nil)
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	c := app.client()
+	c.bearer = token.Token
+	return c
+}
+
+// events returns the recorded security events of the kind, newest first.
+func (app *testApp) events(event string) []models.SecurityEvent {
+	app.t.Helper()
+	events, err := app.securityEvents.Search(stdctx.Background(), models.SecurityEventFilter{Event: event})
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return events
+}
+
+var tokenRe = regexp.MustCompile(`token=([^\s"&<]+)`)
+
+// lastToken returns the token of the link in the last email sent to the
+// address.
+func (app *testApp) lastToken(to string) string {
+	app.t.Helper()
+	sent := app.mailer.Sent()
+	for i := len(sent) - 1; i >= 0; i-- {
+		if sent[i].To != to {
+			continue
+		}
+		match := tokenRe.FindStringSubmatch(sent[i].Plaintext)
+		if match == nil {
+			app.t.Fatalf("email to %s has no token: %q", to, sent[i].Plaintext)
+		}
+		token, err := url.QueryUnescape(match[1])
+		if err != nil {
+			app.t.Fatal(err)
+		}
+		return token
+	}
+	app.t.Fatalf("no email sent to %s", to)
+	return ""
+}
+
+type testClient struct {
+	t    *testing.T
+	base string
+	http *http.Client
+	// bearer is sent as the API token of every request, if set
+	bearer string
+}
+
+func (c *testClient) get(path string) (*http.Response, string) {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, c.base+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return c.do(req)
+}
+
+func (c *testClient) post(path string, form url.Values) (*http.Response, string) {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.base+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req)
+}
+
+// do sends the request and returns the response with its body read.
+func (c *testClient) do(req *http.Request) (*http.Response, string) {
+	c.t.Helper()
+	if c.bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearer)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func (c *testClient) setCookie(name string, value string) {
+	u, err := url.Parse(c.base)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.http.Jar.SetCookies(u, []*http.Cookie{{Name: name, Value: value, Path: "/"}})
+}
+
+func (c *testClient) cookie(name string) string {
+	u, err := url.Parse(c.base)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for _, cookie := range c.http.Jar.Cookies(u) {
+		if cookie.Name == name {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func assertRedirect(t *testing.T, resp *http.Response, location string) {
+	t.Helper()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	if got := resp.Header.Get("Location"); got != location {
+		t.Fatalf("redirected to %q, want %q", got, location)
+	}
+}
+
+func assertStatus(t *testing.T, resp *http.Response, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, status)
+	}
+}
@@ -7,6 +7,15 @@ import (
 
 const (
 	CookieSession = "session"
+	// the oauth cookies keep the state of a sign in with an identity provider
+	// until the provider redirects back to us.
+	CookieOAuthState    = "oauth_state"
+	CookieOAuthNonce    = "oauth_nonce"
+	CookieOAuthVerifier = "oauth_verifier"
+	// binds a sign in link to the browser that requested it
+	CookieSignInNonce = "signin_nonce"
+	// lets an admin act as another user
+	CookieImpersonation = "impersonation"
 )
 
 func newCookie(name string, value string) *http.Cookie {
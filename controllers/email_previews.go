@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/taherk/galleryapp/models"
+)
+
+// emailPreviewData has sample data for every kind of email.
+var emailPreviewData = map[string]interface{}{
+	models.EmailKindForgotPassword: models.ForgotPasswordEmail{
+		ResetURL: "https://www.gallery-app.com/reset-pw?token=preview",
+	},
+	models.EmailKindConfirmEmailChange: models.ConfirmEmailChangeEmail{
+		ConfirmURL: "https://www.gallery-app.com/confirm-email?token=preview",
+	},
+	models.EmailKindEmailChanged: models.EmailChangedEmail{
+		NewEmail: "new-address@example.com",
+	},
+	models.EmailKindSignInLink: models.SignInLinkEmail{
+		SignInURL: "https://www.gallery-app.com/signin/link?token=preview",
+	},
+	models.EmailKindInvite: models.InviteEmail{
+		InviterEmail: "friend@example.com",
+		SignUpURL:    "https://www.gallery-app.com/signup?invite=preview&email=you%40example.com",
+	},
+	models.EmailKindNotification: models.NotificationEmail{
+		Subject:        "New images in Summer Holidays",
+		Message:        "3 images were added to Summer Holidays on the web.",
+		URL:            "https://www.gallery-app.com/galleries/1",
+		UnsubscribeURL: "https://www.gallery-app.com/unsubscribe?token=preview",
+		PreferencesURL: "https://www.gallery-app.com/users/me/notifications",
+	},
+	models.EmailKindDigest: models.DigestEmail{
+		Items: []models.Notification{
+			{Message: "3 images were added to Summer Holidays on the web.", URL: "https://www.gallery-app.com/galleries/1"},
+			{Message: "beach.jpg was added to Summer Holidays by email.", URL: "https://www.gallery-app.com/galleries/1"},
+		},
+		UnsubscribeURL: "https://www.gallery-app.com/unsubscribe?token=preview",
+		PreferencesURL: "https://www.gallery-app.com/users/me/notifications",
+	},
+}
+
+// EmailPreviews renders every kind of email with sample data. It is only
+// meant to be mounted in dev mode.
+type EmailPreviews struct {
+	Templates struct {
+		Index Template
+	}
+
+	EmailTemplates *models.EmailTemplates
+}
+
+func (ep EmailPreviews) Index(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Kinds []string
+	}
+	data.Kinds = models.EmailKinds
+	ep.Templates.Index.Execute(w, r, data)
+}
+
+// Show renders the HTML version of the email, or the plain text version with
+// format=text.
+func (ep EmailPreviews) Show(w http.ResponseWriter, r *http.Request) {
+	kind := chi.URLParam(r, "kind")
+	sample, ok := emailPreviewData[kind]
+	if !ok {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	email, err := ep.EmailTemplates.Render(kind, sample)
+	if err != nil {
+		logError(r, "rendering email preview", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Subject: %s\n\n%s", email.Subject, email.Plaintext)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, email.HTML)
+}
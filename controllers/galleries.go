@@ -1,17 +1,34 @@
 package controllers
 
 import (
-	"errors"
 	"fmt"
-	"math/rand"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/metrics"
 	"github.com/taherk/galleryapp/models"
 )
 
+// maxUploadSize limits how much of a multipart upload is kept in memory, the
+// rest is stored in temporary files.
+const maxUploadSize = 32 << 20
+
+// maxUploadRequestSize limits the size of an upload request, all its images
+// together. Larger requests are cut off before they fill the disk.
+const maxUploadRequestSize = 100 << 20
+
+type Image struct {
+	GalleryID int
+	Filename  string
+	URL       string
+}
+
 type Galleries struct {
 	Templates struct {
 		New   Template
@@ -20,7 +37,11 @@ type Galleries struct {
 		Show  Template
 	}
 
-	GalleryService *models.GalleryService
+	GalleryService       GalleryService
+	SecurityEventService SecurityEventService
+	InboundEmailService  InboundEmailService
+	NotificationService  NotificationService
+	ShareLinkService     ShareLinkService
 }
 
 func (ctrl Galleries) New(w http.ResponseWriter, r *http.Request) {
@@ -40,12 +61,23 @@ func (ctrl Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	data.UserID = int(context.User(r.Context()).ID)
 	data.Title = r.FormValue("title")
 
-	gallery, err := ctrl.GalleryService.Create(data.Title, data.UserID)
+	gallery, err := ctrl.GalleryService.Create(r.Context(), data.Title, data.UserID)
 	if err != nil {
+		if isAPIRequest(r) {
+			logError(r, "creating gallery", err)
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+			return
+		}
 		// if failed redirect back to the create page
 		ctrl.Templates.New.Execute(w, r, data, err)
 		return
 	}
+	ctrl.recordEvent(r, models.SecurityEventGalleryCreated, gallery)
+
+	if isAPIRequest(r) {
+		writeJSON(w, http.StatusCreated, apiGallery(gallery, nil))
+		return
+	}
 
 	// if created redirect to edit page
 	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
@@ -57,35 +89,74 @@ func (ctrl Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// render the edit page
+	ctrl.renderEdit(w, r, gallery)
+}
+
+func (ctrl Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
+	images, err := ctrl.images(r, gallery.ID)
+	if err != nil {
+		logError(r, "loading images", err)
+		errs = append(errs, err)
+	}
+
+	inboundAddress, err := ctrl.InboundEmailService.Address(r.Context(), gallery.ID)
+	if err != nil {
+		logError(r, "loading inbound address", err)
+		errs = append(errs, err)
+	}
+
+	links, err := ctrl.ShareLinkService.ByGalleryID(r.Context(), gallery.ID)
+	if err != nil {
+		logError(r, "loading share links", err)
+		errs = append(errs, err)
+	}
+	var shareLinks []ShareLink
+	for _, link := range links {
+		shareLinks = append(shareLinks, newShareLink(link))
+	}
+
 	data := struct {
-		ID    int
-		Title string
+		ID             int
+		Title          string
+		Images         []Image
+		InboundAddress string
+		ShareLinks     []ShareLink
 	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+		ID:             gallery.ID,
+		Title:          gallery.Title,
+		Images:         images,
+		InboundAddress: inboundAddress,
+		ShareLinks:     shareLinks,
 	}
-	ctrl.Templates.Edit.Execute(w, r, data)
+	ctrl.Templates.Edit.Execute(w, r, data, errs...)
 }
 
 func (ctrl Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := ctrl.galleryByID(w, r)
+	gallery, err := ctrl.galleryByID(w, r, galleryMustBeVisible)
 	if err != nil {
 		return
 	}
 
+	images, err := ctrl.images(r, gallery.ID)
+	if err != nil {
+		logError(r, "loading images", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	if isAPIRequest(r) {
+		writeJSON(w, http.StatusOK, apiGallery(gallery, images))
+		return
+	}
+
 	var data struct {
 		ID     int
 		Title  string
-		Images []string
+		Images []Image
 	}
 	data.ID = gallery.ID
 	data.Title = gallery.Title
-	for i := 0; i < 20; i++ {
-		w, h := rand.Intn(500)+200, rand.Intn(500)+200
-		catImageURL := fmt.Sprintf("https://placekitten.com/%d/%d", w, h)
-		data.Images = append(data.Images, catImageURL)
-	}
+	data.Images = images
 
 	ctrl.Templates.Show.Execute(w, r, data)
 }
@@ -97,11 +168,12 @@ func (ctrl Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery.Title = r.FormValue("title")
-	err = ctrl.GalleryService.UpdateTitle(gallery)
+	err = ctrl.GalleryService.UpdateTitle(r.Context(), gallery)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	ctrl.recordEvent(r, models.SecurityEventGalleryUpdated, gallery)
 
 	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
 }
@@ -117,12 +189,24 @@ func (ctrl Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := context.User(r.Context())
-	galleries, err := ctrl.GalleryService.ByUserID(int(user.ID))
+	galleries, err := ctrl.GalleryService.ByUserID(r.Context(), int(user.ID))
 	if err != nil {
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 
+	if isAPIRequest(r) {
+		var resp struct {
+			Galleries []apiGalleryResponse `json:"galleries"`
+		}
+		resp.Galleries = []apiGalleryResponse{}
+		for i := range galleries {
+			resp.Galleries = append(resp.Galleries, apiGallery(&galleries[i], nil))
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
 	for _, gallery := range galleries {
 		data.Galleries = append(data.Galleries, Gallery{
 			ID:    gallery.ID,
@@ -140,15 +224,194 @@ func (ctrl Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// render the edit page
-	err = ctrl.GalleryService.Delete(gallery.ID)
+	err = ctrl.GalleryService.Delete(r.Context(), gallery.ID)
 	if err != nil {
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
+	ctrl.recordEvent(r, models.SecurityEventGalleryDeleted, gallery)
 
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+func (ctrl Galleries) Image(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, galleryMustBeVisible)
+	if err != nil {
+		return
+	}
+
+	image, err := ctrl.GalleryService.Image(r.Context(), gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		logError(r, "loading image", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeFile(w, r, image.Path)
+}
+
+func (ctrl Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadRequestSize)
+	err = r.ParseMultipartForm(maxUploadSize)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			slog.WarnContext(r.Context(), "uploading images failed", "err", err)
+			msg := fmt.Sprintf("The upload is larger than %d MB, please upload fewer images at a time", maxUploadRequestSize>>20)
+			http.Error(w, msg, http.StatusRequestEntityTooLarge)
+			return
+		}
+		err = errors.Public(err, "The upload could not be read")
+		ctrl.uploadFailed(w, r, gallery, http.StatusBadRequest, err)
+		return
+	}
+
+	start := time.Now()
+	var uploaded []Image
+	var created []models.Image
+	var size int64
+	for _, fileHeader := range r.MultipartForm.File["images"] {
+		file, err := fileHeader.Open()
+		if err != nil {
+			ctrl.uploadFailed(w, r, gallery, http.StatusInternalServerError, err)
+			return
+		}
+
+		image, err := ctrl.GalleryService.CreateImage(r.Context(), gallery.ID, fileHeader.Filename, file)
+		file.Close()
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, models.ErrInvalidImage) {
+				status = http.StatusBadRequest
+				err = errors.Public(err, fmt.Sprintf("%v is not a png, jpg or gif image", fileHeader.Filename))
+			}
+			ctrl.uploadFailed(w, r, gallery, status, err)
+			return
+		}
+		uploaded = append(uploaded, newImage(image))
+		created = append(created, image)
+		size += image.Size
+	}
+	source, via := metrics.ImageSourceWeb, "on the web"
+	if isAPIRequest(r) {
+		source, via = metrics.ImageSourceAPI, "through the API"
+	}
+	metrics.ObserveImageUpload(source, size, time.Since(start))
+	notifyImagesAdded(r, ctrl.NotificationService, gallery, created, via)
+
+	if isAPIRequest(r) {
+		resp := apiGallery(gallery, uploaded)
+		writeJSON(w, http.StatusCreated, resp)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+func (ctrl Galleries) uploadFailed(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, status int, err error) {
+	slog.WarnContext(r.Context(), "uploading images failed", "err", err)
+	if isAPIRequest(r) {
+		msg := "Something went wrong"
+		var pubErr interface{ Public() string }
+		if errors.As(err, &pubErr) {
+			msg = pubErr.Public()
+		}
+		http.Error(w, msg, status)
+		return
+	}
+	ctrl.renderEdit(w, r, gallery, err)
+}
+
+func (ctrl Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = ctrl.GalleryService.DeleteImage(r.Context(), gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Image not found", http.StatusNotFound)
+			return
+		}
+		logError(r, "deleting image", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// ResetInboundAddress gives the gallery a new address to email images to, for
+// example after the previous one leaked.
+func (ctrl Galleries) ResetInboundAddress(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	_, err = ctrl.InboundEmailService.ResetAddress(r.Context(), gallery.ID)
+	if err != nil {
+		logError(r, "resetting inbound address", err)
+		ctrl.renderEdit(w, r, gallery, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+func (ctrl Galleries) DisableInboundAddress(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	err = ctrl.InboundEmailService.DisableAddress(r.Context(), gallery.ID)
+	if err != nil {
+		logError(r, "disabling inbound address", err)
+		ctrl.renderEdit(w, r, gallery, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+func (ctrl Galleries) recordEvent(r *http.Request, event string, gallery *models.Gallery) {
+	se := securityEvent(r, event, context.User(r.Context()))
+	se.GalleryID = &gallery.ID
+	se.Details = gallery.Title
+	recordSecurityEvent(r, ctrl.SecurityEventService, se)
+}
+
+func (ctrl Galleries) images(r *http.Request, galleryID int) ([]Image, error) {
+	images, err := ctrl.GalleryService.Images(r.Context(), galleryID)
+	if err != nil {
+		return nil, err
+	}
+	var result []Image
+	for _, image := range images {
+		result = append(result, newImage(image))
+	}
+	return result, nil
+}
+
+func newImage(image models.Image) Image {
+	return Image{
+		GalleryID: image.GalleryID,
+		Filename:  image.Filename,
+		URL:       fmt.Sprintf("/galleries/%d/images/%s", image.GalleryID, url.PathEscape(image.Filename)),
+	}
+}
+
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 
 func (ctrl Galleries) galleryByID(w http.ResponseWriter, r *http.Request, options ...galleryOpt) (*models.Gallery, error) {
@@ -161,7 +424,7 @@ func (ctrl Galleries) galleryByID(w http.ResponseWriter, r *http.Request, option
 	}
 
 	// get gallery
-	gallery, err := ctrl.GalleryService.ByID(id)
+	gallery, err := ctrl.GalleryService.ByID(r.Context(), id)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "Gallery not found", http.StatusNotFound)
@@ -190,3 +453,17 @@ func userMustOwnGallery(w http.ResponseWriter, r *http.Request, gallery *models.
 
 	return nil
 }
+
+// galleryMustBeVisible hides galleries that were taken down from everyone
+// but admins.
+func galleryMustBeVisible(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+	if gallery.TakenDownAt == nil {
+		return nil
+	}
+	user := context.User(r.Context())
+	if user != nil && user.IsAdmin() {
+		return nil
+	}
+	http.Error(w, "Gallery not found", http.StatusNotFound)
+	return fmt.Errorf("gallery %d was taken down", gallery.ID)
+}
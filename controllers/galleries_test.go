@@ -0,0 +1,427 @@
+package controllers
+
+import (
+	"bytes"
+	stdctx "context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/models"
+)
+
+// createGallery creates a gallery of the user through the gallery service.
+func (app *testApp) createGallery(user *models.User, title string) *models.Gallery {
+	app.t.Helper()
+	gallery, err := app.galleries.Create(stdctx.Background(), title, int(user.ID))
+	if err != nil {
+		app.t.Fatal(err)
+	}
+	return gallery
+}
+
+// upload posts the files as a multipart form, the way the edit page does.
+func (c *testClient) upload(path string, files map[string][]byte) (*http.Response, string) {
+	c.t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for filename, contents := range files {
+		fw, err := mw.CreateFormFile("images", filename)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		fw.Write(contents)
+	}
+	err := mw.Close()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.base+path, &buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+func TestGalleriesCreate(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	c := app.signedIn(user)
+
+	resp, _ := c.post("/galleries", url.Values{"title": {"Holidays"}})
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusFound)
+	}
+	var id int
+	_, err := fmt.Sscanf(resp.Header.Get("Location"), "/galleries/%d/edit", &id)
+	if err != nil {
+		t.Fatalf("redirected to %q: %v", resp.Header.Get("Location"), err)
+	}
+
+	resp, body := c.get(fmt.Sprintf("/galleries/%d/edit", id))
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "Holidays") {
+		t.Errorf("edit page does not show the title:\n%s", body)
+	}
+
+	resp, body = c.get("/galleries")
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "Holidays") {
+		t.Errorf("index does not list the gallery:\n%s", body)
+	}
+
+	events := app.events(models.SecurityEventGalleryCreated)
+	if len(events) != 1 || events[0].GalleryID == nil || *events[0].GalleryID != id {
+		t.Errorf("gallery created events = %+v, want one for gallery %d", events, id)
+	}
+}
+
+func TestGalleriesRequireUser(t *testing.T) {
+	app := newTestApp(t)
+	c := app.client()
+
+	resp, _ := c.get("/galleries")
+	assertRedirect(t, resp, "/signin")
+	resp, _ = c.post("/galleries", url.Values{"title": {"Holidays"}})
+	assertRedirect(t, resp, "/signin")
+}
+
+func TestGalleriesUpdate(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	untouched := app.createGallery(user, "Pets")
+	c := app.signedIn(user)
+
+	resp, _ := c.post(fmt.Sprintf("/galleries/%d", gallery.ID), url.Values{"title": {"Summer"}})
+	assertRedirect(t, resp, fmt.Sprintf("/galleries/%d/edit", gallery.ID))
+
+	for id, want := range map[int]string{gallery.ID: "Summer", untouched.ID: "Pets"} {
+		got, err := app.galleries.ByID(stdctx.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != want {
+			t.Errorf("title of gallery %d = %q, want %q", id, got.Title, want)
+		}
+	}
+}
+
+func TestGalleriesDelete(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	c := app.signedIn(user)
+
+	resp, _ := c.post(fmt.Sprintf("/galleries/%d/delete", gallery.ID), nil)
+	assertRedirect(t, resp, "/galleries")
+
+	resp, _ = c.get(fmt.Sprintf("/galleries/%d", gallery.ID))
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestGalleriesOwnership(t *testing.T) {
+	app := newTestApp(t)
+	owner := app.createUser("alice@example.com")
+	gallery := app.createGallery(owner, "Holidays")
+	c := app.signedIn(app.createUser("mallory@example.com"))
+
+	tests := []struct {
+		method string
+		path   string
+	}{
+		{http.MethodGet, "/galleries/%d/edit"},
+		{http.MethodPost, "/galleries/%d"},
+		{http.MethodPost, "/galleries/%d/delete"},
+		{http.MethodPost, "/galleries/%d/inbound-address"},
+		{http.MethodPost, "/galleries/%d/images/photo.png/delete"},
+	}
+	for _, tt := range tests {
+		path := fmt.Sprintf(tt.path, gallery.ID)
+		t.Run(tt.method+" "+path, func(t *testing.T) {
+			var resp *http.Response
+			if tt.method == http.MethodGet {
+				resp, _ = c.get(path)
+			} else {
+				resp, _ = c.post(path, url.Values{"title": {"Mine now"}})
+			}
+			assertStatus(t, resp, http.StatusForbidden)
+		})
+	}
+
+	got, err := app.galleries.ByID(stdctx.Background(), gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Holidays" {
+		t.Errorf("title = %q, another user changed it", got.Title)
+	}
+
+	// everyone can look at a gallery
+	resp, _ := c.get(fmt.Sprintf("/galleries/%d", gallery.ID))
+	assertStatus(t, resp, http.StatusOK)
+}
+
+func TestGalleriesNotFound(t *testing.T) {
+	app := newTestApp(t)
+	c := app.signedIn(app.createUser("alice@example.com"))
+
+	for _, path := range []string{"/galleries/404", "/galleries/abc", "/galleries/404/edit"} {
+		resp, _ := c.get(path)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGalleriesImages(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	c := app.signedIn(user)
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	imagePath := fmt.Sprintf("/galleries/%d/images/photo.png", gallery.ID)
+
+	resp, _ := c.upload(fmt.Sprintf("/galleries/%d/images", gallery.ID), map[string][]byte{"photo.png": []byte("png data")})
+	assertRedirect(t, resp, editPath)
+
+	resp, body := c.get(editPath)
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, imagePath) {
+		t.Errorf("edit page does not show the image:\n%s", body)
+	}
+
+	resp, body = app.client().get(imagePath)
+	assertStatus(t, resp, http.StatusOK)
+	if body != "png data" {
+		t.Errorf("image = %q, want the uploaded data", body)
+	}
+
+	// owners are not told about their own uploads
+	if notifications := app.notifications.Notifications(int(user.ID)); len(notifications) != 0 {
+		t.Errorf("notifications = %+v, want none", notifications)
+	}
+
+	resp, _ = c.post(fmt.Sprintf("/galleries/%d/images/photo.png/delete", gallery.ID), nil)
+	assertRedirect(t, resp, editPath)
+	resp, _ = c.get(imagePath)
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestGalleriesShareLinks(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	c := app.signedIn(user)
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+
+	resp, _ := c.post(fmt.Sprintf("/galleries/%d/share-links", gallery.ID), url.Values{"name": {"Grandma"}})
+	assertRedirect(t, resp, editPath)
+	links, err := app.shareLinks.ByGalleryID(stdctx.Background(), gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 1 || links[0].Name != "Grandma" {
+		t.Fatalf("share links = %+v, want the one for Grandma", links)
+	}
+	sharePath := "/share/" + links[0].Token
+	_, body := c.get(editPath)
+	if !strings.Contains(body, sharePath) || !strings.Contains(body, "not opened yet") {
+		t.Errorf("edit page does not show the unopened link:\n%s", body)
+	}
+
+	// the owner checking the link does not count as it being opened
+	resp, _ = c.get(sharePath)
+	assertStatus(t, resp, http.StatusOK)
+	_, body = c.get(editPath)
+	if !strings.Contains(body, "not opened yet") {
+		t.Errorf("edit page shows the link as opened by its owner:\n%s", body)
+	}
+
+	// anyone with the link can look at the gallery
+	for i := 0; i < 2; i++ {
+		resp, body = app.client().get(sharePath)
+		assertStatus(t, resp, http.StatusOK)
+		if !strings.Contains(body, "Holidays") {
+			t.Errorf("shared gallery page does not show the gallery:\n%s", body)
+		}
+	}
+	events := app.events(models.SecurityEventShareLinkUsed)
+	if len(events) != 3 {
+		t.Fatalf("events = %+v, want one for every use of the link", events)
+	}
+	se := events[0]
+	if se.UserID == nil || *se.UserID != int(user.ID) || se.ActorID != nil {
+		t.Errorf("event user = %v, actor = %v, want the owner and no actor", se.UserID, se.ActorID)
+	}
+	if se.GalleryID == nil || *se.GalleryID != gallery.ID || se.Details != "Holidays via Grandma" {
+		t.Errorf("event gallery = %v, details = %q, want the gallery and the link", se.GalleryID, se.Details)
+	}
+	notifications := app.notifications.Notifications(int(user.ID))
+	if len(notifications) != 1 || notifications[0].Event != models.NotificationShareLinkOpened {
+		t.Fatalf("notifications = %+v, want one about the first time the link was opened", notifications)
+	}
+	if !strings.Contains(notifications[0].Message, "share link of Holidays for Grandma") {
+		t.Errorf("message = %q, want it to name the gallery and the link", notifications[0].Message)
+	}
+	_, body = c.get(editPath)
+	if !strings.Contains(body, "first opened") {
+		t.Errorf("edit page does not show when the link was opened:\n%s", body)
+	}
+
+	// only the owner can turn the link off
+	deletePath := fmt.Sprintf("/galleries/%d/share-links/%d/delete", gallery.ID, links[0].ID)
+	resp, _ = app.signedIn(app.createUser("bob@example.com")).post(deletePath, nil)
+	assertStatus(t, resp, http.StatusForbidden)
+	resp, _ = c.post(deletePath, nil)
+	assertRedirect(t, resp, editPath)
+	resp, _ = app.client().get(sharePath)
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestNotifyImagesAdded(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	admin := app.createUser("admin@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	images := []models.Image{{GalleryID: gallery.ID, Filename: "photo.png", Size: 8}}
+
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	ctx := context.WithUser(r.Context(), user)
+	notifyImagesAdded(r.WithContext(ctx), app.notifications, gallery, images, "on the web")
+	if notifications := app.notifications.Notifications(int(user.ID)); len(notifications) != 0 {
+		t.Fatalf("notifications = %+v, want none for the own upload", notifications)
+	}
+
+	// an admin acting as the owner, submitting the upload twice
+	ctx = context.WithImpersonator(ctx, admin)
+	notifyImagesAdded(r.WithContext(ctx), app.notifications, gallery, images, "on the web")
+	notifyImagesAdded(r.WithContext(ctx), app.notifications, gallery, images, "on the web")
+	notifications := app.notifications.Notifications(int(user.ID))
+	if len(notifications) != 1 || notifications[0].Event != models.NotificationImagesAdded {
+		t.Fatalf("notifications = %+v, want one about the added image", notifications)
+	}
+	if !strings.Contains(notifications[0].Message, "photo.png was added to Holidays") {
+		t.Errorf("message = %q, want it to name the image and the gallery", notifications[0].Message)
+	}
+
+	images = append(images, models.Image{GalleryID: gallery.ID, Filename: "other.png", Size: 8})
+	notifyImagesAdded(r.WithContext(ctx), app.notifications, gallery, images, "on the web")
+	if notifications := app.notifications.Notifications(int(user.ID)); len(notifications) != 2 {
+		t.Errorf("notifications = %+v, want another one for another upload", notifications)
+	}
+}
+
+func TestGalleriesUploadInvalidImage(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	c := app.signedIn(user)
+
+	resp, body := c.upload(fmt.Sprintf("/galleries/%d/images", gallery.ID), map[string][]byte{"notes.txt": []byte("text")})
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "notes.txt is not a png, jpg or gif image") {
+		t.Errorf("edit page does not show the error:\n%s", body)
+	}
+
+	images, err := app.galleries.Images(stdctx.Background(), gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Errorf("images = %+v, want none", images)
+	}
+	if notifications := app.notifications.Notifications(int(user.ID)); len(notifications) != 0 {
+		t.Errorf("notifications = %+v, want none", notifications)
+	}
+}
+
+func TestGalleriesUploadTooLarge(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	gallery := app.createGallery(user, "Holidays")
+	c := app.signedIn(user)
+
+	resp, _ := c.upload(fmt.Sprintf("/galleries/%d/images", gallery.ID), map[string][]byte{
+		"huge.png": bytes.Repeat([]byte{0}, maxUploadRequestSize+1),
+	})
+	assertStatus(t, resp, http.StatusRequestEntityTooLarge)
+
+	images, err := app.galleries.Images(stdctx.Background(), gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Errorf("images = %+v, want none", images)
+	}
+}
+
+func TestGalleriesTakenDown(t *testing.T) {
+	app := newTestApp(t)
+	owner := app.createUser("alice@example.com")
+	gallery := app.createGallery(owner, "Holidays")
+	admin := app.createUser("admin@example.com")
+	err := app.users.SetRole(stdctx.Background(), int(admin.ID), models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.galleries.SetTakenDown(stdctx.Background(), gallery.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("/galleries/%d", gallery.ID)
+
+	resp, _ := app.client().get(path)
+	assertStatus(t, resp, http.StatusNotFound)
+	resp, _ = app.signedIn(owner).get(path)
+	assertStatus(t, resp, http.StatusNotFound)
+	resp, _ = app.signedIn(admin).get(path)
+	assertStatus(t, resp, http.StatusOK)
+}
+
+func TestGalleriesAPI(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	reader := app.withToken(user, models.ScopeGalleriesRead)
+
+	resp, _ := reader.post("/galleries", url.Values{"title": {"Holidays"}})
+	assertStatus(t, resp, http.StatusForbidden)
+
+	writer := app.withToken(user, models.ScopeGalleriesRead, models.ScopeGalleriesWrite)
+	resp, body := writer.post("/galleries", url.Values{"title": {"Holidays"}})
+	assertStatus(t, resp, http.StatusCreated)
+	var created apiGalleryResponse
+	err := json.Unmarshal([]byte(body), &created)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	if created.Title != "Holidays" {
+		t.Errorf("title = %q, want Holidays", created.Title)
+	}
+
+	resp, body = reader.get("/galleries")
+	assertStatus(t, resp, http.StatusOK)
+	var index struct {
+		Galleries []apiGalleryResponse `json:"galleries"`
+	}
+	err = json.Unmarshal([]byte(body), &index)
+	if err != nil {
+		t.Fatalf("decoding %q: %v", body, err)
+	}
+	if len(index.Galleries) != 1 || index.Galleries[0].ID != created.ID {
+		t.Errorf("galleries = %+v, want the created gallery", index.Galleries)
+	}
+
+	invalid := app.client()
+	invalid.bearer = models.APITokenPrefix + "invalid"
+	resp, _ = invalid.get("/galleries")
+	assertStatus(t, resp, http.StatusUnauthorized)
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	stdctx "context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/taherk/galleryapp/buildinfo"
+)
+
+// readyTimeout bounds how long the readiness checks may take in total, so a
+// hanging dependency fails the probe instead of timing it out.
+const readyTimeout = 2 * time.Second
+
+// HealthCheck checks that a dependency of the app is usable.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx stdctx.Context) error
+}
+
+// Health serves the endpoints of the orchestrator. They do not depend on the
+// user or CSRF middlewares, and have to be routed before them.
+type Health struct {
+	Checks []HealthCheck
+}
+
+// Healthz reports that the process is alive.
+func (h Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type readyCheckResponse struct {
+	Status string `json:"status"`
+}
+
+type readyResponse struct {
+	Status string                        `json:"status"`
+	Checks map[string]readyCheckResponse `json:"checks"`
+}
+
+// Readyz runs all checks concurrently, and responds with 503 Service
+// Unavailable if any of them fails. The errors are only logged, since they
+// may reveal internal addresses.
+func (h Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := stdctx.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	resp := readyResponse{
+		Status: "ok",
+		Checks: make(map[string]readyCheckResponse, len(h.Checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range h.Checks {
+		wg.Add(1)
+		go func(check HealthCheck) {
+			defer wg.Done()
+			result := readyCheckResponse{Status: "ok"}
+			err := check.Check(ctx)
+			if err != nil {
+				logError(r, "readiness check "+check.Name, err)
+				result.Status = "failed"
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Checks[check.Name] = result
+			if err != nil {
+				resp.Status = "failed"
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, resp)
+}
+
+// Version responds with the build info of the binary.
+func (h Health) Version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildinfo.Get())
+}
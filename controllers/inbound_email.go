@@ -0,0 +1,70 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/metrics"
+	"github.com/taherk/galleryapp/models"
+)
+
+// maxInboundEmailSize limits the size of a received message, attachments
+// included.
+const maxInboundEmailSize = 32 << 20
+
+// InboundEmail accepts raw MIME messages from the mail relay in front of the
+// app, e.g. a Postfix pipe or the webhook of an email provider, and adds the
+// attached images to the gallery the message was sent to.
+type InboundEmail struct {
+	InboundEmailService InboundEmailService
+	// Secret the relay sends as a bearer token.
+	Secret string
+}
+
+// Receive responds with 4xx status codes for messages that can never be
+// delivered, so the relay bounces them instead of trying again.
+func (ctrl InboundEmail) Receive(w http.ResponseWriter, r *http.Request) {
+	token, ok := bearerToken(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(ctrl.Secret)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	email, err := models.ParseInboundEmail(http.MaxBytesReader(w, r.Body, maxInboundEmailSize))
+	if err != nil {
+		slog.WarnContext(r.Context(), "reading inbound email failed", "err", err)
+		http.Error(w, "The message could not be read", http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	gallery, images, err := ctrl.InboundEmailService.Receive(r.Context(), email)
+	if err != nil {
+		slog.WarnContext(r.Context(), "receiving inbound email failed", "err", err)
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "Unknown recipient", http.StatusNotFound)
+		case errors.Is(err, models.ErrSenderNotAllowed):
+			http.Error(w, "Sender is not allowed to add images to this gallery", http.StatusForbidden)
+		case errors.Is(err, models.ErrNoImages):
+			http.Error(w, "The message has no png, jpg or gif attachments", http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	var uploaded []Image
+	var size int64
+	for _, image := range images {
+		uploaded = append(uploaded, newImage(image))
+		size += image.Size
+	}
+	// only the owner can email images to their gallery, so nobody is notified
+	metrics.ObserveImageUpload(metrics.ImageSourceEmail, size, time.Since(start))
+	writeJSON(w, http.StatusCreated, apiGallery(gallery, uploaded))
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	stdctx "context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/models"
+)
+
+func (u Users) Invites(w http.ResponseWriter, r *http.Request) {
+	u.renderInvites(w, r, nil)
+}
+
+func (u Users) ProcessCreateInvite(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	email := r.FormValue("email")
+	if email == "" {
+		err := errors.Public(fmt.Errorf("missing invite email"), "Please enter the email address to invite")
+		u.renderInvites(w, r, nil, err)
+		return
+	}
+
+	invite, err := u.InviteService.Create(r.Context(), user, email, func(ctx stdctx.Context, invite *models.Invite) error {
+		vals := url.Values{
+			"invite": {invite.Token},
+			"email":  {invite.Email},
+		}
+		signUpURL := "https://www.gallery-app.com/signup?" + vals.Encode()
+		return u.EmailService.Invite(ctx, invite.TokenHash, invite.Email, user.Email, signUpURL)
+	})
+	if err != nil {
+		if errors.Is(err, models.ErrInviteQuotaExceeded) {
+			err = errors.Public(err, "You have used all of your invites")
+		} else {
+			logError(r, "creating invite", err)
+		}
+		u.renderInvites(w, r, nil, err)
+		return
+	}
+
+	u.renderInvites(w, r, invite)
+}
+
+func (u Users) renderInvites(w http.ResponseWriter, r *http.Request, newInvite *models.Invite, errs ...error) {
+	user := context.User(r.Context())
+	var data struct {
+		Invites   []models.Invite
+		NewInvite *models.Invite
+		Remaining int
+	}
+	data.NewInvite = newInvite
+
+	remaining, err := u.InviteService.Remaining(r.Context(), user)
+	if err != nil {
+		logError(r, "loading remaining invites", err)
+		errs = append(errs, err)
+	}
+	data.Remaining = remaining
+
+	invites, err := u.InviteService.ByInviterID(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "loading invites", err)
+		errs = append(errs, err)
+	}
+	data.Invites = invites
+
+	u.Templates.Invites.Execute(w, r, data, errs...)
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDBytes  = 12
+	// longer request IDs from the client are replaced, so they cannot flood
+	// the logs.
+	maxRequestIDLength = 64
+)
+
+// RequestID gives every request an ID, which is added to its logs and
+// returned in the X-Request-ID header. An ID set by a proxy in front of the
+// app is kept, so requests can be followed across both logs.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			var err error
+			id, err = rand.String(requestIDBytes)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "generating request ID", "err", err)
+			}
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithRequestID(r.Context(), id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog logs every request once it is done. Only the path of the URL is
+// logged, because query strings carry tokens, e.g. of password resets.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"ip", remoteIP(r),
+		)
+	})
+}
+
+// logError logs an error that happened while handling r, together with the
+// ID of the request.
+func logError(r *http.Request, msg string, err error) {
+	slog.ErrorContext(r.Context(), msg, "err", err)
+}
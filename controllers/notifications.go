@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/models"
+)
+
+func (u Users) Notifications(w http.ResponseWriter, r *http.Request) {
+	u.renderNotifications(w, r, false)
+}
+
+func (u Users) ProcessUpdateNotifications(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	for _, event := range models.NotificationEvents {
+		delivery := r.FormValue(event)
+		if delivery == "" {
+			continue
+		}
+		err := u.NotificationService.SetPreference(r.Context(), int(user.ID), event, delivery)
+		if err != nil {
+			logError(r, "updating notification preference", err)
+			u.renderNotifications(w, r, false, err)
+			return
+		}
+	}
+
+	u.renderNotifications(w, r, true)
+}
+
+func (u Users) renderNotifications(w http.ResponseWriter, r *http.Request, saved bool, errs ...error) {
+	user := context.User(r.Context())
+	var data struct {
+		Events      []string
+		Deliveries  []string
+		Preferences map[string]string
+		Saved       bool
+	}
+	data.Events = models.NotificationEvents
+	data.Deliveries = models.Deliveries
+	data.Saved = saved
+
+	prefs, err := u.NotificationService.Preferences(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "loading notification preferences", err)
+		errs = append(errs, err)
+	}
+	data.Preferences = prefs
+
+	u.Templates.Notifications.Execute(w, r, data, errs...)
+}
+
+// Unsubscribe asks for confirmation, so link scanners that follow every link
+// in an email don't unsubscribe anyone.
+func (u Users) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token        string
+		Unsubscribed bool
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.Unsubscribe.Execute(w, r, data)
+}
+
+// ProcessUnsubscribe handles both the confirmation form and one-click
+// unsubscribe requests from mail clients (RFC 8058). The signed token is all
+// that is needed, the user does not have to be signed in.
+func (u Users) ProcessUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token        string
+		Unsubscribed bool
+	}
+	data.Token = r.FormValue("token")
+
+	err := u.NotificationService.Unsubscribe(r.Context(), data.Token)
+	if err != nil {
+		slog.InfoContext(r.Context(), "unsubscribe failed", "err", err)
+		if errors.Is(err, models.ErrNotFound) {
+			err = errors.Public(err, "This unsubscribe link is invalid")
+		}
+		u.Templates.Unsubscribe.Execute(w, r, data, err)
+		return
+	}
+	data.Unsubscribed = true
+
+	u.Templates.Unsubscribe.Execute(w, r, data)
+}
+
+// notifyImagesAdded tells the owner of the gallery about images someone else
+// added, like an admin acting as them. Owners are not told about their own
+// uploads. The images are stored either way, so a failure is only logged.
+func notifyImagesAdded(r *http.Request, service NotificationService, gallery *models.Gallery, images []models.Image, via string) {
+	if len(images) == 0 || actorID(r) == gallery.UserID {
+		return
+	}
+	message := fmt.Sprintf("%d images were added to %s %s.", len(images), gallery.Title, via)
+	if len(images) == 1 {
+		message = fmt.Sprintf("%s was added to %s %s.", images[0].Filename, gallery.Title, via)
+	}
+	link := fmt.Sprintf("https://www.gallery-app.com/galleries/%d", gallery.ID)
+	err := service.Notify(r.Context(), gallery.UserID, models.NotificationImagesAdded, uploadKey(gallery.ID, images), "New images in "+gallery.Title, message, link)
+	if err != nil {
+		logError(r, "notifying about added images", err)
+	}
+}
+
+// notifyShareLinkOpened tells the owner of the gallery that someone opened
+// the share link for the first time. The gallery is shown either way, so a
+// failure is only logged.
+func notifyShareLinkOpened(r *http.Request, service NotificationService, gallery *models.Gallery, shareLink *models.ShareLink) {
+	message := fmt.Sprintf("A share link of %s was opened for the first time.", gallery.Title)
+	if shareLink.Name != "" {
+		message = fmt.Sprintf("The share link of %s for %s was opened for the first time.", gallery.Title, shareLink.Name)
+	}
+	link := fmt.Sprintf("https://www.gallery-app.com/galleries/%d/edit", gallery.ID)
+	key := fmt.Sprintf("share_link:%d", shareLink.ID)
+	err := service.Notify(r.Context(), gallery.UserID, models.NotificationShareLinkOpened, key, gallery.Title+" was opened", message, link)
+	if err != nil {
+		logError(r, "notifying about opened share link", err)
+	}
+}
+
+// actorID is the ID of whoever made the request: the admin acting as the
+// user, the user, or 0 if nobody is signed in.
+func actorID(r *http.Request) int {
+	actor := context.Impersonator(r.Context())
+	if actor == nil {
+		actor = context.User(r.Context())
+	}
+	if actor == nil {
+		return 0
+	}
+	return int(actor.ID)
+}
+
+// uploadKey identifies a batch of uploaded images by their names and sizes,
+// so retrying an upload or submitting it twice notifies once. Uploading the
+// same files again only replaces them with themselves.
+func uploadKey(galleryID int, images []models.Image) string {
+	files := make([]string, 0, len(images))
+	for _, image := range images {
+		files = append(files, fmt.Sprintf("%s:%d", image.Filename, image.Size))
+	}
+	sort.Strings(files)
+	sum := sha256.Sum256([]byte(strings.Join(files, "\n")))
+	return fmt.Sprintf("gallery:%d:%s", galleryID, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/rand"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// how long a user has to complete the sign in at the identity provider.
+	oauthCookieMaxAge = 10 * time.Minute
+	// number of random bytes used for the state and the nonce
+	oauthStateBytes = 32
+)
+
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.OIDCProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w, "Unknown sign in provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := rand.String(oauthStateBytes)
+	if err != nil {
+		logError(r, "generating oauth state", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := rand.String(oauthStateBytes)
+	if err != nil {
+		logError(r, "generating oidc nonce", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	setOAuthCookie(w, CookieOAuthState, state)
+	setOAuthCookie(w, CookieOAuthNonce, nonce)
+	setOAuthCookie(w, CookieOAuthVerifier, verifier)
+
+	http.Redirect(w, r, provider.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	provider, ok := u.OIDCProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		http.Error(w, "Unknown sign in provider", http.StatusNotFound)
+		return
+	}
+
+	// the cookies are only needed for this one callback
+	state, stateErr := readCookie(r, CookieOAuthState)
+	nonce, nonceErr := readCookie(r, CookieOAuthNonce)
+	verifier, verifierErr := readCookie(r, CookieOAuthVerifier)
+	deleteCookie(w, CookieOAuthState)
+	deleteCookie(w, CookieOAuthNonce)
+	deleteCookie(w, CookieOAuthVerifier)
+
+	var data struct {
+		Email     string
+		Providers []*models.OIDCProvider
+	}
+	data.Providers = u.oidcProviderList()
+
+	if stateErr != nil || nonceErr != nil || verifierErr != nil {
+		err := errors.Public(fmt.Errorf("oauth cookies missing"), "Your sign in attempt expired. Please try again.")
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		err := errors.Public(fmt.Errorf("oauth state mismatch"), "Your sign in attempt expired. Please try again.")
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+	if errCode := r.FormValue("error"); errCode != "" {
+		err := errors.Public(fmt.Errorf("oauth provider error: %s", errCode), fmt.Sprintf("Signing in with %s failed.", provider.DisplayName))
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), r.FormValue("code"), nonce, verifier)
+	if err != nil {
+		slog.InfoContext(r.Context(), "oidc code exchange failed", "err", err)
+		err = errors.Public(err, fmt.Sprintf("Signing in with %s failed.", provider.DisplayName))
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+
+	user, err := u.IdentityService.User(r.Context(), provider.Name, claims)
+	if err != nil {
+		logError(r, "loading oidc user", err)
+		data.Email = claims.Email
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			err = errors.Public(err, "There is no account with that email address. Please sign up first.")
+		case errors.Is(err, models.ErrEmailNotVerified):
+			err = errors.Public(err, fmt.Sprintf("Your email address is not verified with %s.", provider.DisplayName))
+		}
+		u.Templates.SignIn.Execute(w, r, data, err)
+		return
+	}
+
+	session, err := u.SessionService.Create(r.Context(), user.ID)
+	if err != nil {
+		logError(r, "creating session", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+	event := securityEvent(r, models.SecurityEventSignIn, user)
+	event.Details = provider.Name
+	recordSecurityEvent(r, u.SecurityEventService, event)
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) oidcProviderList() []*models.OIDCProvider {
+	var providers []*models.OIDCProvider
+	for _, provider := range u.OIDCProviders {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers
+}
+
+func setOAuthCookie(w http.ResponseWriter, name string, value string) {
+	cookie := newCookie(name, value)
+	cookie.MaxAge = int(oauthCookieMaxAge.Seconds())
+	// the provider redirects back with a top level GET, which lax cookies are
+	// still sent with.
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	stdctx "context"
+	"encoding/csv"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/models"
+)
+
+// number of security events shown on a user's security page
+const securityEventLimit = 100
+
+// securityEvent creates an event about the user's account with who made the
+// request and where it came from. The actor is whoever is signed in, or the
+// user themselves while they are signing in.
+func securityEvent(r *http.Request, event string, user *models.User) models.SecurityEvent {
+	se := models.SecurityEvent{
+		Event:     event,
+		IP:        remoteIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: context.RequestID(r.Context()),
+	}
+	if user != nil {
+		userID := int(user.ID)
+		se.UserID = &userID
+	}
+
+	actor := context.Impersonator(r.Context())
+	if actor == nil {
+		actor = context.User(r.Context())
+	}
+	if actor == nil {
+		actor = user
+	}
+	if actor != nil {
+		actorID := int(actor.ID)
+		se.ActorID = &actorID
+		se.ActorEmail = actor.Email
+	}
+
+	return se
+}
+
+// recordSecurityEvent adds the event of r to the audit trail. The event
+// already happened, so it is recorded even if r was cancelled, and failing to
+// record it is only logged.
+func recordSecurityEvent(r *http.Request, service SecurityEventService, event models.SecurityEvent) {
+	err := service.Record(stdctx.WithoutCancel(r.Context()), event)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "recording security event", "err", err, "event", event.Event)
+	}
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (u Users) SecurityEvents(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Events []models.SecurityEvent
+	}
+
+	events, err := u.SecurityEventService.ByUserID(r.Context(), int(user.ID), securityEventLimit)
+	if err != nil {
+		logError(r, "loading security events", err)
+		u.Templates.SecurityEvents.Execute(w, r, data, err)
+		return
+	}
+	data.Events = events
+
+	u.Templates.SecurityEvents.Execute(w, r, data)
+}
+
+// SecurityEvents lets admins search the security audit trail of every user.
+// With format=csv the results are downloaded as a CSV file instead.
+func (a Admin) SecurityEvents(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email  string
+		UserID string
+		Event  string
+		Since  string
+		Until  string
+		Events []string
+		Result []models.SecurityEvent
+	}
+	data.Email = r.FormValue("email")
+	data.UserID = r.FormValue("user_id")
+	data.Event = r.FormValue("event")
+	data.Since = r.FormValue("since")
+	data.Until = r.FormValue("until")
+	data.Events = models.SecurityEvents
+
+	filter := models.SecurityEventFilter{
+		Email: data.Email,
+		Event: data.Event,
+		Limit: adminAuditLogLimit,
+	}
+	var err error
+	if data.UserID != "" {
+		filter.UserID, err = strconv.Atoi(data.UserID)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+	}
+	if data.Since != "" {
+		filter.Since, err = time.Parse("2006-01-02", data.Since)
+		if err != nil {
+			http.Error(w, "Invalid start date", http.StatusBadRequest)
+			return
+		}
+	}
+	if data.Until != "" {
+		filter.Until, err = time.Parse("2006-01-02", data.Until)
+		if err != nil {
+			http.Error(w, "Invalid end date", http.StatusBadRequest)
+			return
+		}
+		// include the whole end date
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+
+	csvExport := r.FormValue("format") == "csv"
+	if csvExport {
+		// exports are not limited to what fits on a page
+		filter.Limit = adminSecurityExportLimit
+	}
+
+	events, err := a.SecurityEventService.Search(r.Context(), filter)
+	if err != nil {
+		logError(r, "searching security events", err)
+		a.Templates.SecurityEvents.Execute(w, r, data, err)
+		return
+	}
+
+	if csvExport {
+		writeSecurityEventsCSV(w, r, events)
+		return
+	}
+
+	data.Result = events
+	a.Templates.SecurityEvents.Execute(w, r, data)
+}
+
+func writeSecurityEventsCSV(w http.ResponseWriter, r *http.Request, events []models.SecurityEvent) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="security-events.csv"`)
+
+	optionalID := func(id *int) string {
+		if id == nil {
+			return ""
+		}
+		return strconv.Itoa(*id)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "time", "event", "user_id", "actor_id", "actor_email", "gallery_id", "ip", "user_agent", "request_id", "details"})
+	for _, event := range events {
+		cw.Write([]string{
+			strconv.Itoa(event.ID),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			event.Event,
+			optionalID(event.UserID),
+			optionalID(event.ActorID),
+			event.ActorEmail,
+			optionalID(event.GalleryID),
+			event.IP,
+			event.UserAgent,
+			event.RequestID,
+			event.Details,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logError(r, "writing security events CSV", err)
+	}
+}
@@ -0,0 +1,146 @@
+package controllers
+
+import (
+	stdctx "context"
+	"io"
+	"time"
+
+	"github.com/taherk/galleryapp/models"
+)
+
+// The controllers only depend on the methods they call, so they can run
+// against the Postgres services in models as well as their in-memory
+// counterparts.
+
+// Transactor runs fn in a transaction that every service called with the ctx
+// passed to fn takes part in, see models.WithTx.
+type Transactor interface {
+	WithTx(ctx stdctx.Context, fn func(ctx stdctx.Context) error) error
+}
+
+type UserService interface {
+	Create(ctx stdctx.Context, email string, password string) (*models.User, error)
+	Authenticate(ctx stdctx.Context, email string, password string) (*models.User, error)
+	ValidatePassword(password string) error
+	UpdatePassword(ctx stdctx.Context, userID int, password string) error
+	UpdateEmail(ctx stdctx.Context, userID int, email string) error
+	ByID(ctx stdctx.Context, id int) (*models.User, error)
+	ByEmail(ctx stdctx.Context, email string) (*models.User, error)
+	Search(ctx stdctx.Context, query string) ([]models.User, error)
+	SetDisabled(ctx stdctx.Context, userID int, disabled bool) error
+}
+
+type SessionService interface {
+	Create(ctx stdctx.Context, userID uint) (*models.Session, error)
+	User(ctx stdctx.Context, token string) (*models.User, error)
+	Delete(ctx stdctx.Context, token string) error
+	DeleteByUserID(ctx stdctx.Context, userID uint) error
+}
+
+type PasswordResetService interface {
+	Create(ctx stdctx.Context, email string, notify func(ctx stdctx.Context, pwReset *models.PasswordReset) error) (*models.PasswordReset, error)
+	Consume(ctx stdctx.Context, token string) (*models.User, error)
+}
+
+type EmailChangeService interface {
+	Create(ctx stdctx.Context, userID int, newEmail string, notify func(ctx stdctx.Context, emailChange *models.EmailChange) error) (*models.EmailChange, error)
+	Consume(ctx stdctx.Context, token string) (*models.EmailChange, error)
+}
+
+type SignInLinkService interface {
+	Create(ctx stdctx.Context, email string, notify func(ctx stdctx.Context, link *models.SignInLink) error) (*models.SignInLink, error)
+	Consume(ctx stdctx.Context, token string, nonce string) (*models.User, error)
+}
+
+type AccountService interface {
+	Export(ctx stdctx.Context, userID int) (*models.AccountExport, error)
+	WriteArchive(ctx stdctx.Context, w io.Writer, export *models.AccountExport) error
+	ScheduledDeletion(ctx stdctx.Context, userID int) (*time.Time, error)
+	RequestDeletion(ctx stdctx.Context, userID int) (time.Time, error)
+	CancelDeletion(ctx stdctx.Context, userID int) error
+}
+
+type APITokenService interface {
+	Create(ctx stdctx.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*models.APIToken, error)
+	ByUserID(ctx stdctx.Context, userID int) ([]models.APIToken, error)
+	User(ctx stdctx.Context, token string) (*models.User, *models.APIToken, error)
+	Delete(ctx stdctx.Context, userID int, id int) error
+}
+
+type IdentityService interface {
+	User(ctx stdctx.Context, provider string, claims *models.OIDCClaims) (*models.User, error)
+}
+
+type InviteService interface {
+	Create(ctx stdctx.Context, inviter *models.User, email string, notify func(ctx stdctx.Context, invite *models.Invite) error) (*models.Invite, error)
+	Remaining(ctx stdctx.Context, user *models.User) (int, error)
+	ByInviterID(ctx stdctx.Context, inviterID int) ([]models.Invite, error)
+	Consume(ctx stdctx.Context, token string, email string) (*models.Invite, error)
+	Release(ctx stdctx.Context, id int) error
+}
+
+type SecurityEventService interface {
+	Record(ctx stdctx.Context, event models.SecurityEvent) error
+	ByUserID(ctx stdctx.Context, userID int, limit int) ([]models.SecurityEvent, error)
+	Search(ctx stdctx.Context, filter models.SecurityEventFilter) ([]models.SecurityEvent, error)
+}
+
+type NotificationService interface {
+	Preferences(ctx stdctx.Context, userID int) (map[string]string, error)
+	SetPreference(ctx stdctx.Context, userID int, event string, delivery string) error
+	Unsubscribe(ctx stdctx.Context, token string) error
+	Notify(ctx stdctx.Context, userID int, event string, key string, subject string, message string, link string) error
+}
+
+type EmailService interface {
+	ForgotPassword(ctx stdctx.Context, key string, to string, resetURL string) error
+	ConfirmEmailChange(ctx stdctx.Context, key string, to string, confirmURL string) error
+	EmailChanged(ctx stdctx.Context, key string, to string, newEmail string) error
+	SignInLink(ctx stdctx.Context, key string, to string, signInURL string) error
+	Invite(ctx stdctx.Context, key string, to string, inviterEmail string, signUpURL string) error
+}
+
+type GalleryService interface {
+	Create(ctx stdctx.Context, title string, userID int) (*models.Gallery, error)
+	ByID(ctx stdctx.Context, id int) (*models.Gallery, error)
+	ByUserID(ctx stdctx.Context, userID int) ([]models.Gallery, error)
+	All(ctx stdctx.Context) ([]models.Gallery, error)
+	SetTakenDown(ctx stdctx.Context, id int, takenDown bool) error
+	UpdateTitle(ctx stdctx.Context, gallery *models.Gallery) error
+	Delete(ctx stdctx.Context, id int) error
+	Images(ctx stdctx.Context, galleryID int) ([]models.Image, error)
+	Image(ctx stdctx.Context, galleryID int, filename string) (models.Image, error)
+	CreateImage(ctx stdctx.Context, galleryID int, filename string, contents io.Reader) (models.Image, error)
+	DeleteImage(ctx stdctx.Context, galleryID int, filename string) error
+}
+
+type InboundEmailService interface {
+	Address(ctx stdctx.Context, galleryID int) (string, error)
+	ResetAddress(ctx stdctx.Context, galleryID int) (string, error)
+	DisableAddress(ctx stdctx.Context, galleryID int) error
+	Receive(ctx stdctx.Context, email *models.InboundEmail) (*models.Gallery, []models.Image, error)
+}
+
+type ShareLinkService interface {
+	Create(ctx stdctx.Context, galleryID int, name string) (*models.ShareLink, error)
+	ByGalleryID(ctx stdctx.Context, galleryID int) ([]models.ShareLink, error)
+	ByToken(ctx stdctx.Context, token string) (*models.ShareLink, error)
+	MarkOpened(ctx stdctx.Context, id int) (bool, error)
+	Delete(ctx stdctx.Context, galleryID int, id int) error
+}
+
+type ImpersonationService interface {
+	Start(ctx stdctx.Context, adminID int, userID int) (*models.Impersonation, error)
+	User(ctx stdctx.Context, adminID int, token string) (*models.User, error)
+	Stop(ctx stdctx.Context, token string) error
+}
+
+type AdminAuditService interface {
+	Record(ctx stdctx.Context, admin *models.User, action string, targetUserID, targetGalleryID *int, details string) error
+	Recent(ctx stdctx.Context, limit int) ([]models.AdminAction, error)
+}
+
+type EmailOutboxService interface {
+	Messages(ctx stdctx.Context, status string, limit int) ([]models.OutboxMessage, error)
+	Retry(ctx stdctx.Context, id int) error
+}
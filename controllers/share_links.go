@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/taherk/galleryapp/context"
+	"github.com/taherk/galleryapp/errors"
+	"github.com/taherk/galleryapp/models"
+)
+
+// ShareLink is a share link of a gallery as shown to its owner.
+type ShareLink struct {
+	ID        int
+	Name      string
+	URL       string
+	CreatedAt string
+	// Opened is empty until someone other than the owner opens the link.
+	Opened string
+}
+
+func newShareLink(link models.ShareLink) ShareLink {
+	sl := ShareLink{
+		ID:        link.ID,
+		Name:      link.Name,
+		URL:       shareLinkURL(link.Token),
+		CreatedAt: link.CreatedAt.Format("Jan 2, 2006"),
+	}
+	if link.FirstOpenedAt != nil {
+		sl.Opened = link.FirstOpenedAt.Format("Jan 2, 2006 15:04")
+	}
+	return sl
+}
+
+func shareLinkURL(token string) string {
+	return "https://www.gallery-app.com/share/" + token
+}
+
+func (ctrl Galleries) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	_, err = ctrl.ShareLinkService.Create(r.Context(), gallery.ID, r.FormValue("name"))
+	if err != nil {
+		logError(r, "creating share link", err)
+		ctrl.renderEdit(w, r, gallery, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+func (ctrl Galleries) DeleteShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := ctrl.galleryByID(w, r, userMustOwnGallery)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "linkID"))
+	if err != nil {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	err = ctrl.ShareLinkService.Delete(r.Context(), gallery.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		logError(r, "deleting share link", err)
+		ctrl.renderEdit(w, r, gallery, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound)
+}
+
+// Shared shows the gallery of a share link. Every use of a link is added to
+// the audit trail of the gallery's owner, but the owner checking their own
+// link does not count as it being opened.
+func (ctrl Galleries) Shared(w http.ResponseWriter, r *http.Request) {
+	link, err := ctrl.ShareLinkService.ByToken(r.Context(), chi.URLParam(r, "token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Share link not found", http.StatusNotFound)
+			return
+		}
+		logError(r, "opening share link", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	gallery, err := ctrl.GalleryService.ByID(r.Context(), link.GalleryID)
+	if err != nil {
+		logError(r, "loading shared gallery", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = galleryMustBeVisible(w, r, gallery)
+	if err != nil {
+		return
+	}
+	ctrl.recordShareLinkUsed(r, gallery, link)
+	if actorID(r) != gallery.UserID {
+		first, err := ctrl.ShareLinkService.MarkOpened(r.Context(), link.ID)
+		if err != nil {
+			// the gallery can be shown anyway
+			logError(r, "marking share link as opened", err)
+		}
+		if first {
+			notifyShareLinkOpened(r, ctrl.NotificationService, gallery, link)
+		}
+	}
+
+	images, err := ctrl.images(r, gallery.ID)
+	if err != nil {
+		logError(r, "loading images", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	var data struct {
+		ID     int
+		Title  string
+		Images []Image
+	}
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.Images = images
+
+	ctrl.Templates.Show.Execute(w, r, data)
+}
+
+// recordShareLinkUsed records the use on the owner's account. Anyone can
+// open a share link, so unlike other events there is no actor unless the
+// visitor is signed in.
+func (ctrl Galleries) recordShareLinkUsed(r *http.Request, gallery *models.Gallery, link *models.ShareLink) {
+	se := securityEvent(r, models.SecurityEventShareLinkUsed, &models.User{ID: uint(gallery.UserID)})
+	if context.User(r.Context()) == nil {
+		se.ActorID = nil
+	}
+	se.GalleryID = &gallery.ID
+	se.Details = gallery.Title
+	if link.Name != "" {
+		se.Details += " via " + link.Name
+	}
+	recordSecurityEvent(r, ctrl.SecurityEventService, se)
+}
@@ -1,14 +1,20 @@
 package controllers
 
 import (
+	stdctx "context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/taherk/galleryapp/context"
 	"github.com/taherk/galleryapp/errors"
 	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/rand"
 )
 
 type Users struct {
@@ -18,61 +24,113 @@ type Users struct {
 		ForgotPassword Template
 		CheckYourEmail Template
 		ResetPassword  Template
+		Settings       Template
+		APITokens      Template
+		Invites        Template
+		SecurityEvents Template
+		Notifications  Template
+		Unsubscribe    Template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	// Tx runs changes that span several services in one transaction.
+	Tx                   Transactor
+	UserService          UserService
+	SessionService       SessionService
+	PasswordResetService PasswordResetService
+	EmailChangeService   EmailChangeService
+	AccountService       AccountService
+	SignInLinkService    SignInLinkService
+	APITokenService      APITokenService
+	IdentityService      IdentityService
+	InviteService        InviteService
+	SecurityEventService SecurityEventService
+	NotificationService  NotificationService
+	EmailService         EmailService
+	// OIDCProviders are the identity providers users can sign in with, keyed
+	// by their name.
+	OIDCProviders map[string]*models.OIDCProvider
+	// InviteOnly restricts sign ups to people with a valid invite.
+	InviteOnly bool
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Email string
+		Email      string
+		Invite     string
+		InviteOnly bool
 	}
 	data.Email = r.FormValue("email")
+	data.Invite = r.FormValue("invite")
+	data.InviteOnly = u.InviteOnly
 
 	u.Templates.New.Execute(w, r, data)
 }
 
 func (u Users) Create(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Email    string
-		Password string
+		Email      string
+		Password   string
+		Invite     string
+		InviteOnly bool
 	}
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
+	data.Invite = r.FormValue("invite")
+	data.InviteOnly = u.InviteOnly
+
+	var invite *models.Invite
+	if u.InviteOnly {
+		var err error
+		invite, err = u.InviteService.Consume(r.Context(), data.Invite, data.Email)
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidInvite) {
+				err = errors.Public(err, "Sign up is invite only, and your invite is invalid, expired or for another email address")
+			}
+			u.Templates.New.Execute(w, r, data, err)
+			return
+		}
+	}
 
-	user, err := u.UserService.Create(data.Email, data.Password)
+	user, err := u.UserService.Create(r.Context(), data.Email, data.Password)
 	if err != nil {
-		// log the information
+		// the invite was not used for an account, so it can be used again
+		if invite != nil {
+			releaseErr := u.InviteService.Release(r.Context(), invite.ID)
+			if releaseErr != nil {
+				logError(r, "releasing invite", releaseErr)
+			}
+		}
 		if errors.Is(err, models.ErrEmailToken) {
 			err = errors.Public(err, "That email address is already associated with an account")
+		} else {
+			slog.WarnContext(r.Context(), "creating user failed", "err", err)
 		}
 		u.Templates.New.Execute(w, r, data, err)
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(r.Context(), user.ID)
 	if err != nil {
-		fmt.Println(err)
+		logError(r, "creating session", err)
 		// TODO: Long term, we should show a warning about not being able to sign the user in.
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
 
 	setCookie(w, CookieSession, session.Token)
+	event := securityEvent(r, models.SecurityEventSignIn, user)
+	event.Details = "sign up"
+	recordSecurityEvent(r, u.SecurityEventService, event)
 
 	http.Redirect(w, r, "/users/me", http.StatusFound)
-
-	fmt.Fprintf(w, "User created: %+v", user)
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.FormValue("gorilla.csrf.Token"))
 	var data struct {
-		Email string
+		Email     string
+		Providers []*models.OIDCProvider
 	}
 	data.Email = r.FormValue("email")
+	data.Providers = u.oidcProviderList()
 	u.Templates.SignIn.Execute(w, r, data)
 }
 
@@ -85,51 +143,282 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
 
-	user, err := u.UserService.Authenticate(data.Email, data.Password)
+	user, err := u.UserService.Authenticate(r.Context(), data.Email, data.Password)
 	if err != nil {
-		fmt.Println(err)
+		slog.InfoContext(r.Context(), "sign in failed", "err", err)
+		// the attempt shows up in the trail of the account, if there is one
+		account, lookupErr := u.UserService.ByEmail(r.Context(), data.Email)
+		if lookupErr != nil && !errors.Is(lookupErr, models.ErrNotFound) {
+			logError(r, "looking up user of failed sign in", lookupErr)
+		}
+		event := securityEvent(r, models.SecurityEventSignInFailed, account)
+		event.ActorEmail = strings.ToLower(data.Email)
+		event.Details = "password"
+		recordSecurityEvent(r, u.SecurityEventService, event)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
 
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(r.Context(), user.ID)
 	if err != nil {
-		fmt.Println(err)
+		logError(r, "creating session", err)
+		if errors.Is(err, models.ErrAccountDisabled) {
+			event := securityEvent(r, models.SecurityEventSignInFailed, user)
+			event.Details = "account disabled"
+			recordSecurityEvent(r, u.SecurityEventService, event)
+			http.Error(w, "Your account has been disabled", http.StatusForbidden)
+			return
+		}
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
 
 	// httponly is not allow cookie access to javascript
 	setCookie(w, CookieSession, session.Token)
+	event := securityEvent(r, models.SecurityEventSignIn, user)
+	event.Details = "password"
+	recordSecurityEvent(r, u.SecurityEventService, event)
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) ProcessSignInLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string
+	}
+	data.Email = r.FormValue("email")
+
+	link, err := u.SignInLinkService.Create(r.Context(), data.Email, func(ctx stdctx.Context, link *models.SignInLink) error {
+		vals := url.Values{
+			"token": {link.Token},
+		}
+		signInURL := "https://www.gallery-app.com/signin/link?" + vals.Encode()
+		return u.EmailService.SignInLink(ctx, link.TokenHash, data.Email, signInURL)
+	})
+	if errors.Is(err, models.ErrNotFound) {
+		// don't reveal whether an account exists for the email address, the
+		// response looks the same, down to a nonce cookie no link matches
+		link = &models.SignInLink{ExpiresAt: time.Now().Add(models.DefaultSignInLinkDuration)}
+		link.Nonce, err = rand.String(models.MinSessionTokenBytes)
+	}
+	if err != nil {
+		logError(r, "creating sign in link", err)
+		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
+		return
+	}
+
+	cookie := newCookie(CookieSignInNonce, link.Nonce)
+	cookie.Expires = link.ExpiresAt
+	http.SetCookie(w, cookie)
+
+	u.Templates.CheckYourEmail.Execute(w, r, data)
+}
+
+func (u Users) SignInWithLink(w http.ResponseWriter, r *http.Request) {
+	nonce, err := readCookie(r, CookieSignInNonce)
+	if err != nil {
+		http.Error(w, "Please open this link in the browser you requested it from", http.StatusForbidden)
+		return
+	}
+
+	user, err := u.SignInLinkService.Consume(r.Context(), r.FormValue("token"), nonce)
+	if err != nil {
+		slog.InfoContext(r.Context(), "sign in with link failed", "err", err)
+		switch {
+		case errors.Is(err, models.ErrWrongBrowser):
+			http.Error(w, "Please open this link in the browser you requested it from", http.StatusForbidden)
+		case errors.Is(err, models.ErrNotFound), errors.Is(err, models.ErrTokenExpired):
+			http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+		default:
+			http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	deleteCookie(w, CookieSignInNonce)
+
+	session, err := u.SessionService.Create(r.Context(), user.ID)
+	if err != nil {
+		logError(r, "creating session", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+	event := securityEvent(r, models.SecurityEventSignIn, user)
+	event.Details = "sign in link"
+	recordSecurityEvent(r, u.SecurityEventService, event)
 
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
+	u.renderSettings(w, r)
+}
+
+// renderSettings renders the settings page of the current user. All the forms
+// on the settings page post to their own handler, which render the page again
+// with any errors that occurred.
+func (u Users) renderSettings(w http.ResponseWriter, r *http.Request, errs ...error) {
 	user := context.User(r.Context())
-	fmt.Fprintf(w, "Current user: %v", user.Email)
+	var data struct {
+		Email               string
+		DeletionScheduledAt *time.Time
+	}
+	data.Email = user.Email
+
+	deleteAfter, err := u.AccountService.ScheduledDeletion(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "loading scheduled deletion", err)
+		errs = append(errs, err)
+	}
+	data.DeletionScheduledAt = deleteAfter
+
+	u.Templates.Settings.Execute(w, r, data, errs...)
+}
+
+func (u Users) ProcessUpdatePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		CurrentPassword string
+		NewPassword     string
+	}
+	data.CurrentPassword = r.FormValue("current_password")
+	data.NewPassword = r.FormValue("new_password")
+
+	_, err := u.UserService.Authenticate(r.Context(), user.Email, data.CurrentPassword)
+	if err != nil {
+		event := securityEvent(r, models.SecurityEventSignInFailed, user)
+		event.Details = "password change"
+		recordSecurityEvent(r, u.SecurityEventService, event)
+		err = errors.Public(err, "Your current password is incorrect")
+		u.renderSettings(w, r, err)
+		return
+	}
+
+	err = u.UserService.UpdatePassword(r.Context(), int(user.ID), data.NewPassword)
+	if err != nil {
+		logError(r, "updating password", err)
+		u.renderSettings(w, r, err)
+		return
+	}
+	event := securityEvent(r, models.SecurityEventPasswordChanged, user)
+	event.Details = "other sessions signed out"
+	recordSecurityEvent(r, u.SecurityEventService, event)
+
+	// a user only ever has one session, so creating a new one replaces the
+	// session token of every other browser the user was signed in with.
+	session, err := u.SessionService.Create(r.Context(), user.ID)
+	if err != nil {
+		logError(r, "creating session", err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	setCookie(w, CookieSession, session.Token)
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) ProcessUpdateEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		NewEmail string
+	}
+	data.NewEmail = strings.ToLower(r.FormValue("new_email"))
+
+	if data.NewEmail == "" || data.NewEmail == user.Email {
+		err := errors.Public(fmt.Errorf("invalid new email: %q", data.NewEmail), "Please enter a new email address")
+		u.renderSettings(w, r, err)
+		return
+	}
+
+	emailChange, err := u.EmailChangeService.Create(r.Context(), int(user.ID), data.NewEmail, func(ctx stdctx.Context, emailChange *models.EmailChange) error {
+		vals := url.Values{
+			"token": {emailChange.Token},
+		}
+		confirmURL := "https://www.gallery-app.com/confirm-email?" + vals.Encode()
+		return u.EmailService.ConfirmEmailChange(ctx, emailChange.TokenHash, emailChange.NewEmail, confirmURL)
+	})
+	if err != nil {
+		logError(r, "requesting email change", err)
+		u.renderSettings(w, r, err)
+		return
+	}
+
+	// the change is only applied once the link sent to the new address is
+	// visited, which proves the user has access to it.
+	var checkData struct {
+		Email string
+	}
+	checkData.Email = emailChange.NewEmail
+	u.Templates.CheckYourEmail.Execute(w, r, checkData)
+}
+
+func (u Users) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+
+	// the token is only used up if the email is changed and the old address
+	// notified, the notification is queued in the same transaction
+	var consumeErr error
+	err := u.Tx.WithTx(r.Context(), func(ctx stdctx.Context) error {
+		var emailChange *models.EmailChange
+		emailChange, consumeErr = u.EmailChangeService.Consume(ctx, token)
+		if consumeErr != nil {
+			return consumeErr
+		}
+		user, err := u.UserService.ByID(ctx, emailChange.UserID)
+		if err != nil {
+			return err
+		}
+		err = u.UserService.UpdateEmail(ctx, emailChange.UserID, emailChange.NewEmail)
+		if err != nil {
+			return err
+		}
+		return u.EmailService.EmailChanged(ctx, emailChange.TokenHash, user.Email, emailChange.NewEmail)
+	})
+	if consumeErr != nil {
+		slog.InfoContext(r.Context(), "confirming email change failed", "err", consumeErr)
+		if errors.Is(consumeErr, models.ErrNotFound) || errors.Is(consumeErr, models.ErrTokenExpired) {
+			http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		logError(r, "updating email", err)
+		if errors.Is(err, models.ErrEmailToken) {
+			http.Error(w, "That email address is already associated with an account", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
 func (u Users) ProcessSignout(w http.ResponseWriter, r *http.Request) {
 	token, err := readCookie(r, CookieSession)
 	if err != nil {
-		fmt.Println(err)
+		slog.InfoContext(r.Context(), "signing out without a session", "err", err)
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
 
-	err = u.SessionService.Delete(token)
+	err = u.SessionService.Delete(r.Context(), token)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			http.Redirect(w, r, "/signin", http.StatusFound)
 		} else {
-			fmt.Println(err)
+			logError(r, "deleting session", err)
 			http.Error(w, "Something went wrong", http.StatusInternalServerError)
 			return
 		}
 	}
 
 	deleteCookie(w, CookieSession)
+	if user := context.User(r.Context()); user != nil {
+		recordSecurityEvent(r, u.SecurityEventService, securityEvent(r, models.SecurityEventSignOut, user))
+	}
 
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
@@ -148,32 +437,35 @@ func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Email = r.FormValue("email")
 
-	pwResetToken, err := u.PasswordResetService.Create(data.Email)
+	// the email is delivered from the outbox, so a mail server that is down
+	// doesn't fail the request
+	pwResetToken, err := u.PasswordResetService.Create(r.Context(), data.Email, func(ctx stdctx.Context, pwReset *models.PasswordReset) error {
+		return u.EmailService.ForgotPassword(ctx, pwReset.TokenHash, data.Email, resetPasswordURL(pwReset))
+	})
 	// TODO: handle other cases in the future. For instance, if a user does not exist
 	// with that email
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
-		return
-	}
-
-	vals := url.Values{
-		"token": {pwResetToken.Token},
-	}
-	resetURL := "https://www.gallery-app.com/reset-pw?" + vals.Encode()
-
-	err = u.EmailService.ForgotPassword(data.Email, resetURL)
-	if err != nil {
-		fmt.Println(err)
+		logError(r, "creating password reset", err)
 		http.Error(w, "Something went wrong.", http.StatusInternalServerError)
 		return
 	}
+	recordSecurityEvent(r, u.SecurityEventService, securityEvent(r, models.SecurityEventPasswordResetRequested, &models.User{
+		ID:    uint(pwResetToken.UserID),
+		Email: strings.ToLower(data.Email),
+	}))
 
 	// don't render your token here. We need the user to confirm they have access to the
 	// email account to verify their identity.
 	u.Templates.CheckYourEmail.Execute(w, r, data)
 }
 
+func resetPasswordURL(pwReset *models.PasswordReset) string {
+	vals := url.Values{
+		"token": {pwReset.Token},
+	}
+	return "https://www.gallery-app.com/reset-pw?" + vals.Encode()
+}
+
 func (u Users) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Token string
@@ -190,26 +482,43 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	data.Token = r.FormValue("token")
 	data.Passsword = r.FormValue("password")
 
-	user, err := u.PasswordResetService.Consume(data.Token)
+	// check the new password before the token is used up, so the user can try
+	// again with a different one
+	err := u.UserService.ValidatePassword(data.Passsword)
 	if err != nil {
-		fmt.Println(err)
+		u.Templates.ResetPassword.Execute(w, r, data, err)
+		return
+	}
+
+	// the token is only used up if the password is updated, so the user can
+	// try again if that fails
+	var user *models.User
+	var consumeErr error
+	err = u.Tx.WithTx(r.Context(), func(ctx stdctx.Context) error {
+		user, consumeErr = u.PasswordResetService.Consume(ctx, data.Token)
+		if consumeErr != nil {
+			return consumeErr
+		}
+		return u.UserService.UpdatePassword(ctx, int(user.ID), data.Passsword)
+	})
+	if consumeErr != nil {
+		slog.InfoContext(r.Context(), "resetting password failed", "err", consumeErr)
 		// TODO: Distinguish between types of errors
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
 		return
 	}
-
-	// TODO: Update the user's password
-	err = u.UserService.UpdatePassword(int(user.ID), data.Passsword)
 	if err != nil {
-		fmt.Println(err)
+		logError(r, "updating password", err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
 	}
+	recordSecurityEvent(r, u.SecurityEventService, securityEvent(r, models.SecurityEventPasswordReset, user))
 
 	// Sign the user in
 	// any errors from this point onwards should  redirect the user to the sign in page
-	session, err := u.SessionService.Create(user.ID)
+	session, err := u.SessionService.Create(r.Context(), user.ID)
 	if err != nil {
-		fmt.Println(err)
+		logError(r, "creating session", err)
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
@@ -217,12 +526,87 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/users/me", http.StatusFound)
 }
 
+func (u Users) ExportData(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	export, err := u.AccountService.Export(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "exporting account", err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("gallery-export-%s", export.ExportedAt.Format("2006-01-02"))
+	if r.FormValue("originals") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".json"))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(export)
+		if err != nil {
+			logError(r, "writing account export", err)
+		}
+		return
+	}
+
+	// the archive is streamed, so once writing started we can no longer
+	// respond with an error status.
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+".zip"))
+	err = u.AccountService.WriteArchive(r.Context(), w, export)
+	if err != nil {
+		logError(r, "writing account archive", err)
+	}
+}
+
+func (u Users) ProcessDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	password := r.FormValue("password")
+
+	_, err := u.UserService.Authenticate(r.Context(), user.Email, password)
+	if err != nil {
+		err = errors.Public(err, "Your password is incorrect")
+		u.renderSettings(w, r, err)
+		return
+	}
+
+	_, err = u.AccountService.RequestDeletion(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "requesting account deletion", err)
+		u.renderSettings(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) ProcessCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+
+	err := u.AccountService.CancelDeletion(r.Context(), int(user.ID))
+	if err != nil {
+		logError(r, "cancelling account deletion", err)
+		u.renderSettings(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
 type UserMiddleware struct {
-	SessionService *models.SessionService
+	SessionService       SessionService
+	APITokenService      APITokenService
+	ImpersonationService ImpersonationService
+	AdminAuditService    AdminAuditService
 }
 
 func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests with an API token are authenticated by SetTokenUser
+		if _, ok := bearerToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
 
 		token, err := readCookie(r, CookieSession)
 		if err != nil {
@@ -230,18 +614,55 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := umw.SessionService.User(token)
+		user, err := umw.SessionService.User(r.Context(), token)
 		if err != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
 		ctx := r.Context()
+
+		if user.IsAdmin() {
+			impersonated, ok := umw.impersonatedUser(r, user)
+			if ok {
+				ctx = context.WithImpersonator(ctx, user)
+				user = impersonated
+			}
+		}
+
 		ctx = context.WithUser(ctx, user)
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// impersonatedUser returns the user the admin is impersonating, if any. Every
+// request that changes something while impersonating is recorded in the admin
+// audit log.
+func (umw UserMiddleware) impersonatedUser(r *http.Request, admin *models.User) (*models.User, bool) {
+	token, err := readCookie(r, CookieImpersonation)
+	if err != nil {
+		return nil, false
+	}
+
+	user, err := umw.ImpersonationService.User(r.Context(), int(admin.ID), token)
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			logError(r, "loading impersonated user", err)
+		}
+		return nil, false
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		targetUserID := int(user.ID)
+		err = umw.AdminAuditService.Record(r.Context(), admin, models.AdminActionImpersonatedRequest, &targetUserID, nil, r.Method+" "+r.URL.Path)
+		if err != nil {
+			logError(r, "recording impersonated request", err)
+		}
+	}
+
+	return user, true
+}
+
 func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := context.User(r.Context())
@@ -253,3 +674,75 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (umw UserMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if !user.IsAdmin() {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetTokenUser authenticates requests that carry an API token in an
+// "Authorization: Bearer" header. A request with a bearer token is never
+// authenticated with the session cookie, even if the token is invalid.
+func (umw UserMiddleware) SetTokenUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, apiToken, err := umw.APITokenService.User(r.Context(), token)
+		if err != nil {
+			if !errors.Is(err, models.ErrNotFound) && !errors.Is(err, models.ErrTokenExpired) {
+				logError(r, "authenticating API token", err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid API token", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := r.Context()
+		ctx = context.WithUser(ctx, user)
+		ctx = context.WithAPIToken(ctx, apiToken)
+		r = r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope only lets requests authenticated with an API token through if
+// the token has the scope. Requests authenticated with a session cookie are
+// not limited by scopes.
+func (umw UserMiddleware) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			apiToken := context.APIToken(r.Context())
+			if apiToken != nil && !apiToken.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				http.Error(w, "API token is missing the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	stdctx "context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/taherk/galleryapp/models"
+)
+
+func TestUsersSignUp(t *testing.T) {
+	app := newTestApp(t)
+	c := app.client()
+
+	resp, body := c.post("/users", url.Values{"email": {"Alice@Example.com"}, "password": {testPassword}})
+	assertRedirect(t, resp, "/users/me")
+	if strings.Contains(body, "PasswordHash") || strings.Contains(body, "$2a$") {
+		t.Errorf("the sign up response leaks the user:\n%s", body)
+	}
+
+	resp, body = c.get("/users/me")
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "alice@example.com") {
+		t.Errorf("settings page does not show the lower case email address:\n%s", body)
+	}
+
+	events := app.events(models.SecurityEventSignIn)
+	if len(events) != 1 || events[0].Details != "sign up" {
+		t.Errorf("sign in events = %+v, want one for the sign up", events)
+	}
+}
+
+func TestUsersSignUpErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     string
+	}{
+		{"email taken", "taken@example.com", testPassword, "That email address is already associated with an account"},
+		{"email taken with other case", "TAKEN@example.com", testPassword, "That email address is already associated with an account"},
+		{"short password", "new@example.com", "short", "Your password must be at least"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.createUser("taken@example.com")
+			c := app.client()
+
+			resp, body := c.post("/users", url.Values{"email": {tt.email}, "password": {tt.password}})
+			assertStatus(t, resp, http.StatusOK)
+			if !strings.Contains(body, tt.want) {
+				t.Errorf("sign up page does not show %q:\n%s", tt.want, body)
+			}
+			if c.cookie(CookieSession) != "" {
+				t.Errorf("failed sign up set a session cookie")
+			}
+		})
+	}
+}
+
+func TestUsersSignUpInviteOnly(t *testing.T) {
+	app := newTestApp(t, func(u *Users) {
+		u.InviteOnly = true
+	})
+	inviter := app.createUser("inviter@example.com")
+	invite, err := app.invites.Create(stdctx.Background(), inviter, "invited@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := app.client()
+	resp, body := c.post("/users", url.Values{"email": {"other@example.com"}, "password": {testPassword}, "invite": {invite.Token}})
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "Sign up is invite only") {
+		t.Errorf("sign up with an invite for another address was not rejected:\n%s", body)
+	}
+
+	resp, _ = c.post("/users", url.Values{"email": {"invited@example.com"}, "password": {testPassword}, "invite": {invite.Token}})
+	assertRedirect(t, resp, "/users/me")
+
+	// every invite can only be used once
+	resp, body = app.client().post("/users", url.Values{"email": {"invited@example.com"}, "password": {testPassword}, "invite": {invite.Token}})
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "Sign up is invite only") {
+		t.Errorf("invite was used twice:\n%s", body)
+	}
+}
+
+func TestUsersSignIn(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+
+	t.Run("wrong password", func(t *testing.T) {
+		c := app.client()
+		resp, _ := c.post("/signin", url.Values{"email": {"Alice@example.com"}, "password": {"wrong password"}})
+		if resp.StatusCode == http.StatusFound || c.cookie(CookieSession) != "" {
+			t.Fatalf("signed in with the wrong password")
+		}
+		events := app.events(models.SecurityEventSignInFailed)
+		if len(events) != 1 || events[0].ActorEmail != "alice@example.com" {
+			t.Fatalf("failed sign in events = %+v, want one for alice@example.com", events)
+		}
+		if events[0].UserID == nil || *events[0].UserID != int(user.ID) {
+			t.Errorf("failed sign in user ID = %v, want %d", events[0].UserID, user.ID)
+		}
+	})
+
+	t.Run("unknown email", func(t *testing.T) {
+		c := app.client()
+		c.post("/signin", url.Values{"email": {"bob@example.com"}, "password": {testPassword}})
+		events := app.events(models.SecurityEventSignInFailed)
+		if len(events) != 2 {
+			t.Fatalf("failed sign in events = %+v, want another one for bob@example.com", events)
+		}
+		for _, event := range events {
+			if event.ActorEmail == "bob@example.com" && event.UserID != nil {
+				t.Errorf("failed sign in of an unknown email has user ID %d", *event.UserID)
+			}
+		}
+	})
+
+	t.Run("right password", func(t *testing.T) {
+		c := app.client()
+		resp, _ := c.post("/signin", url.Values{"email": {"Alice@example.com"}, "password": {testPassword}})
+		assertRedirect(t, resp, "/users/me")
+
+		resp, _ = c.get("/users/me")
+		assertStatus(t, resp, http.StatusOK)
+	})
+}
+
+func TestUsersSignInDisabled(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	c := app.signedIn(user)
+
+	err := app.users.SetDisabled(stdctx.Background(), int(user.ID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the existing session stops working right away
+	resp, _ := c.get("/users/me")
+	assertRedirect(t, resp, "/signin")
+
+	resp, _ = app.client().post("/signin", url.Values{"email": {"alice@example.com"}, "password": {testPassword}})
+	assertStatus(t, resp, http.StatusForbidden)
+}
+
+func TestUsersSignOut(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	c := app.signedIn(user)
+	token := c.cookie(CookieSession)
+
+	resp, _ := c.post("/signout", nil)
+	assertRedirect(t, resp, "/signin")
+
+	// the session is gone, not just the cookie
+	c.setCookie(CookieSession, token)
+	resp, _ = c.get("/users/me")
+	assertRedirect(t, resp, "/signin")
+
+	if events := app.events(models.SecurityEventSignOut); len(events) != 1 {
+		t.Errorf("sign out events = %+v, want one", events)
+	}
+}
+
+func TestUsersRequireUser(t *testing.T) {
+	app := newTestApp(t)
+	c := app.client()
+
+	resp, _ := c.get("/users/me")
+	assertRedirect(t, resp, "/signin")
+
+	c.setCookie(CookieSession, "not a session token")
+	resp, _ = c.get("/users/me")
+	assertRedirect(t, resp, "/signin")
+}
+
+func TestUsersResetPassword(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser("alice@example.com")
+	c := app.client()
+
+	resp, _ := c.post("/forgot-pw", url.Values{"email": {"alice@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	token := app.lastToken("alice@example.com")
+
+	// a password that is not allowed doesn't use up the token
+	resp, body := c.post("/reset-pw", url.Values{"token": {token}, "password": {"short"}})
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "Your password must be at least") {
+		t.Errorf("reset page does not explain the password policy:\n%s", body)
+	}
+
+	resp, _ = c.post("/reset-pw", url.Values{"token": {token}, "password": {"a new password"}})
+	assertRedirect(t, resp, "/users/me")
+	if c.cookie(CookieSession) == "" {
+		t.Errorf("user was not signed in after resetting the password")
+	}
+
+	_, err := app.users.Authenticate(stdctx.Background(), "alice@example.com", "a new password")
+	if err != nil {
+		t.Errorf("signing in with the new password: %v", err)
+	}
+
+	resp, _ = app.client().post("/reset-pw", url.Values{"token": {token}, "password": {"another password"}})
+	if resp.StatusCode == http.StatusFound {
+		t.Errorf("reset token was used twice")
+	}
+}
+
+func TestUsersUpdatePassword(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	other := app.signedIn(user)
+	c := app.signedIn(user)
+
+	resp, body := c.post("/users/me/password", url.Values{"current_password": {"wrong password"}, "new_password": {"a new password"}})
+	assertStatus(t, resp, http.StatusOK)
+	if !strings.Contains(body, "Your current password is incorrect") {
+		t.Errorf("settings page does not show the error:\n%s", body)
+	}
+
+	resp, _ = c.post("/users/me/password", url.Values{"current_password": {testPassword}, "new_password": {"a new password"}})
+	assertRedirect(t, resp, "/users/me")
+
+	resp, _ = c.get("/users/me")
+	assertStatus(t, resp, http.StatusOK)
+	// every other browser is signed out
+	resp, _ = other.get("/users/me")
+	assertRedirect(t, resp, "/signin")
+}
+
+func TestUsersUpdateEmail(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	c := app.signedIn(user)
+
+	resp, _ := c.post("/users/me/email", url.Values{"new_email": {"Alice@New.example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+
+	// the email only changes once the new address is confirmed
+	current, err := app.users.ByID(stdctx.Background(), int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Email != "alice@example.com" {
+		t.Fatalf("email changed to %q before it was confirmed", current.Email)
+	}
+
+	token := app.lastToken("alice@new.example.com")
+	resp, _ = c.get("/confirm-email?" + url.Values{"token": {token}}.Encode())
+	assertRedirect(t, resp, "/users/me")
+
+	current, err = app.users.ByID(stdctx.Background(), int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Email != "alice@new.example.com" {
+		t.Errorf("email = %q, want alice@new.example.com", current.Email)
+	}
+
+	var notified bool
+	for _, email := range app.mailer.Sent() {
+		notified = notified || email.To == "alice@example.com"
+	}
+	if !notified {
+		t.Errorf("the previous address was not told about the change")
+	}
+
+	resp, _ = c.get("/confirm-email?" + url.Values{"token": {token}}.Encode())
+	assertStatus(t, resp, http.StatusNotFound)
+}
+
+func TestUsersUpdateEmailTaken(t *testing.T) {
+	app := newTestApp(t)
+	user := app.createUser("alice@example.com")
+	c := app.signedIn(user)
+
+	resp, _ := c.post("/users/me/email", url.Values{"new_email": {"bob@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	token := app.lastToken("bob@example.com")
+	confirmPath := "/confirm-email?" + url.Values{"token": {token}}.Encode()
+
+	// bob signed up before the link was opened
+	bob := app.createUser("bob@example.com")
+	resp, _ = c.get(confirmPath)
+	assertStatus(t, resp, http.StatusConflict)
+
+	// nothing was changed, so the link still works once the address is free
+	err := app.users.UpdateEmail(stdctx.Background(), int(bob.ID), "bob@new.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = c.get(confirmPath)
+	assertRedirect(t, resp, "/users/me")
+}
+
+func TestUsersSignInLink(t *testing.T) {
+	app := newTestApp(t)
+	app.createUser("alice@example.com")
+	c := app.client()
+
+	resp, _ := c.post("/signin/link", url.Values{"email": {"alice@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	link := "/signin/link?" + url.Values{"token": {app.lastToken("alice@example.com")}}.Encode()
+
+	// the link only works in the browser that requested it
+	other := app.client()
+	other.setCookie(CookieSignInNonce, "another nonce")
+	resp, _ = other.get(link)
+	assertStatus(t, resp, http.StatusForbidden)
+
+	resp, _ = c.get(link)
+	assertRedirect(t, resp, "/users/me")
+	if c.cookie(CookieSession) == "" {
+		t.Errorf("no session after signing in with the link")
+	}
+
+	resp, _ = c.get(link)
+	if resp.StatusCode == http.StatusFound {
+		t.Errorf("sign in link was used twice")
+	}
+}
+
+func TestUsersSignInLinkUnknownEmail(t *testing.T) {
+	app := newTestApp(t)
+	c := app.client()
+
+	// the response does not reveal whether there is an account
+	resp, _ := c.post("/signin/link", url.Values{"email": {"nobody@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	if sent := app.mailer.Sent(); len(sent) != 0 {
+		t.Errorf("sent %d emails for an unknown address", len(sent))
+	}
+	if c.cookie(CookieSignInNonce) == "" {
+		t.Errorf("no nonce cookie for an unknown address")
+	}
+
+	app.createUser("alice@example.com")
+	known := app.client()
+	resp, _ = known.post("/signin/link", url.Values{"email": {"alice@example.com"}})
+	assertStatus(t, resp, http.StatusOK)
+	if known.cookie(CookieSignInNonce) == "" {
+		t.Errorf("no nonce cookie for a known address")
+	}
+}
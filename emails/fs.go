@@ -0,0 +1,11 @@
+package emails
+
+import "embed"
+
+// FS holds the transactional email templates. Every email kind has a
+// <kind>.gohtml file rendered with html/template and a <kind>.txt file
+// rendered with text/template, which also defines the "subject". Both are
+// wrapped in the matching layout file.
+//
+//go:embed *.gohtml *.txt
+var FS embed.FS
@@ -0,0 +1,80 @@
+// Package logging sets up the structured logger of the app.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	appctx "github.com/taherk/galleryapp/context"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// redacted replaces the values of attributes whose key contains one of
+// these, so secrets that end up in a log call are not written to the logs.
+var redacted = []string{"password", "secret", "token", "authorization", "cookie", "csrf"}
+
+// New returns a logger that writes records of at least level to w, in
+// FormatText or FormatJSON. Records logged with a request context get the
+// request ID.
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact,
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, &opts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, &opts)
+	default:
+		return nil, fmt.Errorf("logging.New: unknown format %q", format)
+	}
+	return slog.New(contextHandler{handler}), nil
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, secret := range redacted {
+		if strings.Contains(key, secret) {
+			return slog.String(a.Key, "REDACTED")
+		}
+	}
+	return a
+}
+
+// contextHandler adds the request ID and the trace of the context to every
+// record, so logs can be found from a trace and the other way around.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := appctx.RequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -1,84 +1,72 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
-	"github.com/joho/godotenv"
+	"github.com/taherk/galleryapp/config"
 	"github.com/taherk/galleryapp/controllers"
+	"github.com/taherk/galleryapp/logging"
+	"github.com/taherk/galleryapp/metrics"
 	"github.com/taherk/galleryapp/migrations"
 	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/passwords"
 	"github.com/taherk/galleryapp/templates"
+	"github.com/taherk/galleryapp/tracing"
 	"github.com/taherk/galleryapp/views"
 )
 
-// it is better not to refer the config in the rather pass in the values needed.
-// which is why the config structs of components are defined in their package.
-type config struct {
-	PSQL models.PostgresConfig
-	SMTP models.SMTPConfig
-	CSRF struct {
-		Key    string
-		Secure bool
+func main() {
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-	Server struct {
-		Address string
+	if err != nil {
+		fatal("loading config", err)
 	}
-}
 
-func loadEnvConfig() (config, error) {
-	var cfg config
-	err := godotenv.Load()
+	logger, err := logging.New(os.Stderr, cfg.Log.Format, cfg.Log.Level)
 	if err != nil {
-		return cfg, nil
+		fatal("creating logger", err)
 	}
+	slog.SetDefault(logger)
+	// String redacts the secrets
+	slog.Info("loaded config", "config", cfg.String())
 
-	// psql
-	cfg.PSQL = models.DefaultPostgresConfig()
-
-	// csrf
-	cfg.CSRF.Key = "hciCfay4reF2GIyx7Fi3CUoakVSRgap9"
-	cfg.CSRF.Secure = false
+	// ctx is cancelled on SIGINT or SIGTERM, which starts the shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// http server
-	cfg.Server.Address = ":3000"
-
-	// smtp
-	host := os.Getenv("SMTP_HOST")
-	portStr := os.Getenv("SMTP_PORT")
-	port, err := strconv.Atoi(portStr)
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
 	if err != nil {
-		panic(fmt.Errorf("invalid port: %w", err))
+		fatal("setting up tracing", err)
 	}
-	username := os.Getenv("SMTP_USERNAME")
-	password := os.Getenv("SMTP_PASSWORD")
-
-	cfg.SMTP.Host = host
-	cfg.SMTP.Port = port
-	cfg.SMTP.Username = username
-	cfg.SMTP.Password = password
+	// background workers, which are waited for before the database is closed
+	var workers sync.WaitGroup
 
-	return cfg, nil
-}
-
-func main() {
-	config, err := loadEnvConfig()
+	// Setup DB
+	db, err := models.Open(cfg.PSQL)
 	if err != nil {
 		panic(err)
 	}
+	defer db.Close()
 
-	// Setup DB
-	cfg := models.DefaultPostgresConfig()
-	db, err := models.Open(cfg)
+	err = metrics.RegisterDB(db, cfg.PSQL.Database)
 	if err != nil {
 		panic(err)
 	}
-	defer db.Close()
 
 	err = models.MigrateFS(db, migrations.FS, ".")
 	if err != nil {
@@ -86,8 +74,23 @@ func main() {
 	}
 
 	// Setup Services
+	breachedPasswords, err := models.LoadBreachedPasswords(passwords.Breached)
+	if err != nil {
+		panic(err)
+	}
+
+	passwordHasher, err := models.NewPasswordHasher(cfg.Password.Hasher, cfg.Password.BcryptCost)
+	if err != nil {
+		fatal("creating password hasher", err)
+	}
+
 	userService := &models.UserService{
 		DB: db,
+		PasswordPolicy: &models.PasswordPolicy{
+			MinLength: cfg.Password.MinLength,
+			Breached:  breachedPasswords,
+		},
+		PasswordHasher: passwordHasher,
 	}
 	sessionService := &models.SessionService{
 		DB: db,
@@ -95,47 +98,210 @@ func main() {
 	pwResetService := &models.PasswordResetService{
 		DB: db,
 	}
+	emailChangeService := &models.EmailChangeService{
+		DB: db,
+	}
+	signInLinkService := &models.SignInLinkService{
+		DB: db,
+	}
 	galleryService := &models.GalleryService{
+		DB:        db,
+		ImagesDir: cfg.Storage.ImagesDir,
+	}
+	accountService := &models.AccountService{
+		DB:             db,
+		UserService:    userService,
+		GalleryService: galleryService,
+		SessionService: sessionService,
+	}
+	emailOutboxService := &models.EmailOutboxService{
 		DB: db,
 	}
-	emailService, err := models.NewEmailService(config.SMTP)
+	mailer, err := models.NewMailer(cfg.Mail)
 	if err != nil {
-		log.Fatalf("cannot create mail service: %v", err)
+		fatal("creating mailer", err)
+	}
+	emailService, err := models.NewEmailService(metrics.Mailer{Mailer: mailer})
+	if err != nil {
+		fatal("creating email service", err)
+	}
+	emailService.Outbox = emailOutboxService
+	identityService := &models.IdentityService{
+		DB: db,
 	}
+	oidcProviders := make(map[string]*models.OIDCProvider)
+	for _, oidcCfg := range cfg.OIDC {
+		provider, err := models.NewOIDCProvider(ctx, oidcCfg)
+		if err != nil {
+			fatal("creating oidc provider", err)
+		}
+		oidcProviders[provider.Name] = provider
+	}
+
+	// delete accounts whose deletion grace period has passed
+	runEvery(ctx, &workers, time.Hour, true, func(ctx context.Context) {
+		n, err := accountService.PurgeDeleted(ctx)
+		if err != nil {
+			slog.Error("purging deleted accounts", "err", err)
+		}
+		if n > 0 {
+			slog.Info("purged deleted accounts", "count", n)
+		}
+	})
+
+	notificationService := &models.NotificationService{
+		DB:           db,
+		EmailService: emailService,
+		Secret:       []byte(cfg.Notifications.Secret),
+	}
+
+	// send the daily digests of notifications. Every user's digest is due a
+	// day after their last one, so it is checked often, not once a day.
+	runEvery(ctx, &workers, 5*time.Minute, true, func(ctx context.Context) {
+		n, err := notificationService.SendDigests(ctx)
+		if err != nil {
+			slog.Error("sending notification digests", "err", err)
+		}
+		if n > 0 {
+			slog.Info("sent notification digests", "count", n)
+		}
+	})
+
+	// deliver queued emails
+	runEvery(ctx, &workers, 5*time.Second, true, func(ctx context.Context) {
+		_, err := emailOutboxService.Deliver(ctx, emailService.Send, 20)
+		if err != nil {
+			slog.Error("delivering emails", "err", err)
+		}
+	})
+
+	// delete old sent and dead emails, dead ones still hold their tokens
+	runEvery(ctx, &workers, time.Hour, true, func(ctx context.Context) {
+		n, err := emailOutboxService.Purge(ctx, time.Now().Add(-models.OutboxRetention))
+		if err != nil {
+			slog.Error("purging emails", "err", err)
+		}
+		if n > 0 {
+			slog.Info("purged emails", "count", n)
+		}
+	})
 
 	csrfMiddleware := func(next http.Handler) http.Handler {
-		csrfMw := csrf.Protect([]byte(config.CSRF.Key), csrf.Secure(config.CSRF.Secure), csrf.Path("/"))
-		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			next.ServeHTTP(w, r)
+		csrfMw := csrf.Protect([]byte(cfg.CSRF.Key), csrf.Secure(cfg.CSRF.Secure), csrf.Path("/"))
+		handler := csrfMw(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// requests with an API token are not authenticated by a cookie the
+			// browser sends on its own, so they cannot be forged cross-site.
+			if strings.HasPrefix(strings.ToLower(r.Header.Get("Authorization")), "bearer ") {
+				r = csrf.UnsafeSkipCheck(r)
+			}
+			// one-click unsubscribe requests come from mail clients, and are
+			// authenticated by the signed token in the link instead.
+			if r.Method == http.MethodPost && r.URL.Path == "/unsubscribe" {
+				r = csrf.UnsafeSkipCheck(r)
+			}
+			handler.ServeHTTP(w, r)
 		})
+	}
 
-		return csrfMw(handler)
+	apiTokenService := &models.APITokenService{
+		DB: db,
+	}
+
+	impersonationService := &models.ImpersonationService{
+		DB: db,
+	}
+	adminAuditService := &models.AdminAuditService{
+		DB: db,
+	}
+
+	securityEventService := &models.SecurityEventService{
+		DB: db,
+	}
+
+	inviteService := &models.InviteService{
+		DB:    db,
+		Quota: &cfg.Registration.InviteQuota,
 	}
 
 	umw := controllers.UserMiddleware{
-		SessionService: sessionService,
+		SessionService:       sessionService,
+		APITokenService:      apiTokenService,
+		ImpersonationService: impersonationService,
+		AdminAuditService:    adminAuditService,
 	}
 
 	usersC := controllers.Users{
+		Tx:                   models.Transactor{DB: db},
 		UserService:          userService,
 		SessionService:       sessionService,
 		EmailService:         emailService,
 		PasswordResetService: pwResetService,
+		EmailChangeService:   emailChangeService,
+		AccountService:       accountService,
+		SignInLinkService:    signInLinkService,
+		APITokenService:      apiTokenService,
+		IdentityService:      identityService,
+		InviteService:        inviteService,
+		SecurityEventService: securityEventService,
+		NotificationService:  notificationService,
+		OIDCProviders:        oidcProviders,
+		InviteOnly:           cfg.Registration.InviteOnly,
 	}
 	usersC.Templates.New = views.Must(views.ParseFS(templates.FS, "sign-up.gohtml", "tailwind.gohtml"))
 	usersC.Templates.SignIn = views.Must(views.ParseFS(templates.FS, "sign-in.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ForgotPassword = views.Must(views.ParseFS(templates.FS, "forgot-pw.gohtml", "tailwind.gohtml"))
 	usersC.Templates.ResetPassword = views.Must(views.ParseFS(templates.FS, "reset-pw.gohtml", "tailwind.gohtml"))
+	usersC.Templates.CheckYourEmail = views.Must(views.ParseFS(templates.FS, "check-your-email.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Settings = views.Must(views.ParseFS(templates.FS, "settings.gohtml", "tailwind.gohtml"))
+	usersC.Templates.APITokens = views.Must(views.ParseFS(templates.FS, "api-tokens.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Invites = views.Must(views.ParseFS(templates.FS, "invites.gohtml", "tailwind.gohtml"))
+	usersC.Templates.SecurityEvents = views.Must(views.ParseFS(templates.FS, "security.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Notifications = views.Must(views.ParseFS(templates.FS, "notifications.gohtml", "tailwind.gohtml"))
+	usersC.Templates.Unsubscribe = views.Must(views.ParseFS(templates.FS, "unsubscribe.gohtml", "tailwind.gohtml"))
 
-	galleriesC := controllers.Galleries{
+	inboundEmailService := &models.InboundEmailService{
+		DB:             db,
 		GalleryService: galleryService,
+		Domain:         cfg.InboundEmail.Domain,
+	}
+
+	galleriesC := controllers.Galleries{
+		GalleryService:       galleryService,
+		SecurityEventService: securityEventService,
+		InboundEmailService:  inboundEmailService,
+		NotificationService:  notificationService,
+		ShareLinkService:     &models.ShareLinkService{DB: db},
 	}
 	galleriesC.Templates.New = views.Must(views.ParseFS(templates.FS, "galleries/new.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Edit = views.Must(views.ParseFS(templates.FS, "galleries/edit.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Index = views.Must(views.ParseFS(templates.FS, "galleries/index.gohtml", "tailwind.gohtml"))
 	galleriesC.Templates.Show = views.Must(views.ParseFS(templates.FS, "galleries/show.gohtml", "tailwind.gohtml"))
 
+	adminC := controllers.Admin{
+		UserService:          userService,
+		SessionService:       sessionService,
+		GalleryService:       galleryService,
+		PasswordResetService: pwResetService,
+		EmailService:         emailService,
+		ImpersonationService: impersonationService,
+		AdminAuditService:    adminAuditService,
+		SecurityEventService: securityEventService,
+		EmailOutboxService:   emailOutboxService,
+	}
+	adminC.Templates.Users = views.Must(views.ParseFS(templates.FS, "admin/users.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	adminC.Templates.Galleries = views.Must(views.ParseFS(templates.FS, "admin/galleries.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	adminC.Templates.AuditLog = views.Must(views.ParseFS(templates.FS, "admin/audit.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	adminC.Templates.SecurityEvents = views.Must(views.ParseFS(templates.FS, "admin/security.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+	adminC.Templates.Emails = views.Must(views.ParseFS(templates.FS, "admin/emails.gohtml", "admin/nav.gohtml", "tailwind.gohtml"))
+
 	r := chi.NewRouter()
+	r.Use(controllers.RequestID)
+	// before the access log, so it is logged with the trace ID
+	r.Use(tracing.Middleware)
+	r.Use(controllers.AccessLog)
+	r.Use(metrics.Middleware)
 	r.Use(csrfMiddleware)
 	r.Use(umw.SetUser)
 	r.Get("/", controllers.StaticHandler(views.Must(views.ParseFS(templates.FS, "home.gohtml", "tailwind.gohtml"))))
@@ -150,36 +316,259 @@ func main() {
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
 		r.Get("/", usersC.CurrentUser)
+		r.Post("/password", usersC.ProcessUpdatePassword)
+		r.Post("/email", usersC.ProcessUpdateEmail)
+		r.Get("/export", usersC.ExportData)
+		r.Post("/delete", usersC.ProcessDeleteAccount)
+		r.Post("/delete/cancel", usersC.ProcessCancelDeletion)
+		r.Get("/tokens", usersC.APITokens)
+		r.Post("/tokens", usersC.ProcessCreateAPIToken)
+		r.Post("/tokens/{id}/delete", usersC.ProcessDeleteAPIToken)
+		r.Get("/invites", usersC.Invites)
+		r.Post("/invites", usersC.ProcessCreateInvite)
+		r.Get("/security", usersC.SecurityEvents)
+		r.Get("/notifications", usersC.Notifications)
+		r.Post("/notifications", usersC.ProcessUpdateNotifications)
 	})
 
 	// processing
 	r.Post("/users", usersC.Create)
 	r.Post("/signin", usersC.ProcessSignIn)
+	r.Post("/signin/link", usersC.ProcessSignInLink)
+	r.Get("/signin/link", usersC.SignInWithLink)
 	r.Post("/signout", usersC.ProcessSignout)
 	r.Post("/forgot-pw", usersC.ProcessForgotPassword)
 	r.Post("/reset-pw", usersC.ProcessResetPassword)
+	r.Get("/confirm-email", usersC.ConfirmEmail)
+	r.Get("/unsubscribe", usersC.Unsubscribe)
+	r.Post("/unsubscribe", usersC.ProcessUnsubscribe)
+	r.Get("/oauth/{provider}/signin", usersC.OIDCSignIn)
+	r.Get("/oauth/{provider}/callback", usersC.OIDCCallback)
 
 	// if not done this way csrf token will throws error
+	// API tokens are only accepted for the gallery routes, where the scopes
+	// of the token are checked.
 	r.Route("/galleries", func(r chi.Router) {
-		r.Get("/{id}", galleriesC.Show)
+		r.Use(umw.SetTokenUser)
+		r.With(umw.RequireScope(models.ScopeGalleriesRead)).Get("/{id}", galleriesC.Show)
+		r.Get("/{id}/images/{filename}", galleriesC.Image)
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
-			r.Get("/", galleriesC.Index)
-			r.Get("/new", galleriesC.New)
-			r.Get("/{id}/edit", galleriesC.Edit)
-			r.Post("/", galleriesC.Create)
-			r.Post("/{id}", galleriesC.Update)
-			r.Post("/{id}/delete", galleriesC.Delete)
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireScope(models.ScopeGalleriesRead))
+				r.Get("/", galleriesC.Index)
+				r.Get("/new", galleriesC.New)
+				r.Get("/{id}/edit", galleriesC.Edit)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireScope(models.ScopeGalleriesWrite))
+				r.Post("/", galleriesC.Create)
+				r.Post("/{id}", galleriesC.Update)
+				r.Post("/{id}/delete", galleriesC.Delete)
+				r.Post("/{id}/inbound-address", galleriesC.ResetInboundAddress)
+				r.Post("/{id}/share-links", galleriesC.CreateShareLink)
+				r.Post("/{id}/share-links/{linkID}/delete", galleriesC.DeleteShareLink)
+				r.Post("/{id}/inbound-address/delete", galleriesC.DisableInboundAddress)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(umw.RequireScope(models.ScopeImagesWrite))
+				r.Post("/{id}/images", galleriesC.UploadImage)
+				r.Post("/{id}/images/{filename}/delete", galleriesC.DeleteImage)
+			})
+		})
+	})
+
+	r.Get("/share/{token}", galleriesC.Shared)
+
+	// raw MIME messages from the mail relay
+	if cfg.InboundEmail.Secret != "" {
+		inboundEmailC := controllers.InboundEmail{
+			InboundEmailService: inboundEmailService,
+			Secret:              cfg.InboundEmail.Secret,
+		}
+		r.Post("/inbound/email", inboundEmailC.Receive)
+	}
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RequireAdmin)
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/admin/users", http.StatusFound)
 		})
+		r.Get("/users", adminC.Users)
+		r.Post("/users/{id}/disable", adminC.DisableUser)
+		r.Post("/users/{id}/enable", adminC.EnableUser)
+		r.Post("/users/{id}/reset-password", adminC.ForcePasswordReset)
+		r.Post("/users/{id}/impersonate", adminC.Impersonate)
+		r.Get("/galleries", adminC.Galleries)
+		r.Post("/galleries/{id}/take-down", adminC.TakeDownGallery)
+		r.Post("/galleries/{id}/restore", adminC.RestoreGallery)
+		r.Get("/audit", adminC.AuditLog)
+		r.Get("/security", adminC.SecurityEvents)
+		r.Get("/emails", adminC.Emails)
+		r.Post("/emails/{id}/retry", adminC.RetryEmail)
 	})
+	r.Post("/impersonation/stop", adminC.StopImpersonation)
+
+	if cfg.Server.Dev {
+		emailPreviewsC := controllers.EmailPreviews{
+			EmailTemplates: emailService.Templates,
+		}
+		emailPreviewsC.Templates.Index = views.Must(views.ParseFS(templates.FS, "dev/emails.gohtml", "tailwind.gohtml"))
+		r.Get("/dev/emails", emailPreviewsC.Index)
+		r.Get("/dev/emails/{kind}", emailPreviewsC.Show)
+	}
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Page not found", http.StatusNotFound)
 	})
 
-	fmt.Printf("Starting the server on %s...\n", config.Server.Address)
-	err = http.ListenAndServe(config.Server.Address, r)
+	latestMigration, err := models.LatestMigration(migrations.FS, ".")
 	if err != nil {
-		panic(err)
+		fatal("reading migrations", err)
+	}
+	healthC := controllers.Health{
+		Checks: []controllers.HealthCheck{
+			{Name: "postgres", Check: db.PingContext},
+			{Name: "migrations", Check: func(ctx context.Context) error {
+				return models.CheckMigrations(ctx, db, latestMigration)
+			}},
+			{Name: "storage", Check: func(ctx context.Context) error {
+				return galleryService.Ping()
+			}},
+			{Name: "mail", Check: mailer.Ping},
+		},
+	}
+	// the orchestrator endpoints are served ahead of the router, so they
+	// bypass its CSRF and user middlewares
+	rootMux := http.NewServeMux()
+	rootMux.HandleFunc("/healthz", healthC.Healthz)
+	rootMux.HandleFunc("/readyz", healthC.Readyz)
+	rootMux.HandleFunc("/version", healthC.Version)
+	rootMux.Handle("/", r)
+
+	server := &http.Server{
+		Addr:              cfg.Server.Address,
+		Handler:           rootMux,
+		ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.Server.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
+	tlsEnabled := cfg.Server.TLS.CertFile != ""
+	if tlsEnabled {
+		certs, err := newCertReloader(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+		if err != nil {
+			fatal("loading TLS certificate", err)
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.GetCertificate,
+		}
+	}
+
+	// the admin listener serves internal endpoints like /metrics, and should
+	// not be reachable from the internet
+	var adminServer *http.Server
+	if cfg.Server.AdminAddress != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metrics.Handler())
+		adminMux.HandleFunc("/healthz", healthC.Healthz)
+		adminMux.HandleFunc("/readyz", healthC.Readyz)
+		adminMux.HandleFunc("/version", healthC.Version)
+		adminServer = &http.Server{
+			Addr:              cfg.Server.AdminAddress,
+			Handler:           adminMux,
+			ReadHeaderTimeout: time.Duration(cfg.Server.ReadHeaderTimeout),
+			ReadTimeout:       time.Duration(cfg.Server.ReadTimeout),
+			WriteTimeout:      time.Duration(cfg.Server.WriteTimeout),
+			IdleTimeout:       time.Duration(cfg.Server.IdleTimeout),
+			MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+		}
+	}
+
+	serverErr := make(chan error, 2)
+	if adminServer != nil {
+		go func() {
+			slog.Info("starting the admin server", "address", cfg.Server.AdminAddress)
+			serverErr <- adminServer.ListenAndServe()
+		}()
+	}
+	go func() {
+		slog.Info("starting the server", "address", cfg.Server.Address, "tls", tlsEnabled)
+		if tlsEnabled {
+			// the certificate comes from TLSConfig.GetCertificate
+			serverErr <- server.ListenAndServeTLS("", "")
+			return
+		}
+		serverErr <- server.ListenAndServe()
+	}()
+
+	var listenErr error
+	select {
+	case listenErr = <-serverErr:
+		slog.Error("server stopped", "err", listenErr)
+	case <-ctx.Done():
 	}
+	// a second signal kills the process right away
+	stop()
+
+	// stop accepting connections and wait for in-flight requests, including
+	// uploads, to finish
+	slog.Info("shutting down, waiting for requests to finish", "timeout", time.Duration(cfg.Server.ShutdownTimeout))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("shutting down the server", "err", err)
+	}
+	if adminServer != nil {
+		err = adminServer.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("shutting down the admin server", "err", err)
+		}
+	}
+
+	// the workers stop once ctx is cancelled and their current run is done.
+	// The database is closed by the deferred db.Close afterwards.
+	workers.Wait()
+	err = shutdownTracing(shutdownCtx)
+	if err != nil {
+		slog.Error("flushing traces", "err", err)
+	}
+	if listenErr != nil {
+		db.Close()
+		os.Exit(1)
+	}
+	slog.Info("shut down")
+}
+
+// fatal logs an error the app cannot start with and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// runEvery calls fn every interval in the background, and right away if now
+// is set, until ctx is cancelled. A run in progress is always finished, so
+// the ctx passed to fn is not cancelled with ctx.
+func runEvery(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, now bool, fn func(ctx context.Context)) {
+	wg.Add(1)
+	runCtx := context.WithoutCancel(ctx)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		if now {
+			fn(runCtx)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				fn(runCtx)
+			}
+		}
+	}()
 }
@@ -0,0 +1,135 @@
+// Package metrics collects the Prometheus metrics of the app, which are served
+// on the admin listener.
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/taherk/galleryapp/models"
+)
+
+const namespace = "galleryapp"
+
+const (
+	// ImageSourceWeb, ImageSourceAPI and ImageSourceEmail tell where an
+	// uploaded image came from.
+	ImageSourceWeb   = "web"
+	ImageSourceAPI   = "api"
+	ImageSourceEmail = "email"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to handle HTTP requests by method and route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	emailsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "emails_sent_total",
+		Help:      "Emails handed to the mail transport, by result.",
+	}, []string{"result"})
+
+	imageUploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_upload_bytes_total",
+		Help:      "Bytes of uploaded images, by source.",
+	}, []string{"source"})
+	imageUploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "image_upload_duration_seconds",
+		Help:      "Time to store the images of an upload, by source.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"source"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		emailsSent,
+		imageUploadBytes,
+		imageUploadDuration,
+	)
+	// export both results from the start, so rates work before the first
+	// failure
+	emailsSent.WithLabelValues("success")
+	emailsSent.WithLabelValues("failure")
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RegisterDB adds the connection pool stats of db.
+func RegisterDB(db *sql.DB, name string) error {
+	return registry.Register(collectors.NewDBStatsCollector(db, name))
+}
+
+// Middleware counts and times requests by their chi route pattern, e.g.
+// /galleries/{id}, so the number of series does not grow with the IDs. It has
+// to be used on the chi router, and requests that match no route are counted
+// as "unmatched".
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		// the pattern is only complete once the request was routed
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveImageUpload records an upload of images with size bytes in total,
+// which took d to store.
+func ObserveImageUpload(source string, size int64, d time.Duration) {
+	imageUploadBytes.WithLabelValues(source).Add(float64(size))
+	imageUploadDuration.WithLabelValues(source).Observe(d.Seconds())
+}
+
+// Mailer counts the emails sent by the wrapped mailer.
+type Mailer struct {
+	models.Mailer
+}
+
+func (m Mailer) Send(ctx context.Context, email models.Email) error {
+	err := m.Mailer.Send(ctx, email)
+	if err != nil {
+		emailsSent.WithLabelValues("failure").Inc()
+		return err
+	}
+	emailsSent.WithLabelValues("success").Inc()
+	return nil
+}
@@ -4,8 +4,8 @@ ALTER TABLE sessions ADD CONSTRAINT fk_users_sessions_id FOREIGN KEY (user_id) R
 
 -- +goose StatementEnd
 -- +goose Down
+-- +goose StatementBegin
 ALTER TABLE sessions
 DROP CONSTRAINT fk_users_sessions_id;
 
--- +goose StatementBegin
--- +goose StatementEnd
\ No newline at end of file
+-- +goose StatementEnd
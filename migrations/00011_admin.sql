@@ -0,0 +1,46 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+ADD COLUMN role TEXT NOT NULL DEFAULT 'user',
+ADD COLUMN disabled_at TIMESTAMPTZ;
+
+ALTER TABLE galleries
+ADD COLUMN taken_down_at TIMESTAMPTZ;
+
+CREATE TABLE
+  impersonations (
+    id SERIAL PRIMARY KEY,
+    admin_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    ended_at TIMESTAMPTZ
+  );
+
+CREATE TABLE
+  admin_audit_log (
+    id SERIAL PRIMARY KEY,
+    admin_id INT REFERENCES users (id) ON DELETE SET NULL,
+    admin_email TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_user_id INT,
+    target_gallery_id INT,
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+  );
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE admin_audit_log;
+
+DROP TABLE impersonations;
+
+ALTER TABLE galleries
+DROP COLUMN taken_down_at;
+
+ALTER TABLE users
+DROP COLUMN disabled_at,
+DROP COLUMN role;
+
+-- +goose StatementEnd
@@ -0,0 +1,40 @@
+-- +goose Up
+-- +goose StatementBegin
+-- user_id and actor_id have no foreign keys, so the history outlives deleted
+-- accounts and galleries.
+CREATE TABLE
+  security_events (
+    id SERIAL PRIMARY KEY,
+    event TEXT NOT NULL,
+    user_id INT,
+    actor_id INT,
+    actor_email TEXT NOT NULL DEFAULT '',
+    gallery_id INT,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    details TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+  );
+
+CREATE INDEX security_events_user_id_idx ON security_events (user_id, created_at);
+
+CREATE FUNCTION security_events_append_only () RETURNS TRIGGER AS $$
+BEGIN
+  RAISE EXCEPTION 'security_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER security_events_append_only BEFORE
+UPDATE
+OR DELETE ON security_events FOR EACH STATEMENT
+EXECUTE FUNCTION security_events_append_only ();
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE security_events;
+
+DROP FUNCTION security_events_append_only;
+
+-- +goose StatementEnd
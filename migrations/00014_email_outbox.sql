@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE
+  email_outbox (
+    id SERIAL PRIMARY KEY,
+    idempotency_key TEXT UNIQUE NOT NULL,
+    from_address TEXT NOT NULL DEFAULT '',
+    to_address TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    plaintext TEXT NOT NULL DEFAULT '',
+    html TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMPTZ
+  );
+
+CREATE INDEX email_outbox_due_idx ON email_outbox (status, next_attempt_at);
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE email_outbox;
+
+-- +goose StatementEnd
@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE email_outbox
+ADD COLUMN headers TEXT NOT NULL DEFAULT '{}';
+
+-- users without a row for an event get the default delivery
+CREATE TABLE
+  notification_preferences (
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    delivery TEXT NOT NULL,
+    PRIMARY KEY (user_id, event)
+  );
+
+-- notifications waiting for the next digest
+CREATE TABLE
+  notifications (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    message TEXT NOT NULL,
+    url TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    digested_at TIMESTAMPTZ
+  );
+
+CREATE INDEX notifications_pending_idx ON notifications (user_id) WHERE digested_at IS NULL;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE notifications;
+
+DROP TABLE notification_preferences;
+
+ALTER TABLE email_outbox
+DROP COLUMN headers;
+
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- 00002 already references users from sessions.user_id, the foreign key of
+-- 00003 is a second copy of it.
+ALTER TABLE sessions
+DROP CONSTRAINT fk_users_sessions_id;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions ADD CONSTRAINT fk_users_sessions_id FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+
+-- +goose StatementEnd
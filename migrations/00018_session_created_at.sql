@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- existing sessions count from now, so pruning doesn't sign everyone out
+ALTER TABLE sessions
+ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE sessions
+DROP COLUMN created_at;
+
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- digests go out a day after the last one, whenever the server was started
+ALTER TABLE users
+ADD COLUMN last_digest_at TIMESTAMPTZ;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+DROP COLUMN last_digest_at;
+
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- notifications queued before keys existed have none
+ALTER TABLE notifications
+ADD COLUMN idempotency_key TEXT UNIQUE;
+
+-- +goose StatementEnd
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE notifications
+DROP COLUMN idempotency_key;
+
+-- +goose StatementEnd
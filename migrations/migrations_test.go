@@ -0,0 +1,129 @@
+package migrations_test
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"testing"
+
+	"github.com/pressly/goose/v3"
+	"github.com/taherk/galleryapp/migrations"
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/models/pgtest"
+)
+
+// schema describes the tables, columns, constraints and indexes of the
+// database, one line each, to compare it before and after a migration.
+func schema(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT 'column ' || table_name || '.' || column_name || ' ' || data_type
+			|| ' nullable=' || is_nullable || ' default=' || coalesce(column_default, '')
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name <> 'goose_db_version'
+		UNION ALL
+		SELECT 'constraint ' || conrelid::regclass::text || '.' || conname || ' ' || pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE connamespace = 'public'::regnamespace AND conrelid::regclass::text <> 'goose_db_version'
+		UNION ALL
+		SELECT 'index ' || indexdef
+		FROM pg_indexes
+		WHERE schemaname = 'public' AND tablename <> 'goose_db_version'
+		ORDER BY 1;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var line string
+		err := rows.Scan(&line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestMigrationsUpDownUp(t *testing.T) {
+	db := pgtest.Empty(t)
+	provider, err := goose.NewProvider(goose.DialectPostgres, db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for _, source := range provider.ListSources() {
+		before := schema(t, db)
+		_, err := provider.UpByOne(ctx)
+		if err != nil {
+			t.Fatalf("up %s: %v", source.Path, err)
+		}
+		after := schema(t, db)
+
+		_, err = provider.Down(ctx)
+		if err != nil {
+			t.Fatalf("down %s: %v", source.Path, err)
+		}
+		if got := schema(t, db); !slices.Equal(got, before) {
+			t.Errorf("down %s does not undo up\nbefore up: %q\nafter down: %q", source.Path, before, got)
+		}
+
+		_, err = provider.UpByOne(ctx)
+		if err != nil {
+			t.Fatalf("up %s after down: %v", source.Path, err)
+		}
+		if got := schema(t, db); !slices.Equal(got, after) {
+			t.Errorf("up %s after down differs from the first up\nfirst: %q\nagain: %q", source.Path, after, got)
+		}
+	}
+
+	// all the way down and up again, with the rows goose keeps in between
+	_, err = provider.DownTo(ctx, 0)
+	if err != nil {
+		t.Fatalf("down to 0: %v", err)
+	}
+	_, err = provider.Up(ctx)
+	if err != nil {
+		t.Fatalf("up after down to 0: %v", err)
+	}
+
+	latest, err := models.LatestMigration(migrations.FS, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = models.CheckMigrations(ctx, db, latest)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrationsNoDuplicateConstraints(t *testing.T) {
+	db := pgtest.New(t)
+
+	rows, err := db.Query(`
+		SELECT conrelid::regclass::text, pg_get_constraintdef(oid), string_agg(conname, ', ')
+		FROM pg_constraint
+		WHERE connamespace = 'public'::regnamespace
+		GROUP BY 1, 2
+		HAVING count(*) > 1;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, def, names string
+		err := rows.Scan(&table, &def, &names)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Errorf("%s has the same constraint %s more than once: %s", table, def, names)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
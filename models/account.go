@@ -0,0 +1,501 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	DefaultDeletionGracePeriod = 14 * 24 * time.Hour
+)
+
+// AccountExport is everything we store about a user, in the format it is
+// handed out to them.
+type AccountExport struct {
+	ExportedAt time.Time              `json:"exported_at"`
+	Profile    AccountExportProfile   `json:"profile"`
+	Galleries  []AccountExportGallery `json:"galleries"`
+	Sessions   []AccountExportSession `json:"sessions"`
+	// APITokens only describe the tokens, their hashes are left out.
+	APITokens  []AccountExportAPIToken `json:"api_tokens"`
+	Identities []AccountExportIdentity `json:"identities"`
+	// Invites are the invites the user sent.
+	Invites []AccountExportInvite `json:"invites"`
+	// NotificationPreferences has the delivery of every event. Unsubscribing
+	// turns events off, so it shows here as well.
+	NotificationPreferences map[string]string            `json:"notification_preferences"`
+	Notifications           []AccountExportNotification  `json:"notifications"`
+	SecurityEvents          []AccountExportSecurityEvent `json:"security_events"`
+}
+
+type AccountExportProfile struct {
+	ID                  uint       `json:"id"`
+	Email               string     `json:"email"`
+	PendingEmail        string     `json:"pending_email,omitempty"`
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+}
+
+type AccountExportGallery struct {
+	ID         int                      `json:"id"`
+	Title      string                   `json:"title"`
+	Images     []AccountExportImage     `json:"images"`
+	ShareLinks []AccountExportShareLink `json:"share_links"`
+}
+
+type AccountExportImage struct {
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	// path of the original inside the archive. Only set when the originals are
+	// bundled with the export.
+	ArchivePath string `json:"archive_path,omitempty"`
+}
+
+type AccountExportSession struct {
+	ID int `json:"id"`
+}
+
+type AccountExportShareLink struct {
+	Name          string     `json:"name"`
+	CreatedAt     time.Time  `json:"created_at"`
+	FirstOpenedAt *time.Time `json:"first_opened_at,omitempty"`
+}
+
+type AccountExportAPIToken struct {
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// AccountExportIdentity is an account of an OIDC provider the user signs in
+// with.
+type AccountExportIdentity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+}
+
+type AccountExportInvite struct {
+	Email     string     `json:"email"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type AccountExportNotification struct {
+	Event      string     `json:"event"`
+	Message    string     `json:"message"`
+	URL        string     `json:"url,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	DigestedAt *time.Time `json:"digested_at,omitempty"`
+}
+
+type AccountExportSecurityEvent struct {
+	Event      string    `json:"event"`
+	ActorEmail string    `json:"actor_email,omitempty"`
+	GalleryID  *int      `json:"gallery_id,omitempty"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	RequestID  string    `json:"request_id"`
+	Details    string    `json:"details,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func newAccountExportShareLink(link ShareLink) AccountExportShareLink {
+	return AccountExportShareLink{
+		Name:          link.Name,
+		CreatedAt:     link.CreatedAt,
+		FirstOpenedAt: link.FirstOpenedAt,
+	}
+}
+
+func newAccountExportAPIToken(token APIToken) AccountExportAPIToken {
+	return AccountExportAPIToken{
+		Name:       token.Name,
+		Prefix:     token.Prefix,
+		Scopes:     token.Scopes,
+		ExpiresAt:  token.ExpiresAt,
+		LastUsedAt: token.LastUsedAt,
+		CreatedAt:  token.CreatedAt,
+	}
+}
+
+func newAccountExportInvite(invite Invite) AccountExportInvite {
+	return AccountExportInvite{
+		Email:     invite.Email,
+		ExpiresAt: invite.ExpiresAt,
+		UsedAt:    invite.UsedAt,
+		CreatedAt: invite.CreatedAt,
+	}
+}
+
+func newAccountExportSecurityEvent(event SecurityEvent) AccountExportSecurityEvent {
+	return AccountExportSecurityEvent{
+		Event:      event.Event,
+		ActorEmail: event.ActorEmail,
+		GalleryID:  event.GalleryID,
+		IP:         event.IP,
+		UserAgent:  event.UserAgent,
+		RequestID:  event.RequestID,
+		Details:    event.Details,
+		CreatedAt:  event.CreatedAt,
+	}
+}
+
+// AccountService handles operations that span everything a user owns, such as
+// exporting their data or deleting their account.
+type AccountService struct {
+	DB             *sql.DB
+	UserService    *UserService
+	GalleryService *GalleryService
+	SessionService *SessionService
+	// how long after a deletion request the account is actually deleted.
+	// Defaults to DefaultDeletionGracePeriod
+	GracePeriod time.Duration
+}
+
+func (service *AccountService) Export(ctx context.Context, userID int) (*AccountExport, error) {
+	user, err := service.UserService.ByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+
+	export := AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: AccountExportProfile{
+			ID:    user.ID,
+			Email: user.Email,
+		},
+		Galleries:      []AccountExportGallery{},
+		Sessions:       []AccountExportSession{},
+		APITokens:      []AccountExportAPIToken{},
+		Identities:     []AccountExportIdentity{},
+		Invites:        []AccountExportInvite{},
+		Notifications:  []AccountExportNotification{},
+		SecurityEvents: []AccountExportSecurityEvent{},
+	}
+
+	export.Profile.DeletionScheduledAt, err = service.ScheduledDeletion(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `SELECT new_email FROM email_changes WHERE user_id = $1;`, userID)
+	err = row.Scan(&export.Profile.PendingEmail)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+
+	galleries, err := service.GalleryService.ByUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+	for _, gallery := range galleries {
+		images, err := service.GalleryService.Images(ctx, gallery.ID)
+		if err != nil {
+			return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+		}
+		exportGallery := AccountExportGallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Images:     []AccountExportImage{},
+			ShareLinks: []AccountExportShareLink{},
+		}
+		for _, image := range images {
+			exportGallery.Images = append(exportGallery.Images, AccountExportImage{
+				Filename:   image.Filename,
+				Size:       image.Size,
+				ModifiedAt: image.ModifiedAt,
+			})
+		}
+		links, err := (&ShareLinkService{DB: service.DB}).ByGalleryID(ctx, gallery.ID)
+		if err != nil {
+			return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+		}
+		for _, link := range links {
+			exportGallery.ShareLinks = append(exportGallery.ShareLinks, newAccountExportShareLink(link))
+		}
+		export.Galleries = append(export.Galleries, exportGallery)
+	}
+
+	sessions, err := service.SessionService.ByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, AccountExportSession{
+			ID: session.ID,
+		})
+	}
+
+	tokens, err := (&APITokenService{DB: service.DB}).ByUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+	for _, token := range tokens {
+		export.APITokens = append(export.APITokens, newAccountExportAPIToken(token))
+	}
+
+	invites, err := (&InviteService{DB: service.DB}).ByInviterID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+	for _, invite := range invites {
+		export.Invites = append(export.Invites, newAccountExportInvite(invite))
+	}
+
+	export.NotificationPreferences, err = (&NotificationService{DB: service.DB}).Preferences(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+
+	err = service.exportRows(ctx, &export, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.AccountService.Export: %w", err)
+	}
+
+	return &export, nil
+}
+
+// exportRows adds the identities, notifications and security events of the
+// user to the export. The services of those only look them up one at a time
+// or a page at a time, so they are queried here.
+func (service *AccountService) exportRows(ctx context.Context, export *AccountExport, userID int) error {
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT provider, subject
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var identity AccountExportIdentity
+		err := rows.Scan(&identity.Provider, &identity.Subject)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		export.Identities = append(export.Identities, identity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT event, message, url, created_at, digested_at
+		FROM notifications
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var n AccountExportNotification
+		var digestedAt sql.NullTime
+		err := rows.Scan(&n.Event, &n.Message, &n.URL, &n.CreatedAt, &digestedAt)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		n.DigestedAt = nullTimePtr(digestedAt)
+		export.Notifications = append(export.Notifications, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT event, actor_email, gallery_id, ip, user_agent, request_id, details, created_at
+		FROM security_events
+		WHERE user_id = $1
+		ORDER BY id;`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event SecurityEvent
+		var galleryID sql.NullInt64
+		err := rows.Scan(&event.Event, &event.ActorEmail, &galleryID, &event.IP, &event.UserAgent,
+			&event.RequestID, &event.Details, &event.CreatedAt)
+		if err != nil {
+			return err
+		}
+		event.GalleryID = nullIntPtr(galleryID)
+		export.SecurityEvents = append(export.SecurityEvents, newAccountExportSecurityEvent(event))
+	}
+	return rows.Err()
+}
+
+// WriteArchive writes the export as a zip file containing account.json and the
+// original of every image in the user's galleries.
+func (service *AccountService) WriteArchive(ctx context.Context, w io.Writer, export *AccountExport) error {
+	zw := zip.NewWriter(w)
+
+	for i, gallery := range export.Galleries {
+		for j, image := range gallery.Images {
+			// stop copying originals once the client is gone
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("models.AccountService.WriteArchive: %w", err)
+			}
+			archivePath := path.Join("images", fmt.Sprintf("gallery-%d", gallery.ID), image.Filename)
+			err := service.addImage(zw, archivePath, gallery.ID, image.Filename)
+			if err != nil {
+				return fmt.Errorf("models.AccountService.WriteArchive: %w", err)
+			}
+			export.Galleries[i].Images[j].ArchivePath = archivePath
+		}
+	}
+
+	// account.json is written last so it can reference the archived originals.
+	f, err := zw.Create("account.json")
+	if err != nil {
+		return fmt.Errorf("models.AccountService.WriteArchive: %w", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(export)
+	if err != nil {
+		return fmt.Errorf("models.AccountService.WriteArchive: %w", err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return fmt.Errorf("models.AccountService.WriteArchive: %w", err)
+	}
+	return nil
+}
+
+func (service *AccountService) addImage(zw *zip.Writer, archivePath string, galleryID int, filename string) error {
+	src, err := os.Open(filepath.Join(service.GalleryService.galleryDir(galleryID), filename))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := zw.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// ScheduledDeletion returns when the user's account will be deleted, or nil if
+// no deletion has been requested.
+func (service *AccountService) ScheduledDeletion(ctx context.Context, userID int) (*time.Time, error) {
+	var deleteAfter sql.NullTime
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `SELECT delete_after FROM users WHERE id = $1;`, userID)
+	err := row.Scan(&deleteAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.AccountService.ScheduledDeletion: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.AccountService.ScheduledDeletion: %w", err)
+	}
+	if !deleteAfter.Valid {
+		return nil, nil
+	}
+	return &deleteAfter.Time, nil
+}
+
+// RequestDeletion schedules the account to be deleted once the grace period
+// has passed. Until then the user can cancel the deletion.
+func (service *AccountService) RequestDeletion(ctx context.Context, userID int) (time.Time, error) {
+	gracePeriod := service.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultDeletionGracePeriod
+	}
+	deleteAfter := time.Now().Add(gracePeriod)
+
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE users
+		SET delete_after = $2
+		WHERE id = $1;
+	`, userID, deleteAfter)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("models.AccountService.RequestDeletion: %w", err)
+	}
+
+	return deleteAfter, nil
+}
+
+func (service *AccountService) CancelDeletion(ctx context.Context, userID int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE users
+		SET delete_after = NULL
+		WHERE id = $1;
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("models.AccountService.CancelDeletion: %w", err)
+	}
+	return nil
+}
+
+// PurgeDeleted deletes every account whose grace period has passed. Database
+// rows are removed through ON DELETE CASCADE, and the stored images of each
+// gallery are removed afterwards. It returns the number of deleted accounts.
+func (service *AccountService) PurgeDeleted(ctx context.Context) (int, error) {
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT users.id, galleries.id
+		FROM users
+			LEFT JOIN galleries ON galleries.user_id = users.id
+		WHERE users.delete_after <= $1;`,
+		time.Now(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("models.AccountService.PurgeDeleted: %w", err)
+	}
+	defer rows.Close()
+
+	galleriesByUser := make(map[int][]int)
+	for rows.Next() {
+		var userID int
+		var galleryID sql.NullInt64
+		err := rows.Scan(&userID, &galleryID)
+		if err != nil {
+			return 0, fmt.Errorf("models.AccountService.PurgeDeleted: %w", err)
+		}
+		// users without galleries still need an entry so they get deleted
+		galleryIDs := galleriesByUser[userID]
+		if galleryID.Valid {
+			galleryIDs = append(galleryIDs, int(galleryID.Int64))
+		}
+		galleriesByUser[userID] = galleryIDs
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("models.AccountService.PurgeDeleted: %w", err)
+	}
+
+	purged := 0
+	for userID, galleryIDs := range galleriesByUser {
+		_, err := conn(ctx, service.DB).ExecContext(ctx, `DELETE FROM users WHERE id = $1;`, userID)
+		if err != nil {
+			return purged, fmt.Errorf("models.AccountService.PurgeDeleted: %w", err)
+		}
+		purged++
+
+		for _, galleryID := range galleryIDs {
+			err := service.GalleryService.DeleteImages(ctx, galleryID)
+			if err != nil {
+				return purged, fmt.Errorf("models.AccountService.PurgeDeleted: %w", err)
+			}
+		}
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMemoryAccountServiceArchive(t *testing.T) {
+	ctx := context.Background()
+	store := &MemoryStore{}
+	us := &MemoryUserService{Store: store, PasswordHasher: &BcryptHasher{Cost: bcrypt.MinCost}}
+	gs := &MemoryGalleryService{Store: store, ImagesDir: t.TempDir()}
+	accounts := &MemoryAccountService{
+		Store:          store,
+		UserService:    us,
+		GalleryService: gs,
+		SessionService: &MemorySessionService{Store: store},
+	}
+	user, err := us.Create(ctx, "alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := int(user.ID)
+
+	gallery, err := gs.Create(ctx, "Holidays", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gs.CreateImage(ctx, gallery.ID, "photo.png", strings.NewReader("png data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&MemoryShareLinkService{Store: store}).Create(ctx, gallery.ID, "Grandma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := (&MemoryAPITokenService{Store: store}).Create(ctx, userID, "backup", []string{ScopeGalleriesRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invite, err := (&MemoryInviteService{Store: store}).Create(ctx, user, "bob@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&MemoryIdentityService{Store: store}).User(ctx, "google", &OIDCClaims{Subject: "123", Email: user.Email, EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifications := &MemoryNotificationService{Store: store}
+	err = notifications.SetPreference(ctx, userID, NotificationImagesAdded, DeliveryOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = notifications.Notify(ctx, userID, NotificationShareLinkOpened, "share_link:1", "Holidays was opened", "The share link was opened.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&MemorySecurityEventService{Store: store}).Record(ctx, SecurityEvent{Event: SecurityEventSignIn, UserID: &userID, IP: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := accounts.Export(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	err = accounts.WriteArchive(ctx, &archive, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(contents)
+	}
+	imagePath := fmt.Sprintf("images/gallery-%d/photo.png", gallery.ID)
+	if files[imagePath] != "png data" {
+		t.Errorf("archive has %q at %s, want the original", files[imagePath], imagePath)
+	}
+
+	accountJSON := files["account.json"]
+	for _, secret := range []string{token.Token, token.TokenHash, invite.Token, invite.TokenHash, user.PasswordHash} {
+		if strings.Contains(accountJSON, secret) {
+			t.Errorf("account.json contains the secret %q:\n%s", secret, accountJSON)
+		}
+	}
+	var got AccountExport
+	err = json.Unmarshal([]byte(accountJSON), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Galleries) != 1 || len(got.Galleries[0].ShareLinks) != 1 || got.Galleries[0].ShareLinks[0].Name != "Grandma" {
+		t.Errorf("galleries = %+v, want Holidays with the share link for Grandma", got.Galleries)
+	}
+	if len(got.APITokens) != 1 || got.APITokens[0].Name != "backup" || got.APITokens[0].Prefix != token.Prefix {
+		t.Errorf("api tokens = %+v, want the backup token", got.APITokens)
+	}
+	if len(got.Identities) != 1 || got.Identities[0] != (AccountExportIdentity{Provider: "google", Subject: "123"}) {
+		t.Errorf("identities = %+v, want the google identity", got.Identities)
+	}
+	if len(got.Invites) != 1 || got.Invites[0].Email != "bob@example.com" {
+		t.Errorf("invites = %+v, want the invite of bob", got.Invites)
+	}
+	if got.NotificationPreferences[NotificationImagesAdded] != DeliveryOff || got.NotificationPreferences[NotificationShareLinkOpened] != DefaultDelivery {
+		t.Errorf("notification preferences = %v, want images_added off and the default for the rest", got.NotificationPreferences)
+	}
+	if len(got.Notifications) != 1 || got.Notifications[0].Event != NotificationShareLinkOpened {
+		t.Errorf("notifications = %+v, want the opened share link", got.Notifications)
+	}
+	if len(got.SecurityEvents) != 1 || got.SecurityEvents[0].Event != SecurityEventSignIn || got.SecurityEvents[0].IP != "192.0.2.1" {
+		t.Errorf("security events = %+v, want the sign in", got.SecurityEvents)
+	}
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	AdminActionDisableUser         = "disable_user"
+	AdminActionEnableUser          = "enable_user"
+	AdminActionForcePasswordReset  = "force_password_reset"
+	AdminActionStartImpersonation  = "start_impersonation"
+	AdminActionStopImpersonation   = "stop_impersonation"
+	AdminActionImpersonatedRequest = "impersonated_request"
+	AdminActionTakeDownGallery     = "take_down_gallery"
+	AdminActionRestoreGallery      = "restore_gallery"
+	AdminActionRetryEmail          = "retry_email"
+)
+
+// AdminAction is an entry of the admin audit log.
+type AdminAction struct {
+	ID              int
+	AdminID         *int
+	AdminEmail      string
+	Action          string
+	TargetUserID    *int
+	TargetGalleryID *int
+	Details         string
+	CreatedAt       time.Time
+}
+
+// AdminAuditService records everything admins do to other users' accounts
+// and galleries. Entries are never updated or deleted.
+type AdminAuditService struct {
+	DB *sql.DB
+}
+
+func (service *AdminAuditService) Record(ctx context.Context, admin *User, action string, targetUserID, targetGalleryID *int, details string) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		INSERT INTO admin_audit_log (admin_id, admin_email, action, target_user_id, target_gallery_id, details)
+		VALUES ($1, $2, $3, $4, $5, $6);`,
+		admin.ID, admin.Email, action, targetUserID, targetGalleryID, details,
+	)
+	if err != nil {
+		return fmt.Errorf("models.AdminAuditService.Record: %w", err)
+	}
+	return nil
+}
+
+// Recent returns the latest entries of the audit log, newest first.
+func (service *AdminAuditService) Recent(ctx context.Context, limit int) ([]AdminAction, error) {
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, admin_id, admin_email, action, target_user_id, target_gallery_id, details, created_at
+		FROM admin_audit_log
+		ORDER BY id DESC
+		LIMIT $1;`,
+		limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.AdminAuditService.Recent: %w", err)
+	}
+	defer rows.Close()
+
+	var actions []AdminAction
+	for rows.Next() {
+		var action AdminAction
+		var adminID, targetUserID, targetGalleryID sql.NullInt64
+		err := rows.Scan(&action.ID, &adminID, &action.AdminEmail, &action.Action,
+			&targetUserID, &targetGalleryID, &action.Details, &action.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.AdminAuditService.Recent: %w", err)
+		}
+		action.AdminID = nullIntPtr(adminID)
+		action.TargetUserID = nullIntPtr(targetUserID)
+		action.TargetGalleryID = nullIntPtr(targetGalleryID)
+		actions = append(actions, action)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.AdminAuditService.Recent: %w", err)
+	}
+
+	return actions, nil
+}
+
+// Impersonation lets an admin act as another user without signing that user
+// out, since a user only ever has one session.
+type Impersonation struct {
+	ID      int
+	AdminID int
+	UserID  int
+	// token is only set when an Impersonation is being started
+	Token     string
+	TokenHash string
+	StartedAt time.Time
+}
+
+type ImpersonationService struct {
+	DB *sql.DB
+}
+
+func (service *ImpersonationService) Start(ctx context.Context, adminID int, userID int) (*Impersonation, error) {
+	token, err := rand.String(MinSessionTokenBytes)
+	if err != nil {
+		return nil, fmt.Errorf("models.ImpersonationService.Start: %w", err)
+	}
+
+	impersonation := Impersonation{
+		AdminID:   adminID,
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+	}
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		INSERT INTO impersonations (admin_id, user_id, token_hash)
+		VALUES ($1, $2, $3)
+		RETURNING id, started_at;`,
+		impersonation.AdminID, impersonation.UserID, impersonation.TokenHash,
+	)
+	err = row.Scan(&impersonation.ID, &impersonation.StartedAt)
+	if err != nil {
+		return nil, fmt.Errorf("models.ImpersonationService.Start: %w", err)
+	}
+
+	return &impersonation, nil
+}
+
+// User returns the user the admin is impersonating with the token. Only the
+// admin that started the impersonation can use the token.
+func (service *ImpersonationService) User(ctx context.Context, adminID int, token string) (*User, error) {
+	var user User
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT users.id, users.email, users.password_hash, users.role
+		FROM impersonations
+			JOIN users ON users.id = impersonations.user_id
+		WHERE impersonations.token_hash = $1
+			AND impersonations.admin_id = $2
+			AND impersonations.ended_at IS NULL;`,
+		service.hash(token), adminID,
+	)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.ImpersonationService.User: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.ImpersonationService.User: %w", err)
+	}
+
+	return &user, nil
+}
+
+func (service *ImpersonationService) Stop(ctx context.Context, token string) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE impersonations
+		SET ended_at = NOW()
+		WHERE token_hash = $1 AND ended_at IS NULL;
+	`, service.hash(token))
+	if err != nil {
+		return fmt.Errorf("models.ImpersonationService.Stop: %w", err)
+	}
+	return nil
+}
+
+func (service *ImpersonationService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	i := int(n.Int64)
+	return &i
+}
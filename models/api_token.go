@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	ScopeGalleriesRead  = "galleries:read"
+	ScopeGalleriesWrite = "galleries:write"
+	ScopeImagesWrite    = "images:write"
+
+	// every API token starts with this, so leaked tokens are easy to spot
+	APITokenPrefix = "gal_"
+	// number of characters of a token, including APITokenPrefix, that are
+	// stored in plain text so users can tell their tokens apart.
+	apiTokenVisibleChars = 12
+)
+
+// Scopes lists every scope an API token can be granted.
+var Scopes = []string{ScopeGalleriesRead, ScopeGalleriesWrite, ScopeImagesWrite}
+
+type APIToken struct {
+	ID     int
+	UserID int
+	Name   string
+	// Prefix is the start of the token, which is safe to display.
+	Prefix string
+	// token is only set when an APIToken is being created
+	Token      string
+	TokenHash  string
+	Scopes     []string
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+func (token *APIToken) HasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (token *APIToken) Expired() bool {
+	return token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt)
+}
+
+type APITokenService struct {
+	DB *sql.DB
+	// how many bytes to use when generating each token. If this value is
+	// not set or is less than the MinSessionTokenBytes const it will be ignored and
+	// MinSessionTokenBytes will be used.
+	BytesPerToken int
+}
+
+// Create issues a new API token for the user. expiresAt can be nil for tokens
+// that never expire.
+func (service *APITokenService) Create(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*APIToken, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, fmt.Errorf("models.APITokenService.Create: invalid scope %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("models.APITokenService.Create: no scopes")
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinSessionTokenBytes {
+		bytesPerToken = MinSessionTokenBytes
+	}
+	secret, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.APITokenService.Create: %w", err)
+	}
+	token := APITokenPrefix + secret
+
+	apiToken := APIToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    token[:apiTokenVisibleChars],
+		Token:     token,
+		TokenHash: service.hash(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at;`,
+		apiToken.UserID, apiToken.Name, apiToken.Prefix, apiToken.TokenHash,
+		strings.Join(apiToken.Scopes, " "), apiToken.ExpiresAt,
+	)
+	err = row.Scan(&apiToken.ID, &apiToken.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("models.APITokenService.Create: %w", err)
+	}
+
+	return &apiToken, nil
+}
+
+func (service *APITokenService) ByUserID(ctx context.Context, userID int) ([]APIToken, error) {
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, name, prefix, scopes, expires_at, last_used_at, created_at
+		FROM api_tokens
+		WHERE user_id = $1
+		ORDER BY created_at;`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.APITokenService.ByUserID: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token := APIToken{
+			UserID: userID,
+		}
+		var scopes string
+		var expiresAt, lastUsedAt sql.NullTime
+		err := rows.Scan(&token.ID, &token.Name, &token.Prefix, &scopes, &expiresAt, &lastUsedAt, &token.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.APITokenService.ByUserID: %w", err)
+		}
+		token.Scopes = strings.Fields(scopes)
+		token.ExpiresAt = nullTimePtr(expiresAt)
+		token.LastUsedAt = nullTimePtr(lastUsedAt)
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.APITokenService.ByUserID: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// User returns the owner of the token and records that the token was used.
+// Expired tokens are treated as if they did not exist.
+func (service *APITokenService) User(ctx context.Context, token string) (*User, *APIToken, error) {
+	var user User
+	var apiToken APIToken
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullTime
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT api_tokens.id,
+			api_tokens.name,
+			api_tokens.prefix,
+			api_tokens.scopes,
+			api_tokens.expires_at,
+			api_tokens.last_used_at,
+			api_tokens.created_at,
+			users.id,
+			users.email,
+			users.password_hash,
+			users.role
+		FROM api_tokens
+			JOIN users ON users.id = api_tokens.user_id
+		WHERE api_tokens.token_hash = $1 AND users.disabled_at IS NULL;`,
+		service.hash(token),
+	)
+	err := row.Scan(&apiToken.ID, &apiToken.Name, &apiToken.Prefix, &scopes, &expiresAt, &lastUsedAt,
+		&apiToken.CreatedAt, &user.ID, &user.Email, &user.PasswordHash, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("models.APITokenService.User: %w", ErrNotFound)
+		}
+		return nil, nil, fmt.Errorf("models.APITokenService.User: %w", err)
+	}
+	apiToken.UserID = int(user.ID)
+	apiToken.Scopes = strings.Fields(scopes)
+	apiToken.ExpiresAt = nullTimePtr(expiresAt)
+	apiToken.LastUsedAt = nullTimePtr(lastUsedAt)
+
+	if apiToken.Expired() {
+		return nil, nil, fmt.Errorf("models.APITokenService.User: %w", ErrTokenExpired)
+	}
+
+	now := time.Now()
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `UPDATE api_tokens SET last_used_at = $2 WHERE id = $1;`, apiToken.ID, now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("models.APITokenService.User: %w", err)
+	}
+	apiToken.LastUsedAt = &now
+
+	return &user, &apiToken, nil
+}
+
+// Delete revokes the token. Tokens can only be deleted by the user they
+// belong to.
+func (service *APITokenService) Delete(ctx context.Context, userID int, id int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM api_tokens
+		WHERE id = $1 AND user_id = $2;
+	`, id, userID)
+	if err != nil {
+		return fmt.Errorf("models.APITokenService.Delete: %w", err)
+	}
+	return nil
+}
+
+func (service *APITokenService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -1,9 +1,10 @@
 package models
 
 import (
+	"context"
 	"fmt"
 
-	"github.com/go-mail/mail"
+	"github.com/taherk/galleryapp/emails"
 )
 
 const (
@@ -16,80 +17,158 @@ type Email struct {
 	Subject   string
 	Plaintext string
 	HTML      string
+	// Headers are added to the standard headers, e.g. List-Unsubscribe.
+	Headers map[string]string
 }
 
-type SMTPConfig struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-}
-
-func NewEmailService(config SMTPConfig) (*EmailService, error) {
+func NewEmailService(mailer Mailer) (*EmailService, error) {
+	templates, err := ParseEmailTemplates(emails.FS)
+	if err != nil {
+		return nil, fmt.Errorf("models.NewEmailService: %w", err)
+	}
 	es := EmailService{
-		dialer: mail.NewDialer(config.Host, config.Port, config.Username, config.Password),
+		Templates: templates,
+		Mailer:    mailer,
 	}
 	return &es, nil
 }
 
 type EmailService struct {
 	DefaultSender string
-
-	dialer *mail.Dialer
+	Templates     *EmailTemplates
+	// Mailer delivers the emails.
+	Mailer Mailer
+	// Outbox stores the emails until they are delivered. Without an outbox
+	// emails are sent right away.
+	Outbox *EmailOutboxService
 }
 
-func (es *EmailService) Send(email Email) error {
-	msg := mail.NewMessage()
-	msg.SetHeader("To", email.To)
+func (es *EmailService) Send(ctx context.Context, email Email) error {
 	// set the from to a default value if it is not set in the email
-	es.setFrom(msg, email)
-	msg.SetHeader("Subject", email.Subject)
-	switch {
-	case email.Plaintext != "" && email.HTML != "":
-		msg.SetBody("text/plain", email.Plaintext)
-		msg.AddAlternative("text/html", email.HTML)
-	case email.Plaintext != "":
-		msg.SetBody("text/plain", email.Plaintext)
-	case email.HTML != "":
-		msg.SetBody("text/html", email.HTML)
+	email.From = es.from(email)
+
+	err := es.Mailer.Send(ctx, email)
+	if err != nil {
+		return fmt.Errorf("models.email.send: %w", err)
 	}
 
-	msg.SetHeader("text/plain", email.Plaintext)
-	msg.SetHeader("text/html", email.HTML)
+	return nil
+}
 
-	err := es.dialer.DialAndSend(msg)
+func (es *EmailService) ForgotPassword(ctx context.Context, key string, to string, resetURL string) error {
+	err := es.queueTemplate(ctx, key, to, EmailKindForgotPassword, ForgotPasswordEmail{
+		ResetURL: resetURL,
+	})
 	if err != nil {
-		return fmt.Errorf("models.email.send: %w", err)
+		return fmt.Errorf("models.email.ForgotPassword: %w", err)
 	}
 
 	return nil
 }
 
-func (es *EmailService) ForgotPassword(to string, resetURL string) error {
+func (es *EmailService) ConfirmEmailChange(ctx context.Context, key string, to string, confirmURL string) error {
+	err := es.queueTemplate(ctx, key, to, EmailKindConfirmEmailChange, ConfirmEmailChangeEmail{
+		ConfirmURL: confirmURL,
+	})
+	if err != nil {
+		return fmt.Errorf("models.email.ConfirmEmailChange: %w", err)
+	}
 
-	email := Email{
-		Subject:   "Reset your password",
-		To:        to,
-		Plaintext: "To reset your password, please visit the following link: " + resetURL,
-		HTML:      `<p>To reset your password, please visit the following link: <a href="` + resetURL + `">` + resetURL + `</a></p>`,
+	return nil
+}
+
+// EmailChanged notifies the previous address of an account that the email was
+// changed, so the owner finds out if it was not them.
+func (es *EmailService) EmailChanged(ctx context.Context, key string, to string, newEmail string) error {
+	err := es.queueTemplate(ctx, key, to, EmailKindEmailChanged, EmailChangedEmail{
+		NewEmail: newEmail,
+	})
+	if err != nil {
+		return fmt.Errorf("models.email.EmailChanged: %w", err)
 	}
-	err := es.Send(email)
+
+	return nil
+}
+
+func (es *EmailService) SignInLink(ctx context.Context, key string, to string, signInURL string) error {
+	err := es.queueTemplate(ctx, key, to, EmailKindSignInLink, SignInLinkEmail{
+		SignInURL: signInURL,
+	})
 	if err != nil {
-		return fmt.Errorf("models.email.ForgotPassword: %w", err)
+		return fmt.Errorf("models.email.SignInLink: %w", err)
+	}
+
+	return nil
+}
+
+func (es *EmailService) Invite(ctx context.Context, key string, to string, inviterEmail string, signUpURL string) error {
+	err := es.queueTemplate(ctx, key, to, EmailKindInvite, InviteEmail{
+		InviterEmail: inviterEmail,
+		SignUpURL:    signUpURL,
+	})
+	if err != nil {
+		return fmt.Errorf("models.email.Invite: %w", err)
+	}
+
+	return nil
+}
+
+// Notification emails the user about a single event. unsubscribeURL is also
+// sent as a one-click List-Unsubscribe header.
+func (es *EmailService) Notification(ctx context.Context, key string, to string, data NotificationEmail) error {
+	err := es.queueTemplateWithHeaders(ctx, key, to, EmailKindNotification, data, unsubscribeHeaders(data.UnsubscribeURL))
+	if err != nil {
+		return fmt.Errorf("models.email.Notification: %w", err)
+	}
+
+	return nil
+}
+
+func (es *EmailService) Digest(ctx context.Context, key string, to string, data DigestEmail) error {
+	err := es.queueTemplateWithHeaders(ctx, key, to, EmailKindDigest, data, unsubscribeHeaders(data.UnsubscribeURL))
+	if err != nil {
+		return fmt.Errorf("models.email.Digest: %w", err)
 	}
 
 	return nil
 }
 
-func (es *EmailService) setFrom(msg *mail.Message, email Email) {
-	var from string
+// queueTemplate renders the email and adds it to the outbox, in the
+// transaction of ctx if there is one. key has to be unique for every email,
+// e.g. the hash of the token the email is about.
+func (es *EmailService) queueTemplate(ctx context.Context, key string, to string, kind string, data interface{}) error {
+	return es.queueTemplateWithHeaders(ctx, key, to, kind, data, nil)
+}
+
+func (es *EmailService) queueTemplateWithHeaders(ctx context.Context, key string, to string, kind string, data interface{}, headers map[string]string) error {
+	email, err := es.Templates.Render(kind, data)
+	if err != nil {
+		return err
+	}
+	email.To = to
+	email.Headers = headers
+	if es.Outbox == nil {
+		return es.Send(ctx, email)
+	}
+	return es.Outbox.Queue(ctx, kind+":"+key, email)
+}
+
+// unsubscribeHeaders allow mail clients to unsubscribe with a single POST to
+// the URL, as described in RFC 8058.
+func unsubscribeHeaders(unsubscribeURL string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeURL + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+func (es *EmailService) from(email Email) string {
 	switch {
 	case email.From != "":
-		from = email.From
+		return email.From
 	case es.DefaultSender != "":
-		from = es.DefaultSender
+		return es.DefaultSender
 	default:
-		from = DefaultSender
+		return DefaultSender
 	}
-	msg.SetHeader("From", from)
 }
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+// EmailChange is a pending change of a user's email address. The change is only
+// applied once the token sent to the new address has been consumed.
+type EmailChange struct {
+	ID       int
+	UserID   int
+	NewEmail string
+	// token is only set when an EmailChange is being created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+type EmailChangeService struct {
+	DB *sql.DB
+	// how many bytes to use when generating each email change token. If this value is
+	// not set or is less than the MinSessionTokenBytes const it will be ignored and
+	// MinSessionTokenBytes will be used.
+	BytesPerToken int
+	// email change expiration duration. Defaults to DefaultEmailChangeDuration
+	Duration time.Duration
+}
+
+// Create stores a pending email change for the user. A user can only have one
+// pending change at a time, so requesting a new one replaces the previous token.
+// notify is called in the same transaction, e.g. to queue the confirmation
+// email. It can be nil.
+func (service *EmailChangeService) Create(ctx context.Context, userID int, newEmail string, notify func(ctx context.Context, emailChange *EmailChange) error) (*EmailChange, error) {
+	newEmail = strings.ToLower(newEmail)
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinSessionTokenBytes {
+		bytesPerToken = MinSessionTokenBytes
+	}
+
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.EmailChangeService.Create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+
+	emailChange := EmailChange{
+		UserID:    userID,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	err = WithTx(ctx, service.DB, func(ctx context.Context) error {
+		row := conn(ctx, service.DB).QueryRowContext(ctx, `
+			INSERT INTO email_changes (user_id, new_email, token_hash, expires_at)
+			VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO
+			UPDATE
+			SET new_email = $2, token_hash = $3, expires_at = $4
+			RETURNING id;`,
+			emailChange.UserID, emailChange.NewEmail, emailChange.TokenHash, emailChange.ExpiresAt,
+		)
+		err := row.Scan(&emailChange.ID)
+		if err != nil || notify == nil {
+			return err
+		}
+		return notify(ctx, &emailChange)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.EmailChangeService.Create: %w", err)
+	}
+
+	return &emailChange, nil
+}
+
+// Consume looks up the pending change for the token and deletes it, so every
+// token can only be used once. The caller is responsible for applying the change.
+func (service *EmailChangeService) Consume(ctx context.Context, token string) (*EmailChange, error) {
+	emailChange := EmailChange{
+		TokenHash: service.hash(token),
+	}
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT id, user_id, new_email, expires_at
+		FROM email_changes
+		WHERE token_hash = $1;`,
+		emailChange.TokenHash,
+	)
+	err := row.Scan(&emailChange.ID, &emailChange.UserID, &emailChange.NewEmail, &emailChange.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.EmailChangeService.Consume: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.EmailChangeService.Consume: %w", err)
+	}
+
+	err = service.delete(ctx, emailChange.ID)
+	if err != nil {
+		return nil, fmt.Errorf("models.EmailChangeService.Consume: %w", err)
+	}
+
+	if time.Now().After(emailChange.ExpiresAt) {
+		return nil, fmt.Errorf("models.EmailChangeService.Consume: %w", ErrTokenExpired)
+	}
+
+	return &emailChange, nil
+}
+
+func (service *EmailChangeService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (service *EmailChangeService) delete(ctx context.Context, id int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+	DELETE FROM email_changes
+	WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("models.EmailChangeService.delete: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	OutboxStatusPending = "pending"
+	OutboxStatusSent    = "sent"
+	// messages that failed MaxAttempts times are dead and only delivered
+	// again when an admin retries them.
+	OutboxStatusDead = "dead"
+
+	DefaultOutboxMaxAttempts = 8
+	DefaultOutboxBackoff     = 30 * time.Second
+	// OutboxRetention is how long sent and dead messages are kept. It is
+	// longer than any token in an email is valid, so dead messages can be
+	// retried until their links expire anyway.
+	OutboxRetention = 7 * 24 * time.Hour
+	// the longest wait between two attempts
+	maxOutboxBackoff = 6 * time.Hour
+)
+
+// OutboxMessage is an Email waiting in, or delivered from, the outbox.
+type OutboxMessage struct {
+	ID int
+	// IdempotencyKey identifies the message, so queuing it twice only delivers
+	// it once.
+	IdempotencyKey string
+	Email          Email
+	Status         string
+	Attempts       int
+	LastError      string
+	NextAttemptAt  time.Time
+	CreatedAt      time.Time
+	SentAt         *time.Time
+}
+
+// EmailOutboxService stores outgoing emails so they are delivered even if the
+// mail server is down when they are sent. Emails are queued in the
+// transaction of the change that caused them and delivered by Deliver.
+type EmailOutboxService struct {
+	DB *sql.DB
+	// how often delivery is attempted before a message is dead. Defaults to
+	// DefaultOutboxMaxAttempts
+	MaxAttempts int
+	// wait after the first failed attempt, doubled after every further
+	// failure. Defaults to DefaultOutboxBackoff
+	Backoff time.Duration
+}
+
+// Queue adds the email to the outbox, in the transaction of ctx if there is
+// one. Queuing a key that is already in the outbox does nothing.
+func (service *EmailOutboxService) Queue(ctx context.Context, key string, email Email) error {
+	headers, err := json.Marshal(email.Headers)
+	if err != nil {
+		return fmt.Errorf("models.EmailOutboxService.Queue: %w", err)
+	}
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
+		INSERT INTO email_outbox (idempotency_key, from_address, to_address, subject, plaintext, html, headers)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (idempotency_key) DO NOTHING;`,
+		key, email.From, email.To, email.Subject, email.Plaintext, email.HTML, string(headers),
+	)
+	if err != nil {
+		return fmt.Errorf("models.EmailOutboxService.Queue: %w", err)
+	}
+	return nil
+}
+
+// Deliver sends up to limit messages that are due and returns how many were
+// sent. Messages are claimed before they are sent, by moving their next
+// attempt OutboxLease into the future, so several workers can run at the same
+// time without sending a message twice. No transaction is open while the mail
+// server is talked to, and the result of every message is recorded on its
+// own, so one failure doesn't send the others again.
+func (service *EmailOutboxService) Deliver(ctx context.Context, send func(context.Context, Email) error, limit int) (sent int, err error) {
+	ctx, span := startQuerySpan(ctx, "EmailOutboxService.Deliver")
+	defer endSpan(span, &err)
+
+	messages, err := service.claim(ctx, limit)
+	if err != nil {
+		return 0, fmt.Errorf("models.EmailOutboxService.Deliver: %w", err)
+	}
+
+	for _, msg := range messages {
+		sendErr := send(ctx, msg.Email)
+		if sendErr == nil {
+			// the bodies hold tokens, e.g. of password resets, which are
+			// only stored hashed everywhere else
+			_, err = service.DB.ExecContext(ctx, `
+				UPDATE email_outbox
+				SET status = $2, last_error = '', sent_at = NOW(), plaintext = '', html = ''
+				WHERE id = $1;`,
+				msg.ID, OutboxStatusSent,
+			)
+			if err != nil {
+				return sent, fmt.Errorf("models.EmailOutboxService.Deliver: %w", err)
+			}
+			sent++
+			continue
+		}
+
+		status := OutboxStatusPending
+		if msg.Attempts >= service.maxAttempts() {
+			status = OutboxStatusDead
+		}
+		_, err = service.DB.ExecContext(ctx, `
+			UPDATE email_outbox
+			SET status = $2, last_error = $3, next_attempt_at = $4
+			WHERE id = $1;`,
+			msg.ID, status, sendErr.Error(), time.Now().Add(service.backoff(msg.Attempts)),
+		)
+		if err != nil {
+			return sent, fmt.Errorf("models.EmailOutboxService.Deliver: %w", err)
+		}
+	}
+	return sent, nil
+}
+
+// OutboxLease is how long a claimed message is left to the worker that
+// claimed it. If the worker dies while sending, the message is due again
+// afterwards. It has to be longer than sending a message takes.
+const OutboxLease = 5 * time.Minute
+
+// claim leases up to limit due messages and counts the attempt. Attempts are
+// counted up front, so a message that crashes the worker still ends up dead.
+func (service *EmailOutboxService) claim(ctx context.Context, limit int) ([]OutboxMessage, error) {
+	rows, err := service.DB.QueryContext(ctx, `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = NOW() + $3 * INTERVAL '1 second'
+		WHERE id IN (
+			SELECT id
+			FROM email_outbox
+			WHERE status = $1 AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, from_address, to_address, subject, plaintext, html, headers, attempts;`,
+		OutboxStatusPending, limit, OutboxLease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var headers string
+		err := rows.Scan(&msg.ID, &msg.Email.From, &msg.Email.To, &msg.Email.Subject,
+			&msg.Email.Plaintext, &msg.Email.HTML, &headers, &msg.Attempts)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(headers), &msg.Email.Headers)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// Purge deletes the messages that were sent before cutoff, and the dead
+// messages queued before it, and returns how many were deleted.
+func (service *EmailOutboxService) Purge(ctx context.Context, cutoff time.Time) (_ int64, err error) {
+	ctx, span := startQuerySpan(ctx, "EmailOutboxService.Purge")
+	defer endSpan(span, &err)
+
+	result, err := conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM email_outbox
+		WHERE (status = $1 AND sent_at < $3) OR (status = $2 AND created_at < $3);`,
+		OutboxStatusSent, OutboxStatusDead, cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("models.EmailOutboxService.Purge: %w", err)
+	}
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("models.EmailOutboxService.Purge: %w", err)
+	}
+	return purged, nil
+}
+
+// Messages returns the latest messages with the status, or of any status if
+// it is empty, newest first.
+func (service *EmailOutboxService) Messages(ctx context.Context, status string, limit int) ([]OutboxMessage, error) {
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, idempotency_key, from_address, to_address, subject, plaintext, html,
+			status, attempts, last_error, next_attempt_at, created_at, sent_at
+		FROM email_outbox
+		WHERE $1 = '' OR status = $1
+		ORDER BY id DESC
+		LIMIT $2;`,
+		status, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.EmailOutboxService.Messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var sentAt sql.NullTime
+		err := rows.Scan(&msg.ID, &msg.IdempotencyKey, &msg.Email.From, &msg.Email.To, &msg.Email.Subject,
+			&msg.Email.Plaintext, &msg.Email.HTML, &msg.Status, &msg.Attempts, &msg.LastError,
+			&msg.NextAttemptAt, &msg.CreatedAt, &sentAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.EmailOutboxService.Messages: %w", err)
+		}
+		msg.SentAt = nullTimePtr(sentAt)
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.EmailOutboxService.Messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// Retry makes a message that has not been sent due right away, with a fresh
+// set of attempts.
+func (service *EmailOutboxService) Retry(ctx context.Context, id int) error {
+	var retriedID int
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		UPDATE email_outbox
+		SET status = $2, attempts = 0, next_attempt_at = NOW()
+		WHERE id = $1 AND status <> $3
+		RETURNING id;`,
+		id, OutboxStatusPending, OutboxStatusSent,
+	)
+	err := row.Scan(&retriedID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("models.EmailOutboxService.Retry: %w", ErrNotFound)
+		}
+		return fmt.Errorf("models.EmailOutboxService.Retry: %w", err)
+	}
+	return nil
+}
+
+func (service *EmailOutboxService) maxAttempts() int {
+	if service.MaxAttempts <= 0 {
+		return DefaultOutboxMaxAttempts
+	}
+	return service.MaxAttempts
+}
+
+// backoff returns how long to wait after the given number of failed attempts.
+func (service *EmailOutboxService) backoff(attempts int) time.Duration {
+	backoff := service.Backoff
+	if backoff <= 0 {
+		backoff = DefaultOutboxBackoff
+	}
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= maxOutboxBackoff {
+			return maxOutboxBackoff
+		}
+	}
+	return backoff
+}
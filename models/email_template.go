@@ -0,0 +1,133 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	texttemplate "text/template"
+)
+
+// The kinds of transactional emails. Each kind has a template pair in the
+// emails package and a data struct below.
+const (
+	EmailKindForgotPassword     = "forgot-password"
+	EmailKindConfirmEmailChange = "confirm-email-change"
+	EmailKindEmailChanged       = "email-changed"
+	EmailKindSignInLink         = "sign-in-link"
+	EmailKindInvite             = "invite"
+	EmailKindNotification       = "notification"
+	EmailKindDigest             = "digest"
+)
+
+// EmailKinds lists every kind of email, e.g. for previews.
+var EmailKinds = []string{
+	EmailKindForgotPassword,
+	EmailKindConfirmEmailChange,
+	EmailKindEmailChanged,
+	EmailKindSignInLink,
+	EmailKindInvite,
+	EmailKindNotification,
+	EmailKindDigest,
+}
+
+type ForgotPasswordEmail struct {
+	ResetURL string
+}
+
+type ConfirmEmailChangeEmail struct {
+	ConfirmURL string
+}
+
+type EmailChangedEmail struct {
+	NewEmail string
+}
+
+type SignInLinkEmail struct {
+	SignInURL string
+}
+
+type InviteEmail struct {
+	InviterEmail string
+	SignUpURL    string
+}
+
+type NotificationEmail struct {
+	Subject        string
+	Message        string
+	URL            string
+	UnsubscribeURL string
+	PreferencesURL string
+}
+
+type DigestEmail struct {
+	Items          []Notification
+	UnsubscribeURL string
+	PreferencesURL string
+}
+
+// EmailTemplates renders the HTML and plain text versions of every kind of
+// email.
+type EmailTemplates struct {
+	html map[string]*htmltemplate.Template
+	text map[string]*texttemplate.Template
+}
+
+// ParseEmailTemplates parses <kind>.gohtml and <kind>.txt of every email kind
+// together with layout.gohtml and layout.txt.
+func ParseEmailTemplates(fsys fs.FS) (*EmailTemplates, error) {
+	templates := EmailTemplates{
+		html: make(map[string]*htmltemplate.Template),
+		text: make(map[string]*texttemplate.Template),
+	}
+	for _, kind := range EmailKinds {
+		htmlTpl, err := htmltemplate.ParseFS(fsys, "layout.gohtml", kind+".gohtml")
+		if err != nil {
+			return nil, fmt.Errorf("models.ParseEmailTemplates: %w", err)
+		}
+		textTpl, err := texttemplate.ParseFS(fsys, "layout.txt", kind+".txt")
+		if err != nil {
+			return nil, fmt.Errorf("models.ParseEmailTemplates: %w", err)
+		}
+		if textTpl.Lookup("subject") == nil {
+			return nil, fmt.Errorf("models.ParseEmailTemplates: %s.txt does not define a subject", kind)
+		}
+		templates.html[kind] = htmlTpl
+		templates.text[kind] = textTpl
+	}
+	return &templates, nil
+}
+
+// Render returns the email of the kind without any recipients. data has to be
+// the data struct of the kind.
+func (t *EmailTemplates) Render(kind string, data interface{}) (Email, error) {
+	var email Email
+	htmlTpl, textTpl := t.html[kind], t.text[kind]
+	if htmlTpl == nil || textTpl == nil {
+		return email, fmt.Errorf("models.EmailTemplates.Render: unknown email kind %q", kind)
+	}
+
+	var buf bytes.Buffer
+	err := textTpl.ExecuteTemplate(&buf, "subject", data)
+	if err != nil {
+		return email, fmt.Errorf("models.EmailTemplates.Render: %w", err)
+	}
+	email.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	err = textTpl.ExecuteTemplate(&buf, "layout", data)
+	if err != nil {
+		return email, fmt.Errorf("models.EmailTemplates.Render: %w", err)
+	}
+	email.Plaintext = strings.TrimSpace(buf.String()) + "\n"
+
+	buf.Reset()
+	err = htmlTpl.ExecuteTemplate(&buf, "layout", data)
+	if err != nil {
+		return email, fmt.Errorf("models.EmailTemplates.Render: %w", err)
+	}
+	email.HTML = strings.TrimSpace(buf.String()) + "\n"
+
+	return email, nil
+}
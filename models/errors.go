@@ -3,6 +3,19 @@ package models
 import "errors"
 
 var (
-	ErrNotFound   = errors.New("resource could not be found")
-	ErrEmailToken = errors.New("email address is already in use")
+	ErrNotFound            = errors.New("resource could not be found")
+	ErrEmailToken          = errors.New("email address is already in use")
+	ErrTokenExpired        = errors.New("token has expired")
+	ErrWrongBrowser        = errors.New("token was requested from another browser")
+	ErrInvalidImage        = errors.New("file is not a supported image")
+	ErrAccountDisabled     = errors.New("account has been disabled")
+	ErrInvalidInvite       = errors.New("invite is invalid, expired or already used")
+	ErrInviteQuotaExceeded = errors.New("no invites left")
+	ErrEmailNotVerified    = errors.New("identity provider did not verify the email address")
+	ErrPasswordTooShort    = errors.New("password is too short")
+	ErrPasswordTooLong     = errors.New("password is too long")
+	ErrPasswordBreached    = errors.New("password has appeared in a data breach")
+	ErrPasswordMismatch    = errors.New("password does not match")
+	ErrSenderNotAllowed    = errors.New("sender is not allowed to add images to the gallery")
+	ErrNoImages            = errors.New("email has no image attachments")
 )
@@ -1,32 +1,63 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultImagesDir = "images"
 )
 
 type Gallery struct {
 	ID     int
 	UserID int
 	Title  string
+	// TakenDownAt is set when an admin took the gallery down. Taken down
+	// galleries are only visible to admins.
+	TakenDownAt *time.Time
+}
+
+// Image is a file stored in a gallery's directory on disk. Images are not
+// tracked in the database, so everything we know about them comes from the
+// filesystem.
+type Image struct {
+	GalleryID  int
+	Path       string
+	Filename   string
+	Size       int64
+	ModifiedAt time.Time
 }
 
 type GalleryService struct {
 	DB *sql.DB
+	// ImagesDir is the directory gallery images are stored in. Defaults to
+	// DefaultImagesDir.
+	ImagesDir string
 }
 
-func (service *GalleryService) Create(title string, userID int) (*Gallery, error) {
+func (service *GalleryService) Create(ctx context.Context, title string, userID int) (_ *Gallery, err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.Create")
+	defer endSpan(span, &err)
+
 	gallery := Gallery{
 		Title:  title,
 		UserID: userID,
 	}
-	row := service.DB.QueryRow(`
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
 	INSERT INTO galleries (title, user_id)
 	VALUES ($1, $2) RETURNING id;
 	`, gallery.Title, gallery.UserID)
 
-	err := row.Scan(&gallery.ID)
+	err = row.Scan(&gallery.ID)
 	if err != nil {
 		return nil, fmt.Errorf("GalleryService.Create: %w", err)
 	}
@@ -34,29 +65,37 @@ func (service *GalleryService) Create(title string, userID int) (*Gallery, error
 	return &gallery, nil
 }
 
-func (service *GalleryService) ByID(id int) (*Gallery, error) {
+func (service *GalleryService) ByID(ctx context.Context, id int) (_ *Gallery, err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.ByID")
+	defer endSpan(span, &err)
+
 	gallery := Gallery{
 		ID: id,
 	}
 
-	row := service.DB.QueryRow(`
-	SELECT title, user_id
+	var takenDownAt sql.NullTime
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+	SELECT title, user_id, taken_down_at
 	FROM galleries
 	WHERE id = $1
 	`, id)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+	err = row.Scan(&gallery.Title, &gallery.UserID, &takenDownAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("GalleryService.ByID: %w", ErrNotFound)
 		}
 		return nil, fmt.Errorf("GalleryService.ByID: %w", err)
 	}
+	gallery.TakenDownAt = nullTimePtr(takenDownAt)
 
 	return &gallery, nil
 }
 
-func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
-	rows, err := service.DB.Query(`
+func (service *GalleryService) ByUserID(ctx context.Context, userID int) (_ []Gallery, err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.ByUserID")
+	defer endSpan(span, &err)
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
 	SELECT id, title
 	FROM galleries
 	WHERE user_id = $1;
@@ -79,36 +118,310 @@ func (service *GalleryService) ByUserID(userID int) ([]Gallery, error) {
 		galleries = append(galleries, gallery)
 	}
 
-	if rows.Err() != nil {
-		return nil, fmt.Errorf("GallreyService.ByUserID: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GalleryService.ByUserID: %w", err)
+	}
+
+	return galleries, nil
+}
+
+// All returns every gallery of every user, for use by admins.
+func (service *GalleryService) All(ctx context.Context) (_ []Gallery, err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.All")
+	defer endSpan(span, &err)
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+	SELECT id, user_id, title, taken_down_at
+	FROM galleries
+	ORDER BY id;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("GalleryService.All: %w", err)
+	}
+	defer rows.Close()
+
+	var galleries []Gallery
+	for rows.Next() {
+		var gallery Gallery
+		var takenDownAt sql.NullTime
+		err := rows.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &takenDownAt)
+		if err != nil {
+			return nil, fmt.Errorf("GalleryService.All: %w", err)
+		}
+		gallery.TakenDownAt = nullTimePtr(takenDownAt)
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GalleryService.All: %w", err)
 	}
 
 	return galleries, nil
 }
 
-func (service *GalleryService) UpdateTitle(gallery *Gallery) error {
+// SetTakenDown takes the gallery down or puts it back up.
+func (service *GalleryService) SetTakenDown(ctx context.Context, id int, takenDown bool) (err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.SetTakenDown")
+	defer endSpan(span, &err)
+
+	var takenDownAt *time.Time
+	if takenDown {
+		now := time.Now()
+		takenDownAt = &now
+	}
+
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
+	UPDATE galleries
+	SET taken_down_at = $2
+	WHERE id = $1;
+	`, id, takenDownAt)
+	if err != nil {
+		return fmt.Errorf("GalleryService.SetTakenDown: %w", err)
+	}
+	return nil
+}
+
+func (service *GalleryService) UpdateTitle(ctx context.Context, gallery *Gallery) (err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.UpdateTitle")
+	defer endSpan(span, &err)
+
 	const errorPrefix = "GalleryService.UpdateTitle %v: %w"
-	res, err := service.DB.Exec(`
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
 	UPDATE galleries
 	SET title = $1
-	WHERE user_id = $2;
+	WHERE id = $2;
 	`, gallery.Title, gallery.ID)
 	if err != nil {
-		return fmt.Errorf(errorPrefix, nil, err)
+		return fmt.Errorf(errorPrefix, gallery.ID, err)
 	}
 
-	fmt.Println(res)
 	return nil
 }
 
-func (service *GalleryService) Delete(id int) error {
+// Transfer gives the gallery to another user. Its images stay where they are.
+func (service *GalleryService) Transfer(ctx context.Context, id int, userID int) (err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.Transfer")
+	defer endSpan(span, &err)
+
+	result, err := conn(ctx, service.DB).ExecContext(ctx, `
+	UPDATE galleries
+	SET user_id = $2
+	WHERE id = $1;
+	`, id, userID)
+	if err != nil {
+		return fmt.Errorf("GalleryService.Transfer: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("GalleryService.Transfer: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("GalleryService.Transfer: %w", ErrNotFound)
+	}
+
+	return nil
+}
+
+func (service *GalleryService) Delete(ctx context.Context, id int) (err error) {
+	ctx, span := startQuerySpan(ctx, "GalleryService.Delete")
+	defer endSpan(span, &err)
+
 	const errorPrefix = "GalleryService.Delete %v: %w"
-	_, err := service.DB.Exec(`
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
 	DELETE FROM galleries
 	WHERE id = $1;
 	`, id)
 	if err != nil {
 		return fmt.Errorf(errorPrefix, nil, err)
 	}
+
+	err = service.DeleteImages(ctx, id)
+	if err != nil {
+		return fmt.Errorf(errorPrefix, id, err)
+	}
+	return nil
+}
+
+func (service *GalleryService) Images(ctx context.Context, galleryID int) (_ []Image, err error) {
+	ctx, span := startSpan(ctx, "GalleryService.Images")
+	defer endSpan(span, &err)
+
+	entries, err := os.ReadDir(service.galleryDir(galleryID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GalleryService.Images: %w", err)
+	}
+
+	var images []Image
+	for _, entry := range entries {
+		if entry.IsDir() || !hasImageExtension(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("GalleryService.Images: %w", err)
+		}
+		images = append(images, Image{
+			GalleryID:  galleryID,
+			Path:       filepath.Join(service.galleryDir(galleryID), entry.Name()),
+			Filename:   entry.Name(),
+			Size:       info.Size(),
+			ModifiedAt: info.ModTime(),
+		})
+	}
+
+	return images, nil
+}
+
+func (service *GalleryService) Image(ctx context.Context, galleryID int, filename string) (_ Image, err error) {
+	ctx, span := startSpan(ctx, "GalleryService.Image")
+	defer endSpan(span, &err)
+
+	imagePath := filepath.Join(service.galleryDir(galleryID), filepath.Base(filename))
+	info, err := os.Stat(imagePath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Image{}, fmt.Errorf("GalleryService.Image: %w", ErrNotFound)
+		}
+		return Image{}, fmt.Errorf("GalleryService.Image: %w", err)
+	}
+	return Image{
+		GalleryID:  galleryID,
+		Path:       imagePath,
+		Filename:   filepath.Base(filename),
+		Size:       info.Size(),
+		ModifiedAt: info.ModTime(),
+	}, nil
+}
+
+// CreateImage stores the contents as an image of the gallery, replacing any
+// image with the same filename.
+func (service *GalleryService) CreateImage(ctx context.Context, galleryID int, filename string, contents io.Reader) (_ Image, err error) {
+	ctx, span := startSpan(ctx, "GalleryService.CreateImage")
+	defer endSpan(span, &err)
+
+	filename = filepath.Base(filename)
+	if !hasImageExtension(filename) {
+		return Image{}, fmt.Errorf("GalleryService.CreateImage %v: %w", filename, ErrInvalidImage)
+	}
+
+	galleryDir := service.galleryDir(galleryID)
+	err = os.MkdirAll(galleryDir, 0755)
+	if err != nil {
+		return Image{}, fmt.Errorf("GalleryService.CreateImage: %w", err)
+	}
+
+	imagePath := filepath.Join(galleryDir, filename)
+	dst, err := os.Create(imagePath)
+	if err != nil {
+		return Image{}, fmt.Errorf("GalleryService.CreateImage: %w", err)
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, contents)
+	if err != nil {
+		return Image{}, fmt.Errorf("GalleryService.CreateImage: %w", err)
+	}
+
+	return service.Image(ctx, galleryID, filename)
+}
+
+func (service *GalleryService) DeleteImage(ctx context.Context, galleryID int, filename string) (err error) {
+	ctx, span := startSpan(ctx, "GalleryService.DeleteImage")
+	defer endSpan(span, &err)
+
+	image, err := service.Image(ctx, galleryID, filename)
+	if err != nil {
+		return fmt.Errorf("GalleryService.DeleteImage: %w", err)
+	}
+	err = os.Remove(image.Path)
+	if err != nil {
+		return fmt.Errorf("GalleryService.DeleteImage: %w", err)
+	}
 	return nil
 }
+
+// DeleteImages removes every image stored for the gallery.
+func (service *GalleryService) DeleteImages(ctx context.Context, galleryID int) (err error) {
+	ctx, span := startSpan(ctx, "GalleryService.DeleteImages")
+	defer endSpan(span, &err)
+
+	err = os.RemoveAll(service.galleryDir(galleryID))
+	if err != nil {
+		return fmt.Errorf("GalleryService.DeleteImages: %w", err)
+	}
+	return nil
+}
+
+// StoredGalleryIDs returns the IDs of the galleries that have images stored,
+// which includes galleries whose images were left behind when they were
+// deleted.
+func (service *GalleryService) StoredGalleryIDs(ctx context.Context) (_ []int, err error) {
+	ctx, span := startSpan(ctx, "GalleryService.StoredGalleryIDs")
+	defer endSpan(span, &err)
+
+	imagesDir := service.ImagesDir
+	if imagesDir == "" {
+		imagesDir = DefaultImagesDir
+	}
+	entries, err := os.ReadDir(imagesDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("GalleryService.StoredGalleryIDs: %w", err)
+	}
+	var ids []int
+	for _, entry := range entries {
+		var id int
+		_, err := fmt.Sscanf(entry.Name(), "gallery-%d", &id)
+		if err == nil && entry.IsDir() && service.galleryDir(id) == filepath.Join(imagesDir, entry.Name()) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Ping checks that images can be stored.
+func (service *GalleryService) Ping() error {
+	imagesDir := service.ImagesDir
+	if imagesDir == "" {
+		imagesDir = DefaultImagesDir
+	}
+	err := os.MkdirAll(imagesDir, 0755)
+	if err != nil {
+		return fmt.Errorf("GalleryService.Ping: %w", err)
+	}
+	err = checkWritable(imagesDir)
+	if err != nil {
+		return fmt.Errorf("GalleryService.Ping: %w", err)
+	}
+	return nil
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".ping-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+func (service *GalleryService) galleryDir(id int) string {
+	imagesDir := service.ImagesDir
+	if imagesDir == "" {
+		imagesDir = DefaultImagesDir
+	}
+	return filepath.Join(imagesDir, fmt.Sprintf("gallery-%d", id))
+}
+
+func hasImageExtension(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	DefaultArgon2idMemory      = 64 * 1024 // KiB
+	DefaultArgon2idIterations  = 3
+	DefaultArgon2idParallelism = 2
+	argon2idSaltLength         = 16
+	argon2idKeyLength          = 32
+)
+
+// PasswordHasher hashes passwords into a self-describing format, so a stored
+// hash records which algorithm and parameters produced it.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password.
+	Hash(password string) (string, error)
+	// Compare returns ErrPasswordMismatch if the password does not match the
+	// hash.
+	Compare(hash string, password string) error
+	// Handles reports whether the hash was produced by this hasher's
+	// algorithm, regardless of its parameters.
+	Handles(hash string) bool
+	// Outdated reports whether the hash was produced with weaker or different
+	// parameters than the hasher currently uses.
+	Outdated(hash string) bool
+}
+
+// NewPasswordHasher returns the hasher called name, "bcrypt" or "argon2id".
+// bcryptCost is only used by bcrypt, 0 means bcrypt.DefaultCost.
+func NewPasswordHasher(name string, bcryptCost int) (PasswordHasher, error) {
+	switch name {
+	case "bcrypt":
+		return &BcryptHasher{Cost: bcryptCost}, nil
+	case "argon2id":
+		return &Argon2idHasher{}, nil
+	default:
+		return nil, fmt.Errorf("models.NewPasswordHasher: unknown password hasher %q", name)
+	}
+}
+
+// BcryptHasher produces the standard "$2a$<cost>$..." bcrypt hashes.
+type BcryptHasher struct {
+	// Defaults to bcrypt.DefaultCost
+	Cost int
+}
+
+func (h *BcryptHasher) cost() int {
+	if h.Cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.Cost
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), h.cost())
+	if err != nil {
+		return "", fmt.Errorf("models.BcryptHasher.Hash: %w", err)
+	}
+	return string(hashedBytes), nil
+}
+
+func (h *BcryptHasher) Compare(hash string, password string) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return fmt.Errorf("models.BcryptHasher.Compare: %w", err)
+	}
+	return nil
+}
+
+func (h *BcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (h *BcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost()
+}
+
+// Argon2idHasher produces argon2id hashes in the PHC string format, e.g.
+// "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>".
+type Argon2idHasher struct {
+	// memory in KiB. Defaults to DefaultArgon2idMemory
+	Memory uint32
+	// Defaults to DefaultArgon2idIterations
+	Iterations uint32
+	// Defaults to DefaultArgon2idParallelism
+	Parallelism uint8
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func (h *Argon2idHasher) params() argon2idParams {
+	params := argon2idParams{
+		memory:      h.Memory,
+		iterations:  h.Iterations,
+		parallelism: h.Parallelism,
+	}
+	if params.memory == 0 {
+		params.memory = DefaultArgon2idMemory
+	}
+	if params.iterations == 0 {
+		params.iterations = DefaultArgon2idIterations
+	}
+	if params.parallelism == 0 {
+		params.parallelism = DefaultArgon2idParallelism
+	}
+	return params
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	params := h.params()
+	salt := make([]byte, argon2idSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", fmt.Errorf("models.Argon2idHasher.Hash: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, argon2idKeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.memory, params.iterations, params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Compare(hash string, password string) error {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return fmt.Errorf("models.Argon2idHasher.Compare: %w", err)
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+func (h *Argon2idHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+func (h *Argon2idHasher) Outdated(hash string) bool {
+	params, _, _, err := decodeArgon2id(hash)
+	return err != nil || params != h.params()
+}
+
+func decodeArgon2id(hash string) (argon2idParams, []byte, []byte, error) {
+	var params argon2idParams
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+
+	return params, salt, key, nil
+}
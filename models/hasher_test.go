@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2idHasher is cheap enough to run many times in tests.
+func testArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 1}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"bcrypt":   &BcryptHasher{Cost: bcrypt.MinCost},
+		"argon2id": testArgon2idHasher(),
+	}
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			hash, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hasher.Handles(hash) {
+				t.Errorf("Handles(%q) = false for its own hash", hash)
+			}
+			if hasher.Outdated(hash) {
+				t.Errorf("Outdated(%q) = true for a fresh hash", hash)
+			}
+			err = hasher.Compare(hash, "correct horse")
+			if err != nil {
+				t.Errorf("Compare() with the password: %v", err)
+			}
+			err = hasher.Compare(hash, "wrong horse")
+			if !errors.Is(err, ErrPasswordMismatch) {
+				t.Errorf("Compare() with another password: err = %v, want %v", err, ErrPasswordMismatch)
+			}
+
+			// every hash has its own salt
+			other, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == hash {
+				t.Errorf("hashing the password twice gave the same hash %q", hash)
+			}
+		})
+	}
+}
+
+func TestArgon2idHasherPHC(t *testing.T) {
+	hash, err := testArgon2idHasher().Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 16 bytes of salt and 32 of key, unpadded base64
+	phc := regexp.MustCompile(`^\$argon2id\$v=19\$m=1024,t=1,p=1\$[A-Za-z0-9+/]{22}\$[A-Za-z0-9+/]{43}$`)
+	if !phc.MatchString(hash) {
+		t.Errorf("Hash() = %q, want the PHC string format", hash)
+	}
+
+	// the parameters of the hash are used, not those of the hasher
+	err = (&Argon2idHasher{}).Compare(hash, "correct horse")
+	if err != nil {
+		t.Errorf("Compare() with other parameters: %v", err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"$argon2id$v=19$m=1024,t=1,p=1$salt",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5",
+		strings.Replace(hash, "$argon2id$", "$argon2i$", 1),
+	} {
+		err := testArgon2idHasher().Compare(invalid, "correct horse")
+		if err == nil || errors.Is(err, ErrPasswordMismatch) {
+			t.Errorf("Compare(%q) err = %v, want an invalid hash error", invalid, err)
+		}
+	}
+}
+
+func TestPasswordHasherOutdated(t *testing.T) {
+	argon2idHash, err := testArgon2idHasher().Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcryptHash, err := (&BcryptHasher{Cost: bcrypt.MinCost}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{"argon2id same parameters", testArgon2idHasher(), argon2idHash, false},
+		{"argon2id more memory", &Argon2idHasher{Memory: 2048, Iterations: 1, Parallelism: 1}, argon2idHash, true},
+		{"argon2id more iterations", &Argon2idHasher{Memory: 1024, Iterations: 2, Parallelism: 1}, argon2idHash, true},
+		{"argon2id more parallelism", &Argon2idHasher{Memory: 1024, Iterations: 1, Parallelism: 2}, argon2idHash, true},
+		{"argon2id defaults", &Argon2idHasher{}, argon2idHash, true},
+		{"argon2id invalid hash", testArgon2idHasher(), "$argon2id$garbage", true},
+		{"bcrypt same cost", &BcryptHasher{Cost: bcrypt.MinCost}, bcryptHash, false},
+		{"bcrypt higher cost", &BcryptHasher{Cost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"bcrypt default cost", &BcryptHasher{}, bcryptHash, true},
+		{"bcrypt invalid hash", &BcryptHasher{Cost: bcrypt.MinCost}, "$2a$garbage", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.Outdated(tt.hash); got != tt.want {
+				t.Errorf("Outdated(%q) = %v, want %v", tt.hash, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRehashes(t *testing.T) {
+	store := &MemoryStore{}
+	us := &MemoryUserService{
+		Store:          store,
+		PasswordHasher: &BcryptHasher{Cost: bcrypt.MinCost},
+	}
+	ctx := context.Background()
+	user, err := us.Create(ctx, "alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedHash := func() string {
+		d := store.lock()
+		defer store.unlock()
+		return d.users[user.ID].PasswordHash
+	}
+	if !strings.HasPrefix(storedHash(), "$2a$") {
+		t.Fatalf("stored hash = %q, want a bcrypt hash", storedHash())
+	}
+
+	// switching the hasher keeps the old hashes working until users sign in
+	us.PasswordHasher = testArgon2idHasher()
+	_, err = us.Authenticate(ctx, "alice@example.com", "wrong horse battery")
+	if err == nil {
+		t.Fatal("authenticated with the wrong password")
+	}
+	if !strings.HasPrefix(storedHash(), "$2a$") {
+		t.Errorf("a failed sign in replaced the hash with %q", storedHash())
+	}
+
+	_, err = us.Authenticate(ctx, "alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rehashed := storedHash()
+	if !strings.HasPrefix(rehashed, "$argon2id$") {
+		t.Fatalf("stored hash = %q, want it replaced by an argon2id hash", rehashed)
+	}
+
+	_, err = us.Authenticate(ctx, "alice@example.com", "correct horse battery")
+	if err != nil {
+		t.Fatalf("authenticating with the rehashed password: %v", err)
+	}
+	if storedHash() != rehashed {
+		t.Errorf("a current hash was replaced")
+	}
+}
@@ -0,0 +1,401 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"path/filepath"
+	"strings"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	DefaultInboundEmailDomain = "inbound.gallery-app.com"
+	// inboundAddressPrefix starts the local part of every gallery address, e.g.
+	// gallery-5f2b...@inbound.gallery-app.com.
+	inboundAddressPrefix = "gallery-"
+	// the token is hex encoded, so addresses survive relays that change the
+	// case of the local part.
+	inboundTokenBytes = 16
+	// maxMIMEDepth limits how deep multipart messages are searched for
+	// attachments.
+	maxMIMEDepth = 10
+)
+
+// InboundEmail is the part of a received message we care about.
+type InboundEmail struct {
+	From        string
+	To          []string
+	Subject     string
+	Attachments []InboundAttachment
+}
+
+type InboundAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// ParseInboundEmail reads a raw MIME message, as received over SMTP or
+// forwarded by a mail relay. Recipients are collected from the To, Cc,
+// Delivered-To and X-Original-To headers, because a message sent to the
+// gallery address by Bcc only carries it in the headers added by the relay.
+func ParseInboundEmail(r io.Reader) (*InboundEmail, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("models.ParseInboundEmail: %w", err)
+	}
+
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("models.ParseInboundEmail: from: %w", err)
+	}
+	email := InboundEmail{
+		From:    strings.ToLower(from.Address),
+		Subject: decodeHeader(msg.Header.Get("Subject")),
+	}
+	for _, key := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		for _, value := range msg.Header[key] {
+			addresses, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, address := range addresses {
+				email.To = append(email.To, strings.ToLower(address.Address))
+			}
+		}
+	}
+
+	err = email.readPart(mimeHeader(msg.Header), msg.Body, 0)
+	if err != nil {
+		return nil, fmt.Errorf("models.ParseInboundEmail: %w", err)
+	}
+	return &email, nil
+}
+
+// mimeHeader is the subset of headers needed to read a part, which is the
+// same for the message itself and for the parts of a multipart message.
+type mimeHeader interface {
+	Get(key string) string
+}
+
+func (email *InboundEmail) readPart(header mimeHeader, body io.Reader, depth int) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// a part we cannot understand is skipped, like mail clients do
+		return nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxMIMEDepth {
+			return nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = email.readPart(part.Header, part, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil
+	}
+	filename := attachmentFilename(header, params)
+	if filename == "" {
+		// inline images pasted into the message often have no name
+		switch mediaType {
+		case "image/jpeg":
+			filename = "image.jpg"
+		case "image/png":
+			filename = "image.png"
+		case "image/gif":
+			filename = "image.gif"
+		default:
+			return nil
+		}
+	}
+
+	data, err := io.ReadAll(transferDecoder(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("reading %v: %w", filename, err)
+	}
+	email.Attachments = append(email.Attachments, InboundAttachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Data:        data,
+	})
+	return nil
+}
+
+// attachmentFilename returns the filename from the Content-Disposition
+// header, falling back to the older name parameter of the Content-Type.
+func attachmentFilename(header mimeHeader, contentTypeParams map[string]string) string {
+	filename := contentTypeParams["name"]
+	_, params, err := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	filename = decodeHeader(filename)
+	// some clients send the full path of the file
+	filename = filepath.Base(strings.ReplaceAll(filename, `\`, "/"))
+	if filename == "." || filename == "/" {
+		return ""
+	}
+	return filename
+}
+
+func transferDecoder(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineSkipper{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// newlineSkipper drops the line breaks of base64 encoded bodies, which the
+// base64 decoder does not accept.
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (s *newlineSkipper) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	kept := p[:0]
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			kept = append(kept, b)
+		}
+	}
+	return len(kept), err
+}
+
+// decodeHeader decodes RFC 2047 encoded words, e.g. =?UTF-8?Q?caf=C3=A9?=.
+func decodeHeader(value string) string {
+	decoded, err := new(mime.WordDecoder).DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// InboundEmailService gives galleries a secret email address, and adds the
+// images attached to messages sent there to the gallery.
+//
+// The sender is checked against the From header, which is easy to forge.
+// The relay in front of the service has to reject messages that fail SPF or
+// DKIM checks, and the address itself has to be kept secret.
+type InboundEmailService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	// Domain of the gallery addresses. Defaults to DefaultInboundEmailDomain.
+	Domain string
+}
+
+// Address returns the inbound address of the gallery, or an empty string if
+// it does not have one yet.
+func (service *InboundEmailService) Address(ctx context.Context, galleryID int) (string, error) {
+	var token sql.NullString
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+	SELECT inbound_token
+	FROM galleries
+	WHERE id = $1;`, galleryID)
+	err := row.Scan(&token)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("models.InboundEmailService.Address: %w", ErrNotFound)
+		}
+		return "", fmt.Errorf("models.InboundEmailService.Address: %w", err)
+	}
+	if !token.Valid {
+		return "", nil
+	}
+	return service.address(token.String), nil
+}
+
+// ResetAddress gives the gallery a new inbound address. The previous address,
+// if any, stops working.
+func (service *InboundEmailService) ResetAddress(ctx context.Context, galleryID int) (string, error) {
+	tokenBytes, err := rand.RandBytes(inboundTokenBytes)
+	if err != nil {
+		return "", fmt.Errorf("models.InboundEmailService.ResetAddress: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+	UPDATE galleries
+	SET inbound_token = $2
+	WHERE id = $1;`, galleryID, token)
+	if err != nil {
+		return "", fmt.Errorf("models.InboundEmailService.ResetAddress: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return "", fmt.Errorf("models.InboundEmailService.ResetAddress: %w", err)
+	}
+	if n == 0 {
+		return "", fmt.Errorf("models.InboundEmailService.ResetAddress: %w", ErrNotFound)
+	}
+	return service.address(token), nil
+}
+
+// DisableAddress removes the inbound address of the gallery.
+func (service *InboundEmailService) DisableAddress(ctx context.Context, galleryID int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+	UPDATE galleries
+	SET inbound_token = NULL
+	WHERE id = $1;`, galleryID)
+	if err != nil {
+		return fmt.Errorf("models.InboundEmailService.DisableAddress: %w", err)
+	}
+	return nil
+}
+
+// Receive adds the image attachments of the email to the gallery it was sent
+// to. The sender has to be the owner of the gallery. Attachments that are not
+// png, jpg or gif images are ignored, and ErrNoImages is returned if nothing
+// was left.
+func (service *InboundEmailService) Receive(ctx context.Context, email *InboundEmail) (*Gallery, []Image, error) {
+	gallery, ownerEmail, err := service.galleryFor(ctx, email.To)
+	if err != nil {
+		return nil, nil, fmt.Errorf("models.InboundEmailService.Receive: %w", err)
+	}
+	if gallery.TakenDownAt != nil {
+		return nil, nil, fmt.Errorf("models.InboundEmailService.Receive: gallery %d is taken down: %w", gallery.ID, ErrNotFound)
+	}
+	if !strings.EqualFold(email.From, ownerEmail) {
+		return nil, nil, fmt.Errorf("models.InboundEmailService.Receive: %v: %w", email.From, ErrSenderNotAllowed)
+	}
+
+	existing, err := service.GalleryService.Images(ctx, gallery.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("models.InboundEmailService.Receive: %w", err)
+	}
+	taken := make(map[string]bool, len(existing))
+	for _, image := range existing {
+		taken[strings.ToLower(image.Filename)] = true
+	}
+
+	var images []Image
+	for _, attachment := range email.Attachments {
+		if !hasImageExtension(attachment.Filename) {
+			continue
+		}
+		// phones name every photo image0.jpg, which would replace the images
+		// of earlier emails.
+		filename := uniqueFilename(attachment.Filename, taken)
+		taken[strings.ToLower(filename)] = true
+
+		image, err := service.GalleryService.CreateImage(ctx, gallery.ID, filename, bytes.NewReader(attachment.Data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("models.InboundEmailService.Receive: %w", err)
+		}
+		images = append(images, image)
+	}
+	if len(images) == 0 {
+		return nil, nil, fmt.Errorf("models.InboundEmailService.Receive: %w", ErrNoImages)
+	}
+
+	return gallery, images, nil
+}
+
+// galleryFor finds the gallery addressed by one of the recipients, and the
+// email of its owner.
+func (service *InboundEmailService) galleryFor(ctx context.Context, recipients []string) (*Gallery, string, error) {
+	for _, recipient := range recipients {
+		token, ok := InboundToken(recipient, service.domain())
+		if !ok {
+			continue
+		}
+
+		var gallery Gallery
+		var ownerEmail string
+		var takenDownAt sql.NullTime
+		row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT galleries.id, galleries.user_id, galleries.title, galleries.taken_down_at, users.email
+		FROM galleries
+		JOIN users ON users.id = galleries.user_id
+		WHERE galleries.inbound_token = $1;`, token)
+		err := row.Scan(&gallery.ID, &gallery.UserID, &gallery.Title, &takenDownAt, &ownerEmail)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return nil, "", err
+		}
+		gallery.TakenDownAt = nullTimePtr(takenDownAt)
+		return &gallery, ownerEmail, nil
+	}
+	return nil, "", ErrNotFound
+}
+
+// InboundToken returns the gallery token of an inbound address in the domain.
+func InboundToken(address string, domain string) (string, bool) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	at := strings.LastIndex(address, "@")
+	if at < 0 || address[at+1:] != strings.ToLower(domain) {
+		return "", false
+	}
+	local := address[:at]
+	if !strings.HasPrefix(local, inboundAddressPrefix) {
+		return "", false
+	}
+	token := local[len(inboundAddressPrefix):]
+	if len(token) != hex.EncodedLen(inboundTokenBytes) {
+		return "", false
+	}
+	return token, true
+}
+
+func (service *InboundEmailService) address(token string) string {
+	return inboundAddressPrefix + token + "@" + service.domain()
+}
+
+func (service *InboundEmailService) domain() string {
+	if service.Domain == "" {
+		return DefaultInboundEmailDomain
+	}
+	return service.Domain
+}
+
+// uniqueFilename adds a number to the filename if it is already taken, e.g.
+// image0-2.jpg.
+func uniqueFilename(filename string, taken map[string]bool) string {
+	filename = filepath.Base(filename)
+	if !taken[strings.ToLower(filename)] {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", name, i, ext)
+		if !taken[strings.ToLower(candidate)] {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const fixtureToken = "0123456789abcdef0123456789abcdef"
+
+func parseFixture(t *testing.T, name string) *InboundEmail {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", "inbound", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	email, err := ParseInboundEmail(f)
+	if err != nil {
+		t.Fatalf("ParseInboundEmail(%v) err = %v", name, err)
+	}
+	return email
+}
+
+func TestParseInboundEmail(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		from      string
+		subject   string
+		filenames []string
+	}{
+		{"single-attachment.eml", "jane@example.com", "Beach", []string{"beach.png"}},
+		{"iphone-nested.eml", "jane@example.com", "Café", []string{"image.gif", "café.gif"}},
+		{"bcc-relay.eml", "jane@example.com", "Bcc", []string{"dog.png"}},
+		{"no-attachments.eml", "jane@example.com", "Hello", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			email := parseFixture(t, tt.fixture)
+			if email.From != tt.from {
+				t.Errorf("From = %q, want %q", email.From, tt.from)
+			}
+			if email.Subject != tt.subject {
+				t.Errorf("Subject = %q, want %q", email.Subject, tt.subject)
+			}
+
+			var filenames []string
+			for _, attachment := range email.Attachments {
+				filenames = append(filenames, attachment.Filename)
+			}
+			if len(filenames) != len(tt.filenames) {
+				t.Fatalf("attachments = %q, want %q", filenames, tt.filenames)
+			}
+			for i := range filenames {
+				if filenames[i] != tt.filenames[i] {
+					t.Errorf("attachments = %q, want %q", filenames, tt.filenames)
+				}
+			}
+
+			token, ok := "", false
+			for _, to := range email.To {
+				if token, ok = InboundToken(to, DefaultInboundEmailDomain); ok {
+					break
+				}
+			}
+			if token != fixtureToken {
+				t.Errorf("gallery token of %q = %q, want %q", email.To, token, fixtureToken)
+			}
+		})
+	}
+}
+
+func TestParseInboundEmailDecodesAttachments(t *testing.T) {
+	email := parseFixture(t, "single-attachment.eml")
+	png := []byte("\x89PNG\r\n\x1a\n")
+	if len(email.Attachments) != 1 || !bytes.HasPrefix(email.Attachments[0].Data, png) {
+		t.Fatalf("attachment is not the decoded png: %+v", email.Attachments)
+	}
+	if got := email.Attachments[0].ContentType; got != "image/png" {
+		t.Errorf("ContentType = %q, want image/png", got)
+	}
+
+	email = parseFixture(t, "iphone-nested.eml")
+	for _, attachment := range email.Attachments {
+		if !bytes.HasPrefix(attachment.Data, []byte("GIF89a")) {
+			t.Errorf("%v is not the decoded gif: %q", attachment.Filename, attachment.Data)
+		}
+	}
+}
+
+func TestParseInboundEmailMalformedFrom(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "inbound", "malformed-from.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = ParseInboundEmail(f)
+	if err == nil {
+		t.Fatal("ParseInboundEmail() err = nil, want an error for the From header")
+	}
+}
+
+func TestInboundToken(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		ok      bool
+	}{
+		{"gallery-" + fixtureToken + "@inbound.gallery-app.com", fixtureToken, true},
+		{"Gallery-0123456789ABCDEF0123456789ABCDEF@Inbound.Gallery-App.com", fixtureToken, true},
+		{"gallery-" + fixtureToken + "@example.com", "", false},
+		{"gallery-0123@inbound.gallery-app.com", "", false},
+		{fixtureToken + "@inbound.gallery-app.com", "", false},
+		{"not an address", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := InboundToken(tt.address, DefaultInboundEmailDomain)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("InboundToken(%q) = %q, %v, want %q, %v", tt.address, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestUniqueFilename(t *testing.T) {
+	taken := map[string]bool{"image0.jpg": true, "image0-2.jpg": true}
+	tests := map[string]string{
+		"beach.png":  "beach.png",
+		"image0.jpg": "image0-3.jpg",
+		"IMAGE0.JPG": "IMAGE0-3.JPG",
+	}
+	for filename, want := range tests {
+		if got := uniqueFilename(filename, taken); got != want {
+			t.Errorf("uniqueFilename(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
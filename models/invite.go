@@ -0,0 +1,227 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	DefaultInviteDuration = 7 * 24 * time.Hour
+	// DefaultInviteQuota is how many invites a user that is not an admin can
+	// send.
+	DefaultInviteQuota = 5
+)
+
+// Invite allows one person to sign up with the invited email address while
+// registration is invite only.
+type Invite struct {
+	ID        int
+	InviterID int
+	Email     string
+	// token is only set when an Invite is being created
+	Token     string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (invite *Invite) Expired() bool {
+	return time.Now().After(invite.ExpiresAt)
+}
+
+type InviteService struct {
+	DB *sql.DB
+	// how many bytes to use when generating each invite token. If this value is
+	// not set or is less than the MinSessionTokenBytes const it will be ignored and
+	// MinSessionTokenBytes will be used.
+	BytesPerToken int
+	// invite expiration duration. Defaults to DefaultInviteDuration
+	Duration time.Duration
+	// how many invites each user that is not an admin can send, zero turns
+	// invites off. Defaults to DefaultInviteQuota if nil
+	Quota *int
+}
+
+// Create invites the email address on behalf of the inviter. Users that are
+// not admins can only send as many invites as their quota allows. notify is
+// called in the same transaction, e.g. to queue the invite email. It can be
+// nil.
+func (service *InviteService) Create(ctx context.Context, inviter *User, email string, notify func(ctx context.Context, invite *Invite) error) (*Invite, error) {
+	email = strings.ToLower(email)
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinSessionTokenBytes {
+		bytesPerToken = MinSessionTokenBytes
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.InviteService.Create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultInviteDuration
+	}
+
+	invite := Invite{
+		InviterID: int(inviter.ID),
+		Email:     email,
+		Token:     token,
+		TokenHash: service.hash(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	err = WithTx(ctx, service.DB, func(ctx context.Context) error {
+		if !inviter.IsAdmin() {
+			// invites of the same user wait for each other here, so they
+			// cannot both pass the quota check
+			_, err := conn(ctx, service.DB).ExecContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE;`, inviter.ID)
+			if err != nil {
+				return err
+			}
+		}
+		remaining, err := service.Remaining(ctx, inviter)
+		if err != nil {
+			return err
+		}
+		if remaining == 0 {
+			return ErrInviteQuotaExceeded
+		}
+
+		row := conn(ctx, service.DB).QueryRowContext(ctx, `
+			INSERT INTO invites (inviter_id, email, token_hash, expires_at)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at;`,
+			invite.InviterID, invite.Email, invite.TokenHash, invite.ExpiresAt,
+		)
+		err = row.Scan(&invite.ID, &invite.CreatedAt)
+		if err != nil || notify == nil {
+			return err
+		}
+		return notify(ctx, &invite)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.InviteService.Create: %w", err)
+	}
+
+	return &invite, nil
+}
+
+// Remaining returns how many more invites the user can send, or -1 if the
+// user can send any number of invites.
+func (service *InviteService) Remaining(ctx context.Context, user *User) (int, error) {
+	if user.IsAdmin() {
+		return -1, nil
+	}
+
+	quota := inviteQuota(service.Quota)
+	var sent int
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `SELECT COUNT(*) FROM invites WHERE inviter_id = $1;`, user.ID)
+	err := row.Scan(&sent)
+	if err != nil {
+		return 0, fmt.Errorf("models.InviteService.Remaining: %w", err)
+	}
+
+	if sent >= quota {
+		return 0, nil
+	}
+	return quota - sent, nil
+}
+
+func inviteQuota(quota *int) int {
+	if quota == nil {
+		return DefaultInviteQuota
+	}
+	return *quota
+}
+
+func (service *InviteService) ByInviterID(ctx context.Context, inviterID int) ([]Invite, error) {
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, email, expires_at, used_at, created_at
+		FROM invites
+		WHERE inviter_id = $1
+		ORDER BY created_at DESC;`,
+		inviterID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.InviteService.ByInviterID: %w", err)
+	}
+	defer rows.Close()
+
+	var invites []Invite
+	for rows.Next() {
+		invite := Invite{
+			InviterID: inviterID,
+		}
+		var usedAt sql.NullTime
+		err := rows.Scan(&invite.ID, &invite.Email, &invite.ExpiresAt, &usedAt, &invite.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.InviteService.ByInviterID: %w", err)
+		}
+		invite.UsedAt = nullTimePtr(usedAt)
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.InviteService.ByInviterID: %w", err)
+	}
+
+	return invites, nil
+}
+
+// Consume marks the invite for the email address as used. Consuming is atomic,
+// so an invite can never be used twice, even by concurrent sign ups.
+func (service *InviteService) Consume(ctx context.Context, token string, email string) (*Invite, error) {
+	invite := Invite{
+		Email:     strings.ToLower(email),
+		TokenHash: service.hash(token),
+	}
+
+	var usedAt time.Time
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		UPDATE invites
+		SET used_at = NOW()
+		WHERE token_hash = $1
+			AND email = $2
+			AND used_at IS NULL
+			AND expires_at > NOW()
+		RETURNING id, expires_at, used_at;`,
+		invite.TokenHash, invite.Email,
+	)
+	err := row.Scan(&invite.ID, &invite.ExpiresAt, &usedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.InviteService.Consume: %w", ErrInvalidInvite)
+		}
+		return nil, fmt.Errorf("models.InviteService.Consume: %w", err)
+	}
+	invite.UsedAt = &usedAt
+
+	return &invite, nil
+}
+
+// Release makes a consumed invite usable again. It is used when the sign up
+// the invite was consumed for failed.
+func (service *InviteService) Release(ctx context.Context, id int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE invites
+		SET used_at = NULL
+		WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("models.InviteService.Release: %w", err)
+	}
+	return nil
+}
+
+func (service *InviteService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-mail/mail"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	MailTransportSMTP   = "smtp"
+	MailTransportFile   = "file"
+	MailTransportMemory = "memory"
+
+	DefaultSMTPPort = 587
+)
+
+// Mailer delivers a single email.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+	// Ping checks that emails can be delivered, e.g. that the SMTP server is
+	// reachable.
+	Ping(ctx context.Context) error
+}
+
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// MailConfig decides how emails are delivered.
+type MailConfig struct {
+	// Transport is one of the MailTransport consts. Defaults to
+	// MailTransportSMTP
+	Transport string
+	SMTP      SMTPConfig
+	// Dir is where MailTransportFile writes its .eml files.
+	Dir string
+}
+
+// NewMailer returns the Mailer for the configured transport.
+func NewMailer(config MailConfig) (Mailer, error) {
+	switch config.Transport {
+	case "", MailTransportSMTP:
+		return NewSMTPMailer(config.SMTP), nil
+	case MailTransportFile:
+		if config.Dir == "" {
+			return nil, fmt.Errorf("models.NewMailer: no directory for the file transport")
+		}
+		return &FileMailer{Dir: config.Dir}, nil
+	case MailTransportMemory:
+		return &MemoryMailer{}, nil
+	default:
+		return nil, fmt.Errorf("models.NewMailer: unknown transport %q", config.Transport)
+	}
+}
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	dialer *mail.Dialer
+}
+
+func NewSMTPMailer(config SMTPConfig) *SMTPMailer {
+	port := config.Port
+	if port == 0 {
+		port = DefaultSMTPPort
+	}
+	return &SMTPMailer{
+		dialer: mail.NewDialer(config.Host, port, config.Username, config.Password),
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, email Email) (err error) {
+	_, span := tracer.Start(ctx, "SMTPMailer.Send",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.ServerAddress(m.dialer.Host),
+			semconv.ServerPort(m.dialer.Port),
+		),
+	)
+	defer endSpan(span, &err)
+
+	err = m.dialer.DialAndSend(newMessage(email))
+	if err != nil {
+		return fmt.Errorf("models.SMTPMailer.Send: %w", err)
+	}
+	return nil
+}
+
+// Ping connects to the SMTP server and authenticates, without sending
+// anything.
+func (m *SMTPMailer) Ping(ctx context.Context) error {
+	dialer := *m.dialer
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Timeout = time.Until(deadline)
+	}
+	conn, err := dialer.Dial()
+	if err != nil {
+		return fmt.Errorf("models.SMTPMailer.Ping: %w", err)
+	}
+	return conn.Close()
+}
+
+// FileMailer writes every email to an .eml file in Dir instead of sending it,
+// so emails can be opened with a mail client during development.
+type FileMailer struct {
+	Dir string
+}
+
+func (m *FileMailer) Send(ctx context.Context, email Email) error {
+	err := os.MkdirAll(m.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("models.FileMailer.Send: %w", err)
+	}
+
+	// files sort by the time they were sent in
+	pattern := time.Now().Format("20060102-150405") + "-" + fileSafe(email.To) + "-*.eml"
+	f, err := os.CreateTemp(m.Dir, pattern)
+	if err != nil {
+		return fmt.Errorf("models.FileMailer.Send: %w", err)
+	}
+
+	_, err = newMessage(email).WriteTo(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("models.FileMailer.Send: writing %s: %w", filepath.Base(f.Name()), err)
+	}
+	// the file may not be complete until it is closed
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("models.FileMailer.Send: closing %s: %w", filepath.Base(f.Name()), err)
+	}
+	return nil
+}
+
+// Ping checks that Dir can be written to.
+func (m *FileMailer) Ping(ctx context.Context) error {
+	err := os.MkdirAll(m.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("models.FileMailer.Ping: %w", err)
+	}
+	return checkWritable(m.Dir)
+}
+
+// MemoryMailer keeps every email it is asked to send, so tests can check
+// what would have been sent.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Email
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, email Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, email)
+	return nil
+}
+
+func (m *MemoryMailer) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Sent returns the emails sent so far, oldest first.
+func (m *MemoryMailer) Sent() []Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := make([]Email, len(m.sent))
+	copy(sent, m.sent)
+	return sent
+}
+
+// Reset forgets every email sent so far.
+func (m *MemoryMailer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = nil
+}
+
+func newMessage(email Email) *mail.Message {
+	msg := mail.NewMessage()
+	msg.SetHeader("To", email.To)
+	msg.SetHeader("From", email.From)
+	msg.SetHeader("Subject", email.Subject)
+	for name, value := range email.Headers {
+		msg.SetHeader(name, value)
+	}
+	switch {
+	case email.Plaintext != "" && email.HTML != "":
+		msg.SetBody("text/plain", email.Plaintext)
+		msg.AddAlternative("text/html", email.HTML)
+	case email.Plaintext != "":
+		msg.SetBody("text/plain", email.Plaintext)
+	case email.HTML != "":
+		msg.SetBody("text/html", email.HTML)
+	}
+	return msg
+}
+
+// fileSafe replaces everything but letters, digits, dots and dashes, so s can
+// be part of a file name.
+func fileSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testNotification = NotificationEmail{
+	Subject:        "New images in Holidays",
+	Message:        "beach.jpg was added to Holidays by email.",
+	URL:            "https://www.gallery-app.com/galleries/1",
+	UnsubscribeURL: "https://www.gallery-app.com/unsubscribe?token=abc",
+	PreferencesURL: notificationPreferencesURL,
+}
+
+func TestFileMailerHeaders(t *testing.T) {
+	dir := t.TempDir()
+	es, err := NewEmailService(&FileMailer{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = es.Notification(context.Background(), "1", "alice@example.com", testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-alice_example.com-*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		entries, _ := os.ReadDir(dir)
+		t.Fatalf("files = %v, want one .eml file for alice", entries)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"To":                    "alice@example.com",
+		"From":                  DefaultSender,
+		"Subject":               "New images in Holidays",
+		"List-Unsubscribe":      "<https://www.gallery-app.com/unsubscribe?token=abc>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	for name, value := range want {
+		if got := msg.Header.Get(name); got != value {
+			t.Errorf("header %s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestMemoryMailerHeaders(t *testing.T) {
+	mailer := &MemoryMailer{}
+	es, err := NewEmailService(mailer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = es.Notification(context.Background(), "1", "alice@example.com", testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := mailer.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(sent))
+	}
+	email := sent[0]
+	if email.To != "alice@example.com" || email.From != DefaultSender || email.Subject != "New images in Holidays" {
+		t.Errorf("email = %q to %q from %q, want the notification to alice", email.Subject, email.To, email.From)
+	}
+	if got := email.Headers["List-Unsubscribe"]; got != "<https://www.gallery-app.com/unsubscribe?token=abc>" {
+		t.Errorf("List-Unsubscribe = %q, want the unsubscribe URL", got)
+	}
+	if got := email.Headers["List-Unsubscribe-Post"]; got != "List-Unsubscribe=One-Click" {
+		t.Errorf("List-Unsubscribe-Post = %q, want one-click unsubscribes", got)
+	}
+}
@@ -0,0 +1,180 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+// MemoryStore holds the data of the Memory services, which behave like their
+// Postgres counterparts without needing a database. Services sharing a store
+// see each other's changes, like services sharing a database. It is meant for
+// tests; the zero value is an empty store.
+type MemoryStore struct {
+	mu     sync.Mutex
+	data   memoryData
+	lastID int
+}
+
+// memoryData is everything a MemoryStore holds. Values are replaced, never
+// changed in place, so a shallow copy is a snapshot.
+type memoryData struct {
+	users map[uint]memoryUser
+	// users only ever have one session, and one pending password reset,
+	// email change and sign in link, so those are keyed by user ID.
+	sessions       map[uint]Session
+	passwordResets map[int]PasswordReset
+	emailChanges   map[int]EmailChange
+	signInLinks    map[int]SignInLink
+	identities     map[memoryIdentity]uint
+	apiTokens      map[int]APIToken
+	invites        map[int]Invite
+	securityEvents []SecurityEvent
+	preferences    map[memoryPreference]string
+	notifications  []Notification
+	galleries      map[int]memoryGallery
+	shareLinks     map[int]ShareLink
+	impersonations map[int]memoryImpersonation
+	adminActions   []AdminAction
+	outbox         map[int]OutboxMessage
+}
+
+type memoryUser struct {
+	User
+	DeleteAfter *time.Time
+}
+
+type memoryIdentity struct {
+	Provider string
+	Subject  string
+}
+
+type memoryPreference struct {
+	UserID int
+	Event  string
+}
+
+type memoryGallery struct {
+	Gallery
+	InboundToken string
+}
+
+type memoryImpersonation struct {
+	Impersonation
+	EndedAt *time.Time
+}
+
+func (d memoryData) clone() memoryData {
+	return memoryData{
+		users:          maps.Clone(d.users),
+		sessions:       maps.Clone(d.sessions),
+		passwordResets: maps.Clone(d.passwordResets),
+		emailChanges:   maps.Clone(d.emailChanges),
+		signInLinks:    maps.Clone(d.signInLinks),
+		identities:     maps.Clone(d.identities),
+		apiTokens:      maps.Clone(d.apiTokens),
+		invites:        maps.Clone(d.invites),
+		// appending to a clipped slice never writes to the snapshot
+		securityEvents: slices.Clip(d.securityEvents),
+		preferences:    maps.Clone(d.preferences),
+		notifications:  slices.Clip(d.notifications),
+		galleries:      maps.Clone(d.galleries),
+		shareLinks:     maps.Clone(d.shareLinks),
+		impersonations: maps.Clone(d.impersonations),
+		adminActions:   slices.Clip(d.adminActions),
+		outbox:         maps.Clone(d.outbox),
+	}
+}
+
+// lock locks the store and returns its data. Callers have to call unlock once
+// they are done.
+func (store *MemoryStore) lock() *memoryData {
+	store.mu.Lock()
+	if store.data.users == nil {
+		store.data = memoryData{
+			users:          make(map[uint]memoryUser),
+			sessions:       make(map[uint]Session),
+			passwordResets: make(map[int]PasswordReset),
+			emailChanges:   make(map[int]EmailChange),
+			signInLinks:    make(map[int]SignInLink),
+			identities:     make(map[memoryIdentity]uint),
+			apiTokens:      make(map[int]APIToken),
+			invites:        make(map[int]Invite),
+			preferences:    make(map[memoryPreference]string),
+			galleries:      make(map[int]memoryGallery),
+			shareLinks:     make(map[int]ShareLink),
+			impersonations: make(map[int]memoryImpersonation),
+			outbox:         make(map[int]OutboxMessage),
+		}
+	}
+	return &store.data
+}
+
+func (store *MemoryStore) unlock() {
+	store.mu.Unlock()
+}
+
+// nextID returns a new ID. IDs are unique across the whole store. The store
+// has to be locked.
+func (store *MemoryStore) nextID() int {
+	store.lastID++
+	return store.lastID
+}
+
+type memoryTxKey struct{}
+
+// WithTx runs fn like models.WithTx does: if fn fails, every change made to
+// the store while it ran is undone. Called inside another WithTx, fn joins
+// the outer transaction.
+//
+// Transactions are not isolated, so undoing one also undoes the changes that
+// others made concurrently. Tests that run one request at a time don't notice.
+func (store *MemoryStore) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(memoryTxKey{}) == store {
+		return fn(ctx)
+	}
+
+	snapshot := store.lock().clone()
+	store.unlock()
+
+	err := fn(context.WithValue(ctx, memoryTxKey{}, store))
+	if err != nil {
+		store.lock()
+		store.data = snapshot
+		store.unlock()
+		return err
+	}
+	return nil
+}
+
+// userByEmail returns the user with the email address, which has to be lower
+// case. The store has to be locked.
+func (d *memoryData) userByEmail(email string) (memoryUser, bool) {
+	for _, user := range d.users {
+		if user.Email == email {
+			return user, true
+		}
+	}
+	return memoryUser{}, false
+}
+
+// newMemoryToken returns a random token of at least MinSessionTokenBytes
+// bytes.
+func newMemoryToken(bytesPerToken int) (string, error) {
+	if bytesPerToken < MinSessionTokenBytes {
+		bytesPerToken = MinSessionTokenBytes
+	}
+	return rand.String(bytesPerToken)
+}
+
+// hashMemoryToken hashes tokens the way the Postgres services do.
+func hashMemoryToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+// MemorySecurityEventService is the in-memory SecurityEventService.
+type MemorySecurityEventService struct {
+	Store *MemoryStore
+}
+
+func (service *MemorySecurityEventService) Record(ctx context.Context, event SecurityEvent) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	event.ID = service.Store.nextID()
+	event.CreatedAt = time.Now()
+	d.securityEvents = append(d.securityEvents, event)
+	return nil
+}
+
+func (service *MemorySecurityEventService) ByUserID(ctx context.Context, userID int, limit int) ([]SecurityEvent, error) {
+	events, err := service.Search(ctx, SecurityEventFilter{
+		UserID: userID,
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.MemorySecurityEventService.ByUserID: %w", err)
+	}
+	return events, nil
+}
+
+func (service *MemorySecurityEventService) Search(ctx context.Context, filter SecurityEventFilter) ([]SecurityEvent, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 200
+	}
+	email := strings.ToLower(filter.Email)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var events []SecurityEvent
+	// events are appended in order, so walking backwards is newest first
+	for i := len(d.securityEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		event := d.securityEvents[i]
+		switch {
+		case filter.UserID != 0 && (event.UserID == nil || *event.UserID != filter.UserID):
+		case email != "" && !strings.Contains(event.ActorEmail, email):
+		case filter.Event != "" && event.Event != filter.Event:
+		case !filter.Since.IsZero() && event.CreatedAt.Before(filter.Since):
+		case !filter.Until.IsZero() && !event.CreatedAt.Before(filter.Until):
+		default:
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// MemoryAdminAuditService is the in-memory AdminAuditService.
+type MemoryAdminAuditService struct {
+	Store *MemoryStore
+}
+
+func (service *MemoryAdminAuditService) Record(ctx context.Context, admin *User, action string, targetUserID, targetGalleryID *int, details string) error {
+	adminID := int(admin.ID)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	d.adminActions = append(d.adminActions, AdminAction{
+		ID:              service.Store.nextID(),
+		AdminID:         &adminID,
+		AdminEmail:      admin.Email,
+		Action:          action,
+		TargetUserID:    targetUserID,
+		TargetGalleryID: targetGalleryID,
+		Details:         details,
+		CreatedAt:       time.Now(),
+	})
+	return nil
+}
+
+func (service *MemoryAdminAuditService) Recent(ctx context.Context, limit int) ([]AdminAction, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var actions []AdminAction
+	for i := len(d.adminActions) - 1; i >= 0 && len(actions) < limit; i-- {
+		actions = append(actions, d.adminActions[i])
+	}
+	return actions, nil
+}
+
+// MemoryImpersonationService is the in-memory ImpersonationService.
+type MemoryImpersonationService struct {
+	Store *MemoryStore
+}
+
+func (service *MemoryImpersonationService) Start(ctx context.Context, adminID int, userID int) (*Impersonation, error) {
+	token, err := rand.String(MinSessionTokenBytes)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryImpersonationService.Start: %w", err)
+	}
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	impersonation := Impersonation{
+		ID:        service.Store.nextID(),
+		AdminID:   adminID,
+		UserID:    userID,
+		TokenHash: hashMemoryToken(token),
+		StartedAt: time.Now(),
+	}
+	d.impersonations[impersonation.ID] = memoryImpersonation{Impersonation: impersonation}
+
+	impersonation.Token = token
+	return &impersonation, nil
+}
+
+func (service *MemoryImpersonationService) User(ctx context.Context, adminID int, token string) (*User, error) {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for _, impersonation := range d.impersonations {
+		if impersonation.TokenHash != tokenHash || impersonation.AdminID != adminID || impersonation.EndedAt != nil {
+			continue
+		}
+		user, ok := d.users[uint(impersonation.UserID)]
+		if !ok {
+			break
+		}
+		return &User{
+			ID:           user.ID,
+			Email:        user.Email,
+			PasswordHash: user.PasswordHash,
+			Role:         user.Role,
+		}, nil
+	}
+	return nil, fmt.Errorf("models.MemoryImpersonationService.User: %w", ErrNotFound)
+}
+
+func (service *MemoryImpersonationService) Stop(ctx context.Context, token string) error {
+	tokenHash := hashMemoryToken(token)
+	now := time.Now()
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for id, impersonation := range d.impersonations {
+		if impersonation.TokenHash == tokenHash && impersonation.EndedAt == nil {
+			impersonation.EndedAt = &now
+			d.impersonations[id] = impersonation
+		}
+	}
+	return nil
+}
+
+// MemoryEmailOutboxService is the in-memory EmailOutboxService. Nothing
+// delivers its messages, tests queue them to check how they are listed and
+// retried.
+type MemoryEmailOutboxService struct {
+	Store *MemoryStore
+}
+
+func (service *MemoryEmailOutboxService) Queue(ctx context.Context, key string, email Email) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for _, msg := range d.outbox {
+		if msg.IdempotencyKey == key {
+			return nil
+		}
+	}
+	now := time.Now()
+	msg := OutboxMessage{
+		ID:             service.Store.nextID(),
+		IdempotencyKey: key,
+		Email:          email,
+		Status:         OutboxStatusPending,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+	}
+	d.outbox[msg.ID] = msg
+	return nil
+}
+
+func (service *MemoryEmailOutboxService) Messages(ctx context.Context, status string, limit int) ([]OutboxMessage, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var messages []OutboxMessage
+	for _, msg := range d.outbox {
+		if status == "" || msg.Status == status {
+			messages = append(messages, msg)
+		}
+	}
+	slices.SortFunc(messages, func(a, b OutboxMessage) int {
+		return b.ID - a.ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (service *MemoryEmailOutboxService) Retry(ctx context.Context, id int) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	msg, ok := d.outbox[id]
+	if !ok || msg.Status == OutboxStatusSent {
+		return fmt.Errorf("models.MemoryEmailOutboxService.Retry: %w", ErrNotFound)
+	}
+	msg.Status = OutboxStatusPending
+	msg.Attempts = 0
+	msg.NextAttemptAt = time.Now()
+	d.outbox[id] = msg
+	return nil
+}
@@ -0,0 +1,326 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+// MemoryGalleryService is the in-memory GalleryService. Galleries are kept in
+// the store, but their images are still files in ImagesDir, since that is
+// where the GalleryService keeps them as well.
+type MemoryGalleryService struct {
+	Store *MemoryStore
+	// ImagesDir defaults to DefaultImagesDir. Tests should use a temporary
+	// directory.
+	ImagesDir string
+}
+
+// files handles the images of the galleries.
+func (service *MemoryGalleryService) files() *GalleryService {
+	return &GalleryService{ImagesDir: service.ImagesDir}
+}
+
+func (service *MemoryGalleryService) Create(ctx context.Context, title string, userID int) (*Gallery, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	gallery := Gallery{
+		ID:     service.Store.nextID(),
+		Title:  title,
+		UserID: userID,
+	}
+	d.galleries[gallery.ID] = memoryGallery{Gallery: gallery}
+	return &gallery, nil
+}
+
+func (service *MemoryGalleryService) ByID(ctx context.Context, id int) (*Gallery, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	gallery, ok := d.galleries[id]
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryGalleryService.ByID: %w", ErrNotFound)
+	}
+	return &gallery.Gallery, nil
+}
+
+func (service *MemoryGalleryService) ByUserID(ctx context.Context, userID int) ([]Gallery, error) {
+	galleries, err := service.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryGalleryService.ByUserID: %w", err)
+	}
+	return slices.DeleteFunc(galleries, func(gallery Gallery) bool {
+		return gallery.UserID != userID
+	}), nil
+}
+
+func (service *MemoryGalleryService) All(ctx context.Context) ([]Gallery, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var galleries []Gallery
+	for _, gallery := range d.galleries {
+		galleries = append(galleries, gallery.Gallery)
+	}
+	slices.SortFunc(galleries, func(a, b Gallery) int {
+		return a.ID - b.ID
+	})
+	return galleries, nil
+}
+
+func (service *MemoryGalleryService) SetTakenDown(ctx context.Context, id int, takenDown bool) error {
+	var takenDownAt *time.Time
+	if takenDown {
+		now := time.Now()
+		takenDownAt = &now
+	}
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if gallery, ok := d.galleries[id]; ok {
+		gallery.TakenDownAt = takenDownAt
+		d.galleries[id] = gallery
+	}
+	return nil
+}
+
+func (service *MemoryGalleryService) UpdateTitle(ctx context.Context, gallery *Gallery) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if stored, ok := d.galleries[gallery.ID]; ok {
+		stored.Title = gallery.Title
+		d.galleries[gallery.ID] = stored
+	}
+	return nil
+}
+
+func (service *MemoryGalleryService) Delete(ctx context.Context, id int) error {
+	d := service.Store.lock()
+	delete(d.galleries, id)
+	maps.DeleteFunc(d.shareLinks, func(_ int, link ShareLink) bool {
+		return link.GalleryID == id
+	})
+	service.Store.unlock()
+
+	err := service.files().DeleteImages(ctx, id)
+	if err != nil {
+		return fmt.Errorf("models.MemoryGalleryService.Delete: %w", err)
+	}
+	return nil
+}
+
+func (service *MemoryGalleryService) Images(ctx context.Context, galleryID int) ([]Image, error) {
+	return service.files().Images(ctx, galleryID)
+}
+
+func (service *MemoryGalleryService) Image(ctx context.Context, galleryID int, filename string) (Image, error) {
+	return service.files().Image(ctx, galleryID, filename)
+}
+
+func (service *MemoryGalleryService) CreateImage(ctx context.Context, galleryID int, filename string, contents io.Reader) (Image, error) {
+	return service.files().CreateImage(ctx, galleryID, filename, contents)
+}
+
+func (service *MemoryGalleryService) DeleteImage(ctx context.Context, galleryID int, filename string) error {
+	return service.files().DeleteImage(ctx, galleryID, filename)
+}
+
+// MemoryShareLinkService is the in-memory ShareLinkService.
+type MemoryShareLinkService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+}
+
+func (service *MemoryShareLinkService) Create(ctx context.Context, galleryID int, name string) (*ShareLink, error) {
+	token, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryShareLinkService.Create: %w", err)
+	}
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if _, ok := d.galleries[galleryID]; !ok {
+		return nil, fmt.Errorf("models.MemoryShareLinkService.Create: %w", ErrNotFound)
+	}
+	link := ShareLink{
+		ID:        service.Store.nextID(),
+		GalleryID: galleryID,
+		Name:      name,
+		Token:     token,
+		CreatedAt: time.Now(),
+	}
+	d.shareLinks[link.ID] = link
+	return &link, nil
+}
+
+func (service *MemoryShareLinkService) ByGalleryID(ctx context.Context, galleryID int) ([]ShareLink, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var links []ShareLink
+	for _, link := range d.shareLinks {
+		if link.GalleryID == galleryID {
+			links = append(links, link)
+		}
+	}
+	slices.SortFunc(links, func(a, b ShareLink) int {
+		return a.ID - b.ID
+	})
+	return links, nil
+}
+
+func (service *MemoryShareLinkService) ByToken(ctx context.Context, token string) (*ShareLink, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for _, link := range d.shareLinks {
+		if link.Token == token {
+			return &link, nil
+		}
+	}
+	return nil, fmt.Errorf("models.MemoryShareLinkService.ByToken: %w", ErrNotFound)
+}
+
+func (service *MemoryShareLinkService) MarkOpened(ctx context.Context, id int) (bool, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	link, ok := d.shareLinks[id]
+	if !ok || link.FirstOpenedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	link.FirstOpenedAt = &now
+	d.shareLinks[id] = link
+	return true, nil
+}
+
+func (service *MemoryShareLinkService) Delete(ctx context.Context, galleryID int, id int) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	link, ok := d.shareLinks[id]
+	if !ok || link.GalleryID != galleryID {
+		return fmt.Errorf("models.MemoryShareLinkService.Delete: %w", ErrNotFound)
+	}
+	delete(d.shareLinks, id)
+	return nil
+}
+
+// MemoryInboundEmailService is the in-memory InboundEmailService.
+type MemoryInboundEmailService struct {
+	Store          *MemoryStore
+	GalleryService *MemoryGalleryService
+	// Domain defaults to DefaultInboundEmailDomain.
+	Domain string
+}
+
+// addresses formats addresses like the InboundEmailService with the same
+// domain.
+func (service *MemoryInboundEmailService) addresses() *InboundEmailService {
+	return &InboundEmailService{Domain: service.Domain}
+}
+
+func (service *MemoryInboundEmailService) Address(ctx context.Context, galleryID int) (string, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	gallery, ok := d.galleries[galleryID]
+	if !ok {
+		return "", fmt.Errorf("models.MemoryInboundEmailService.Address: %w", ErrNotFound)
+	}
+	if gallery.InboundToken == "" {
+		return "", nil
+	}
+	return service.addresses().address(gallery.InboundToken), nil
+}
+
+func (service *MemoryInboundEmailService) ResetAddress(ctx context.Context, galleryID int) (string, error) {
+	tokenBytes, err := rand.RandBytes(inboundTokenBytes)
+	if err != nil {
+		return "", fmt.Errorf("models.MemoryInboundEmailService.ResetAddress: %w", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	gallery, ok := d.galleries[galleryID]
+	if !ok {
+		return "", fmt.Errorf("models.MemoryInboundEmailService.ResetAddress: %w", ErrNotFound)
+	}
+	gallery.InboundToken = token
+	d.galleries[galleryID] = gallery
+	return service.addresses().address(token), nil
+}
+
+func (service *MemoryInboundEmailService) DisableAddress(ctx context.Context, galleryID int) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if gallery, ok := d.galleries[galleryID]; ok {
+		gallery.InboundToken = ""
+		d.galleries[galleryID] = gallery
+	}
+	return nil
+}
+
+func (service *MemoryInboundEmailService) Receive(ctx context.Context, email *InboundEmail) (*Gallery, []Image, error) {
+	gallery, ownerEmail, err := service.galleryFor(email.To)
+	if err != nil {
+		return nil, nil, fmt.Errorf("models.MemoryInboundEmailService.Receive: %w", err)
+	}
+	if gallery.TakenDownAt != nil {
+		return nil, nil, fmt.Errorf("models.MemoryInboundEmailService.Receive: gallery %d is taken down: %w", gallery.ID, ErrNotFound)
+	}
+	if !strings.EqualFold(email.From, ownerEmail) {
+		return nil, nil, fmt.Errorf("models.MemoryInboundEmailService.Receive: %v: %w", email.From, ErrSenderNotAllowed)
+	}
+
+	existing, err := service.GalleryService.Images(ctx, gallery.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("models.MemoryInboundEmailService.Receive: %w", err)
+	}
+	taken := make(map[string]bool, len(existing))
+	for _, image := range existing {
+		taken[strings.ToLower(image.Filename)] = true
+	}
+
+	var images []Image
+	for _, attachment := range email.Attachments {
+		if !hasImageExtension(attachment.Filename) {
+			continue
+		}
+		filename := uniqueFilename(attachment.Filename, taken)
+		taken[strings.ToLower(filename)] = true
+
+		image, err := service.GalleryService.CreateImage(ctx, gallery.ID, filename, bytes.NewReader(attachment.Data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("models.MemoryInboundEmailService.Receive: %w", err)
+		}
+		images = append(images, image)
+	}
+	if len(images) == 0 {
+		return nil, nil, fmt.Errorf("models.MemoryInboundEmailService.Receive: %w", ErrNoImages)
+	}
+
+	return gallery, images, nil
+}
+
+// galleryFor finds the gallery addressed by one of the recipients, and the
+// email of its owner.
+func (service *MemoryInboundEmailService) galleryFor(recipients []string) (*Gallery, string, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for _, recipient := range recipients {
+		token, ok := InboundToken(recipient, service.addresses().domain())
+		if !ok {
+			continue
+		}
+		for _, gallery := range d.galleries {
+			if gallery.InboundToken == token {
+				return &gallery.Gallery, d.users[uint(gallery.UserID)].Email, nil
+			}
+		}
+	}
+	return nil, "", ErrNotFound
+}
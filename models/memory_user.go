@@ -0,0 +1,1052 @@
+package models
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MemoryUserService is the in-memory UserService.
+type MemoryUserService struct {
+	Store          *MemoryStore
+	PasswordPolicy *PasswordPolicy
+	PasswordHasher PasswordHasher
+}
+
+// passwords checks and hashes passwords exactly like the UserService with the
+// same settings.
+func (us *MemoryUserService) passwords() *UserService {
+	return &UserService{
+		PasswordPolicy: us.PasswordPolicy,
+		PasswordHasher: us.PasswordHasher,
+	}
+}
+
+func (us *MemoryUserService) Create(ctx context.Context, email string, password string) (*User, error) {
+	email = strings.ToLower(email)
+
+	err := us.ValidatePassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryUserService.Create: %w", err)
+	}
+	passwordHash, err := us.passwords().hasher().Hash(password)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryUserService.Create: %w", err)
+	}
+
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	if _, ok := d.userByEmail(email); ok {
+		return nil, ErrEmailToken
+	}
+	user := User{
+		ID:           uint(us.Store.nextID()),
+		Email:        email,
+		PasswordHash: passwordHash,
+		Role:         RoleUser,
+	}
+	d.users[user.ID] = memoryUser{User: user}
+
+	return &user, nil
+}
+
+func (us *MemoryUserService) Authenticate(ctx context.Context, email string, password string) (*User, error) {
+	email = strings.ToLower(email)
+
+	d := us.Store.lock()
+	stored, ok := d.userByEmail(email)
+	us.Store.unlock()
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryUserService.Authenticate: %w", ErrNotFound)
+	}
+	user := User{
+		ID:           stored.ID,
+		Email:        stored.Email,
+		PasswordHash: stored.PasswordHash,
+	}
+
+	passwords := us.passwords()
+	hasher, err := passwords.hasherFor(user.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryUserService.Authenticate: %w", err)
+	}
+	err = hasher.Compare(user.PasswordHash, password)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryUserService.Authenticate: %w", err)
+	}
+
+	current := passwords.hasher()
+	if !current.Handles(user.PasswordHash) || current.Outdated(user.PasswordHash) {
+		err = us.rehash(&user, password)
+		if err != nil {
+			slog.ErrorContext(ctx, "rehashing password", "user_id", user.ID, "err", err)
+		}
+	}
+
+	return &user, nil
+}
+
+func (us *MemoryUserService) rehash(user *User, password string) error {
+	passwordHash, err := us.passwords().hasher().Hash(password)
+	if err != nil {
+		return fmt.Errorf("models.MemoryUserService.rehash: %w", err)
+	}
+
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	stored, ok := d.users[user.ID]
+	if ok && stored.PasswordHash == user.PasswordHash {
+		stored.PasswordHash = passwordHash
+		d.users[user.ID] = stored
+	}
+	user.PasswordHash = passwordHash
+
+	return nil
+}
+
+func (us *MemoryUserService) ValidatePassword(password string) error {
+	return us.passwords().ValidatePassword(password)
+}
+
+func (us *MemoryUserService) UpdatePassword(ctx context.Context, userID int, password string) error {
+	err := us.ValidatePassword(password)
+	if err != nil {
+		return fmt.Errorf("models.MemoryUserService.UpdatePassword: %w", err)
+	}
+	passwordHash, err := us.passwords().hasher().Hash(password)
+	if err != nil {
+		return fmt.Errorf("models.MemoryUserService.UpdatePassword: %w", err)
+	}
+
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	if user, ok := d.users[uint(userID)]; ok {
+		user.PasswordHash = passwordHash
+		d.users[user.ID] = user
+	}
+	return nil
+}
+
+func (us *MemoryUserService) UpdateEmail(ctx context.Context, userID int, email string) error {
+	email = strings.ToLower(email)
+
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	if other, ok := d.userByEmail(email); ok && other.ID != uint(userID) {
+		return ErrEmailToken
+	}
+	if user, ok := d.users[uint(userID)]; ok {
+		user.Email = email
+		d.users[user.ID] = user
+	}
+	return nil
+}
+
+func (us *MemoryUserService) ByID(ctx context.Context, id int) (*User, error) {
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	user, ok := d.users[uint(id)]
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryUserService.ByID: %w", ErrNotFound)
+	}
+	return &user.User, nil
+}
+
+func (us *MemoryUserService) ByEmail(ctx context.Context, email string) (*User, error) {
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	user, ok := d.userByEmail(strings.ToLower(email))
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryUserService.ByEmail: %w", ErrNotFound)
+	}
+	return &user.User, nil
+}
+
+func (us *MemoryUserService) Search(ctx context.Context, query string) ([]User, error) {
+	query = strings.ToLower(query)
+
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	var users []User
+	for _, user := range d.users {
+		if strings.Contains(user.Email, query) {
+			user.PasswordHash = ""
+			users = append(users, user.User)
+		}
+	}
+	slices.SortFunc(users, func(a, b User) int {
+		return int(a.ID) - int(b.ID)
+	})
+	return users, nil
+}
+
+func (us *MemoryUserService) SetDisabled(ctx context.Context, userID int, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	if user, ok := d.users[uint(userID)]; ok {
+		user.DisabledAt = disabledAt
+		d.users[user.ID] = user
+	}
+	return nil
+}
+
+// SetRole changes the role of the user, e.g. to make them an admin.
+func (us *MemoryUserService) SetRole(ctx context.Context, userID int, role string) error {
+	d := us.Store.lock()
+	defer us.Store.unlock()
+	user, ok := d.users[uint(userID)]
+	if !ok {
+		return fmt.Errorf("models.MemoryUserService.SetRole: %w", ErrNotFound)
+	}
+	user.Role = role
+	d.users[user.ID] = user
+	return nil
+}
+
+// MemorySessionService is the in-memory SessionService.
+type MemorySessionService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+}
+
+func (service *MemorySessionService) Create(ctx context.Context, userID uint) (*Session, error) {
+	token, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemorySessionService.Create: %w", err)
+	}
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	user, ok := d.users[userID]
+	if !ok || user.DisabledAt != nil {
+		return nil, fmt.Errorf("models.MemorySessionService.Create: %w", ErrAccountDisabled)
+	}
+
+	session, ok := d.sessions[userID]
+	if !ok {
+		session = Session{
+			ID:     service.Store.nextID(),
+			UserID: userID,
+		}
+	}
+	session.TokenHash = hashMemoryToken(token)
+	d.sessions[userID] = session
+
+	session.Token = token
+	return &session, nil
+}
+
+func (service *MemorySessionService) User(ctx context.Context, token string) (*User, error) {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for _, session := range d.sessions {
+		if session.TokenHash != tokenHash {
+			continue
+		}
+		user, ok := d.users[session.UserID]
+		if !ok || user.DisabledAt != nil {
+			break
+		}
+		return &User{
+			ID:           user.ID,
+			Email:        user.Email,
+			PasswordHash: user.PasswordHash,
+			Role:         user.Role,
+		}, nil
+	}
+	return nil, fmt.Errorf("models.MemorySessionService.User: %w", ErrNotFound)
+}
+
+func (service *MemorySessionService) Delete(ctx context.Context, token string) error {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for userID, session := range d.sessions {
+		if session.TokenHash == tokenHash {
+			delete(d.sessions, userID)
+		}
+	}
+	return nil
+}
+
+func (service *MemorySessionService) ByUserID(ctx context.Context, userID uint) ([]Session, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	session, ok := d.sessions[userID]
+	if !ok {
+		return nil, nil
+	}
+	return []Session{session}, nil
+}
+
+func (service *MemorySessionService) DeleteByUserID(ctx context.Context, userID uint) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	delete(d.sessions, userID)
+	return nil
+}
+
+// MemoryPasswordResetService is the in-memory PasswordResetService.
+type MemoryPasswordResetService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *MemoryPasswordResetService) Create(ctx context.Context, email string, notify func(ctx context.Context, pwReset *PasswordReset) error) (*PasswordReset, error) {
+	email = strings.ToLower(email)
+
+	d := service.Store.lock()
+	user, ok := d.userByEmail(email)
+	service.Store.unlock()
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryPasswordResetService.Create: %w", ErrNotFound)
+	}
+
+	token, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryPasswordResetService.Create: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultResetDuration
+	}
+	pwReset := PasswordReset{
+		UserID:    int(user.ID),
+		Token:     token,
+		TokenHash: hashMemoryToken(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	err = service.Store.WithTx(ctx, func(ctx context.Context) error {
+		d := service.Store.lock()
+		pwReset.ID = service.Store.nextID()
+		stored := pwReset
+		stored.Token = ""
+		d.passwordResets[pwReset.UserID] = stored
+		service.Store.unlock()
+
+		if notify == nil {
+			return nil
+		}
+		return notify(ctx, &pwReset)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryPasswordResetService.Create: %w", err)
+	}
+
+	return &pwReset, nil
+}
+
+func (service *MemoryPasswordResetService) Consume(ctx context.Context, token string) (*User, error) {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for userID, pwReset := range d.passwordResets {
+		if pwReset.TokenHash != tokenHash {
+			continue
+		}
+		if time.Now().After(pwReset.ExpiresAt) {
+			return nil, fmt.Errorf("models.MemoryPasswordResetService.Consume: %w", ErrTokenExpired)
+		}
+		delete(d.passwordResets, userID)
+		user := d.users[uint(userID)]
+		return &User{
+			ID:           user.ID,
+			Email:        user.Email,
+			PasswordHash: user.PasswordHash,
+		}, nil
+	}
+	return nil, fmt.Errorf("models.MemoryPasswordResetService.Consume: %w", ErrNotFound)
+}
+
+// MemoryEmailChangeService is the in-memory EmailChangeService.
+type MemoryEmailChangeService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *MemoryEmailChangeService) Create(ctx context.Context, userID int, newEmail string, notify func(ctx context.Context, emailChange *EmailChange) error) (*EmailChange, error) {
+	token, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryEmailChangeService.Create: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultEmailChangeDuration
+	}
+	emailChange := EmailChange{
+		UserID:    userID,
+		NewEmail:  strings.ToLower(newEmail),
+		Token:     token,
+		TokenHash: hashMemoryToken(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	err = service.Store.WithTx(ctx, func(ctx context.Context) error {
+		d := service.Store.lock()
+		emailChange.ID = service.Store.nextID()
+		stored := emailChange
+		stored.Token = ""
+		d.emailChanges[userID] = stored
+		service.Store.unlock()
+
+		if notify == nil {
+			return nil
+		}
+		return notify(ctx, &emailChange)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryEmailChangeService.Create: %w", err)
+	}
+
+	return &emailChange, nil
+}
+
+func (service *MemoryEmailChangeService) Consume(ctx context.Context, token string) (*EmailChange, error) {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for userID, emailChange := range d.emailChanges {
+		if emailChange.TokenHash != tokenHash {
+			continue
+		}
+		delete(d.emailChanges, userID)
+		if time.Now().After(emailChange.ExpiresAt) {
+			return nil, fmt.Errorf("models.MemoryEmailChangeService.Consume: %w", ErrTokenExpired)
+		}
+		return &emailChange, nil
+	}
+	return nil, fmt.Errorf("models.MemoryEmailChangeService.Consume: %w", ErrNotFound)
+}
+
+// MemorySignInLinkService is the in-memory SignInLinkService.
+type MemorySignInLinkService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+	Duration      time.Duration
+}
+
+func (service *MemorySignInLinkService) Create(ctx context.Context, email string, notify func(ctx context.Context, link *SignInLink) error) (*SignInLink, error) {
+	email = strings.ToLower(email)
+
+	d := service.Store.lock()
+	user, ok := d.userByEmail(email)
+	service.Store.unlock()
+	if !ok {
+		return nil, fmt.Errorf("models.MemorySignInLinkService.Create: %w", ErrNotFound)
+	}
+
+	token, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemorySignInLinkService.Create: %w", err)
+	}
+	nonce, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemorySignInLinkService.Create: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultSignInLinkDuration
+	}
+	link := SignInLink{
+		UserID:    int(user.ID),
+		Token:     token,
+		TokenHash: hashMemoryToken(token),
+		Nonce:     nonce,
+		NonceHash: hashMemoryToken(nonce),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	err = service.Store.WithTx(ctx, func(ctx context.Context) error {
+		d := service.Store.lock()
+		link.ID = service.Store.nextID()
+		stored := link
+		stored.Token = ""
+		stored.Nonce = ""
+		d.signInLinks[link.UserID] = stored
+		service.Store.unlock()
+
+		if notify == nil {
+			return nil
+		}
+		return notify(ctx, &link)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.MemorySignInLinkService.Create: %w", err)
+	}
+
+	return &link, nil
+}
+
+func (service *MemorySignInLinkService) Consume(ctx context.Context, token string, nonce string) (*User, error) {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for userID, link := range d.signInLinks {
+		if link.TokenHash != tokenHash {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(link.NonceHash), []byte(hashMemoryToken(nonce))) != 1 {
+			return nil, fmt.Errorf("models.MemorySignInLinkService.Consume: %w", ErrWrongBrowser)
+		}
+		delete(d.signInLinks, userID)
+		if time.Now().After(link.ExpiresAt) {
+			return nil, fmt.Errorf("models.MemorySignInLinkService.Consume: %w", ErrTokenExpired)
+		}
+		user := d.users[uint(userID)]
+		return &User{
+			ID:           user.ID,
+			Email:        user.Email,
+			PasswordHash: user.PasswordHash,
+		}, nil
+	}
+	return nil, fmt.Errorf("models.MemorySignInLinkService.Consume: %w", ErrNotFound)
+}
+
+// MemoryIdentityService is the in-memory IdentityService.
+type MemoryIdentityService struct {
+	Store *MemoryStore
+}
+
+func (service *MemoryIdentityService) User(ctx context.Context, provider string, claims *OIDCClaims) (*User, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+
+	identity := memoryIdentity{Provider: provider, Subject: claims.Subject}
+	if userID, ok := d.identities[identity]; ok {
+		user := d.users[userID]
+		return &User{
+			ID:           user.ID,
+			Email:        user.Email,
+			PasswordHash: user.PasswordHash,
+		}, nil
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, fmt.Errorf("models.MemoryIdentityService.User: %w", ErrEmailNotVerified)
+	}
+	user, ok := d.userByEmail(strings.ToLower(claims.Email))
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryIdentityService.User: %w", ErrNotFound)
+	}
+	d.identities[identity] = user.ID
+
+	return &User{
+		ID:           user.ID,
+		Email:        user.Email,
+		PasswordHash: user.PasswordHash,
+	}, nil
+}
+
+// MemoryAccountService is the in-memory AccountService.
+type MemoryAccountService struct {
+	Store          *MemoryStore
+	UserService    *MemoryUserService
+	GalleryService *MemoryGalleryService
+	SessionService *MemorySessionService
+	GracePeriod    time.Duration
+}
+
+func (service *MemoryAccountService) Export(ctx context.Context, userID int) (*AccountExport, error) {
+	user, err := service.UserService.ByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+	}
+
+	export := AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Profile: AccountExportProfile{
+			ID:    user.ID,
+			Email: user.Email,
+		},
+		Galleries:      []AccountExportGallery{},
+		Sessions:       []AccountExportSession{},
+		APITokens:      []AccountExportAPIToken{},
+		Identities:     []AccountExportIdentity{},
+		Invites:        []AccountExportInvite{},
+		Notifications:  []AccountExportNotification{},
+		SecurityEvents: []AccountExportSecurityEvent{},
+	}
+
+	d := service.Store.lock()
+	export.Profile.DeletionScheduledAt = d.users[user.ID].DeleteAfter
+	export.Profile.PendingEmail = d.emailChanges[userID].NewEmail
+	service.Store.unlock()
+
+	galleries, err := service.GalleryService.ByUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+	}
+	for _, gallery := range galleries {
+		images, err := service.GalleryService.Images(ctx, gallery.ID)
+		if err != nil {
+			return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+		}
+		exportGallery := AccountExportGallery{
+			ID:         gallery.ID,
+			Title:      gallery.Title,
+			Images:     []AccountExportImage{},
+			ShareLinks: []AccountExportShareLink{},
+		}
+		for _, image := range images {
+			exportGallery.Images = append(exportGallery.Images, AccountExportImage{
+				Filename:   image.Filename,
+				Size:       image.Size,
+				ModifiedAt: image.ModifiedAt,
+			})
+		}
+		links, err := (&MemoryShareLinkService{Store: service.Store}).ByGalleryID(ctx, gallery.ID)
+		if err != nil {
+			return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+		}
+		for _, link := range links {
+			exportGallery.ShareLinks = append(exportGallery.ShareLinks, newAccountExportShareLink(link))
+		}
+		export.Galleries = append(export.Galleries, exportGallery)
+	}
+
+	sessions, err := service.SessionService.ByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+	}
+	for _, session := range sessions {
+		export.Sessions = append(export.Sessions, AccountExportSession{
+			ID: session.ID,
+		})
+	}
+
+	tokens, err := (&MemoryAPITokenService{Store: service.Store}).ByUserID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+	}
+	for _, token := range tokens {
+		export.APITokens = append(export.APITokens, newAccountExportAPIToken(token))
+	}
+
+	invites, err := (&MemoryInviteService{Store: service.Store}).ByInviterID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+	}
+	for _, invite := range invites {
+		export.Invites = append(export.Invites, newAccountExportInvite(invite))
+	}
+
+	export.NotificationPreferences, err = (&MemoryNotificationService{Store: service.Store}).Preferences(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAccountService.Export: %w", err)
+	}
+
+	d = service.Store.lock()
+	defer service.Store.unlock()
+	for identity, identityUserID := range d.identities {
+		if identityUserID == user.ID {
+			export.Identities = append(export.Identities, AccountExportIdentity{
+				Provider: identity.Provider,
+				Subject:  identity.Subject,
+			})
+		}
+	}
+	// identities are not ordered in a map
+	slices.SortFunc(export.Identities, func(a, b AccountExportIdentity) int {
+		return strings.Compare(a.Provider+" "+a.Subject, b.Provider+" "+b.Subject)
+	})
+	for _, n := range d.notifications {
+		if n.UserID == userID {
+			export.Notifications = append(export.Notifications, AccountExportNotification{
+				Event:     n.Event,
+				Message:   n.Message,
+				URL:       n.URL,
+				CreatedAt: n.CreatedAt,
+			})
+		}
+	}
+	for _, event := range d.securityEvents {
+		if event.UserID != nil && *event.UserID == userID {
+			export.SecurityEvents = append(export.SecurityEvents, newAccountExportSecurityEvent(event))
+		}
+	}
+
+	return &export, nil
+}
+
+// WriteArchive writes the same archive as AccountService.WriteArchive, with
+// the originals read from the gallery service's ImagesDir.
+func (service *MemoryAccountService) WriteArchive(ctx context.Context, w io.Writer, export *AccountExport) error {
+	accounts := &AccountService{GalleryService: service.GalleryService.files()}
+	return accounts.WriteArchive(ctx, w, export)
+}
+
+func (service *MemoryAccountService) ScheduledDeletion(ctx context.Context, userID int) (*time.Time, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	user, ok := d.users[uint(userID)]
+	if !ok {
+		return nil, fmt.Errorf("models.MemoryAccountService.ScheduledDeletion: %w", ErrNotFound)
+	}
+	return user.DeleteAfter, nil
+}
+
+func (service *MemoryAccountService) RequestDeletion(ctx context.Context, userID int) (time.Time, error) {
+	gracePeriod := service.GracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = DefaultDeletionGracePeriod
+	}
+	deleteAfter := time.Now().Add(gracePeriod)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if user, ok := d.users[uint(userID)]; ok {
+		user.DeleteAfter = &deleteAfter
+		d.users[user.ID] = user
+	}
+	return deleteAfter, nil
+}
+
+func (service *MemoryAccountService) CancelDeletion(ctx context.Context, userID int) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if user, ok := d.users[uint(userID)]; ok {
+		user.DeleteAfter = nil
+		d.users[user.ID] = user
+	}
+	return nil
+}
+
+// MemoryAPITokenService is the in-memory APITokenService.
+type MemoryAPITokenService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+}
+
+func (service *MemoryAPITokenService) Create(ctx context.Context, userID int, name string, scopes []string, expiresAt *time.Time) (*APIToken, error) {
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, fmt.Errorf("models.MemoryAPITokenService.Create: invalid scope %q", scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("models.MemoryAPITokenService.Create: no scopes")
+	}
+
+	secret, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryAPITokenService.Create: %w", err)
+	}
+	token := APITokenPrefix + secret
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	apiToken := APIToken{
+		ID:        service.Store.nextID(),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    token[:apiTokenVisibleChars],
+		TokenHash: hashMemoryToken(token),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+	d.apiTokens[apiToken.ID] = apiToken
+
+	apiToken.Token = token
+	return &apiToken, nil
+}
+
+func (service *MemoryAPITokenService) ByUserID(ctx context.Context, userID int) ([]APIToken, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var tokens []APIToken
+	for _, token := range d.apiTokens {
+		if token.UserID == userID {
+			token.TokenHash = ""
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b APIToken) int {
+		return a.ID - b.ID
+	})
+	return tokens, nil
+}
+
+func (service *MemoryAPITokenService) User(ctx context.Context, token string) (*User, *APIToken, error) {
+	tokenHash := hashMemoryToken(token)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for id, apiToken := range d.apiTokens {
+		if apiToken.TokenHash != tokenHash {
+			continue
+		}
+		user, ok := d.users[uint(apiToken.UserID)]
+		if !ok || user.DisabledAt != nil {
+			break
+		}
+		if apiToken.Expired() {
+			return nil, nil, fmt.Errorf("models.MemoryAPITokenService.User: %w", ErrTokenExpired)
+		}
+
+		now := time.Now()
+		apiToken.LastUsedAt = &now
+		d.apiTokens[id] = apiToken
+
+		apiToken.TokenHash = ""
+		return &User{
+			ID:           user.ID,
+			Email:        user.Email,
+			PasswordHash: user.PasswordHash,
+			Role:         user.Role,
+		}, &apiToken, nil
+	}
+	return nil, nil, fmt.Errorf("models.MemoryAPITokenService.User: %w", ErrNotFound)
+}
+
+func (service *MemoryAPITokenService) Delete(ctx context.Context, userID int, id int) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if token, ok := d.apiTokens[id]; ok && token.UserID == userID {
+		delete(d.apiTokens, id)
+	}
+	return nil
+}
+
+// MemoryInviteService is the in-memory InviteService.
+type MemoryInviteService struct {
+	Store         *MemoryStore
+	BytesPerToken int
+	Duration      time.Duration
+	Quota         *int
+}
+
+func (service *MemoryInviteService) Create(ctx context.Context, inviter *User, email string, notify func(ctx context.Context, invite *Invite) error) (*Invite, error) {
+	token, err := newMemoryToken(service.BytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryInviteService.Create: %w", err)
+	}
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultInviteDuration
+	}
+	invite := Invite{
+		InviterID: int(inviter.ID),
+		Email:     strings.ToLower(email),
+		Token:     token,
+		TokenHash: hashMemoryToken(token),
+		ExpiresAt: time.Now().Add(duration),
+		CreatedAt: time.Now(),
+	}
+
+	err = service.Store.WithTx(ctx, func(ctx context.Context) error {
+		d := service.Store.lock()
+		// counted and stored under one lock, like the row lock of InviteService
+		if service.remaining(d, inviter) == 0 {
+			service.Store.unlock()
+			return ErrInviteQuotaExceeded
+		}
+		invite.ID = service.Store.nextID()
+		stored := invite
+		stored.Token = ""
+		d.invites[invite.ID] = stored
+		service.Store.unlock()
+
+		if notify == nil {
+			return nil
+		}
+		return notify(ctx, &invite)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.MemoryInviteService.Create: %w", err)
+	}
+
+	return &invite, nil
+}
+
+func (service *MemoryInviteService) Remaining(ctx context.Context, user *User) (int, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	return service.remaining(d, user), nil
+}
+
+// remaining is Remaining with the store locked.
+func (service *MemoryInviteService) remaining(d *memoryData, user *User) int {
+	if user.IsAdmin() {
+		return -1
+	}
+
+	quota := inviteQuota(service.Quota)
+	sent := 0
+	for _, invite := range d.invites {
+		if invite.InviterID == int(user.ID) {
+			sent++
+		}
+	}
+
+	if sent >= quota {
+		return 0
+	}
+	return quota - sent
+}
+
+func (service *MemoryInviteService) ByInviterID(ctx context.Context, inviterID int) ([]Invite, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var invites []Invite
+	for _, invite := range d.invites {
+		if invite.InviterID == inviterID {
+			invite.TokenHash = ""
+			invites = append(invites, invite)
+		}
+	}
+	// newest first
+	slices.SortFunc(invites, func(a, b Invite) int {
+		return b.ID - a.ID
+	})
+	return invites, nil
+}
+
+func (service *MemoryInviteService) Consume(ctx context.Context, token string, email string) (*Invite, error) {
+	tokenHash := hashMemoryToken(token)
+	email = strings.ToLower(email)
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for id, invite := range d.invites {
+		if invite.TokenHash != tokenHash || invite.Email != email || invite.UsedAt != nil || invite.Expired() {
+			continue
+		}
+		now := time.Now()
+		invite.UsedAt = &now
+		d.invites[id] = invite
+		return &invite, nil
+	}
+	return nil, fmt.Errorf("models.MemoryInviteService.Consume: %w", ErrInvalidInvite)
+}
+
+func (service *MemoryInviteService) Release(ctx context.Context, id int) error {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	if invite, ok := d.invites[id]; ok {
+		invite.UsedAt = nil
+		d.invites[id] = invite
+	}
+	return nil
+}
+
+// MemoryNotificationService is the in-memory NotificationService. Tokens are
+// signed with Secret, so they are interchangeable with the ones
+// NotificationService issues with the same secret.
+type MemoryNotificationService struct {
+	Store  *MemoryStore
+	Secret []byte
+}
+
+func (service *MemoryNotificationService) Preferences(ctx context.Context, userID int) (map[string]string, error) {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	prefs := make(map[string]string)
+	for _, event := range NotificationEvents {
+		delivery, ok := d.preferences[memoryPreference{UserID: userID, Event: event}]
+		if !ok {
+			delivery = DefaultDelivery
+		}
+		prefs[event] = delivery
+	}
+	return prefs, nil
+}
+
+func (service *MemoryNotificationService) SetPreference(ctx context.Context, userID int, event string, delivery string) error {
+	if !contains(NotificationEvents, event) {
+		return fmt.Errorf("models.MemoryNotificationService.SetPreference: invalid event %q", event)
+	}
+	if !contains(Deliveries, delivery) {
+		return fmt.Errorf("models.MemoryNotificationService.SetPreference: invalid delivery %q", delivery)
+	}
+
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	d.preferences[memoryPreference{UserID: userID, Event: event}] = delivery
+	return nil
+}
+
+// Notify records the notification unless the user turned the event off or
+// was already notified with the key. It doesn't matter whether they would get
+// it right away or in a digest.
+func (service *MemoryNotificationService) Notify(ctx context.Context, userID int, event string, key string, subject string, message string, link string) error {
+	prefs, err := service.Preferences(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("models.MemoryNotificationService.Notify: %w", err)
+	}
+	if prefs[event] == DeliveryOff {
+		return nil
+	}
+
+	key = notificationKey(userID, event, key)
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	for _, n := range d.notifications {
+		if n.key == key {
+			return nil
+		}
+	}
+	d.notifications = append(d.notifications, Notification{
+		ID:        service.Store.nextID(),
+		UserID:    userID,
+		Event:     event,
+		Message:   message,
+		URL:       link,
+		CreatedAt: time.Now(),
+		key:       key,
+	})
+	return nil
+}
+
+// Notifications returns the notifications the user got, oldest first.
+func (service *MemoryNotificationService) Notifications(userID int) []Notification {
+	d := service.Store.lock()
+	defer service.Store.unlock()
+	var notifications []Notification
+	for _, n := range d.notifications {
+		if n.UserID == userID {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications
+}
+
+func (service *MemoryNotificationService) Unsubscribe(ctx context.Context, token string) error {
+	signer := &NotificationService{Secret: service.Secret}
+	userID, event, err := signer.verifyUnsubscribeToken(token)
+	if err != nil {
+		return fmt.Errorf("models.MemoryNotificationService.Unsubscribe: %w", err)
+	}
+
+	events := []string{event}
+	if event == "" {
+		events = NotificationEvents
+	}
+	for _, event := range events {
+		err = service.SetPreference(ctx, userID, event, DeliveryOff)
+		if err != nil {
+			return fmt.Errorf("models.MemoryNotificationService.Unsubscribe: %w", err)
+		}
+	}
+	return nil
+}
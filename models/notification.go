@@ -0,0 +1,358 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events users can be notified about.
+const (
+	// NotificationImagesAdded is sent when someone else, like an admin acting
+	// as the user, uploads images to a gallery of the user.
+	NotificationImagesAdded = "images_added"
+	// NotificationShareLinkOpened is sent when a share link of a gallery of
+	// the user is opened for the first time.
+	NotificationShareLinkOpened = "share_link_opened"
+)
+
+// NotificationEvents lists every event users can be notified about.
+var NotificationEvents = []string{
+	NotificationImagesAdded,
+	NotificationShareLinkOpened,
+}
+
+// How notifications for an event are delivered.
+const (
+	DeliveryInstant = "instant"
+	DeliveryDigest  = "digest"
+	DeliveryOff     = "off"
+
+	DefaultDelivery = DeliveryInstant
+)
+
+// Deliveries lists every way notifications can be delivered.
+var Deliveries = []string{DeliveryInstant, DeliveryDigest, DeliveryOff}
+
+// Notification is a notification waiting for the next digest.
+type Notification struct {
+	ID        int
+	UserID    int
+	Event     string
+	Message   string
+	URL       string
+	CreatedAt time.Time
+
+	// key is only kept by MemoryNotificationService, to skip duplicates.
+	key string
+}
+
+type NotificationService struct {
+	DB           *sql.DB
+	EmailService *EmailService
+	// Secret signs unsubscribe tokens, so links cannot be forged for other
+	// users.
+	Secret []byte
+}
+
+// Preferences returns how the user wants to receive every event.
+func (service *NotificationService) Preferences(ctx context.Context, userID int) (map[string]string, error) {
+	prefs := make(map[string]string)
+	for _, event := range NotificationEvents {
+		prefs[event] = DefaultDelivery
+	}
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT event, delivery
+		FROM notification_preferences
+		WHERE user_id = $1;`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.NotificationService.Preferences: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event, delivery string
+		err := rows.Scan(&event, &delivery)
+		if err != nil {
+			return nil, fmt.Errorf("models.NotificationService.Preferences: %w", err)
+		}
+		// events can be removed, their rows are left behind
+		if _, ok := prefs[event]; ok {
+			prefs[event] = delivery
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.NotificationService.Preferences: %w", err)
+	}
+
+	return prefs, nil
+}
+
+func (service *NotificationService) SetPreference(ctx context.Context, userID int, event string, delivery string) error {
+	if !contains(NotificationEvents, event) {
+		return fmt.Errorf("models.NotificationService.SetPreference: invalid event %q", event)
+	}
+	if !contains(Deliveries, delivery) {
+		return fmt.Errorf("models.NotificationService.SetPreference: invalid delivery %q", delivery)
+	}
+
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		INSERT INTO notification_preferences (user_id, event, delivery)
+		VALUES ($1, $2, $3) ON CONFLICT (user_id, event) DO
+		UPDATE
+		SET delivery = $3;`,
+		userID, event, delivery,
+	)
+	if err != nil {
+		return fmt.Errorf("models.NotificationService.SetPreference: %w", err)
+	}
+	return nil
+}
+
+// Notify tells the user about the event the way they prefer: right away, in
+// the next digest, or not at all. key identifies what triggered the event, so
+// notifying again about the same change, like a retried request, does nothing.
+// link points to what the event is about and can be empty.
+func (service *NotificationService) Notify(ctx context.Context, userID int, event string, key string, subject string, message string, link string) error {
+	prefs, err := service.Preferences(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("models.NotificationService.Notify: %w", err)
+	}
+
+	key = notificationKey(userID, event, key)
+	switch prefs[event] {
+	case DeliveryOff:
+		return nil
+	case DeliveryDigest:
+		_, err = conn(ctx, service.DB).ExecContext(ctx, `
+			INSERT INTO notifications (user_id, event, message, url, idempotency_key)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (idempotency_key) DO NOTHING;`,
+			userID, event, message, link, key,
+		)
+		if err != nil {
+			return fmt.Errorf("models.NotificationService.Notify: %w", err)
+		}
+		return nil
+	}
+
+	var email string
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `SELECT email FROM users WHERE id = $1;`, userID)
+	err = row.Scan(&email)
+	if err != nil {
+		return fmt.Errorf("models.NotificationService.Notify: %w", err)
+	}
+
+	err = service.EmailService.Notification(ctx, key, email, NotificationEmail{
+		Subject:        subject,
+		Message:        message,
+		URL:            link,
+		UnsubscribeURL: service.unsubscribeURL(userID, event),
+		PreferencesURL: notificationPreferencesURL,
+	})
+	if err != nil {
+		return fmt.Errorf("models.NotificationService.Notify: %w", err)
+	}
+	return nil
+}
+
+// notificationKey scopes the key of the trigger to the user and the event, so
+// one change can notify several users or about several events.
+func notificationKey(userID int, event string, key string) string {
+	return fmt.Sprintf("%d:%s:%s", userID, event, key)
+}
+
+// DigestInterval is the least time between two digests to the same user.
+const DigestInterval = 24 * time.Hour
+
+// SendDigests emails their pending notifications in a single digest to every
+// user whose last digest was sent at least DigestInterval ago, or who never
+// got one and has waited that long for their oldest notification. It returns
+// how many digests were sent. It is meant to run often, so restarts don't
+// delay the digests.
+func (service *NotificationService) SendDigests(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-DigestInterval)
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT notifications.id, notifications.user_id, notifications.event,
+			notifications.message, notifications.url, notifications.created_at,
+			users.email
+		FROM notifications
+			JOIN users ON users.id = notifications.user_id
+		WHERE notifications.digested_at IS NULL
+			AND COALESCE(users.last_digest_at, (
+				SELECT MIN(pending.created_at)
+				FROM notifications pending
+				WHERE pending.user_id = users.id AND pending.digested_at IS NULL
+			)) <= $1
+		ORDER BY notifications.user_id, notifications.id;`,
+		cutoff,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("models.NotificationService.SendDigests: %w", err)
+	}
+	type digest struct {
+		email string
+		items []Notification
+	}
+	var userIDs []int
+	digests := make(map[int]*digest)
+	for rows.Next() {
+		var n Notification
+		var email string
+		err := rows.Scan(&n.ID, &n.UserID, &n.Event, &n.Message, &n.URL, &n.CreatedAt, &email)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("models.NotificationService.SendDigests: %w", err)
+		}
+		if digests[n.UserID] == nil {
+			digests[n.UserID] = &digest{email: email}
+			userIDs = append(userIDs, n.UserID)
+		}
+		digests[n.UserID].items = append(digests[n.UserID].items, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("models.NotificationService.SendDigests: %w", err)
+	}
+
+	sent := 0
+	for _, userID := range userIDs {
+		d := digests[userID]
+		lastID := d.items[len(d.items)-1].ID
+		// the digest is queued in the same transaction that marks its
+		// notifications, so nothing is sent twice or lost
+		queued := false
+		err := WithTx(ctx, service.DB, func(ctx context.Context) error {
+			// another server may have sent the digest since the query above
+			result, err := conn(ctx, service.DB).ExecContext(ctx, `
+				UPDATE users
+				SET last_digest_at = NOW()
+				WHERE id = $1 AND (last_digest_at IS NULL OR last_digest_at <= $2);`,
+				userID, cutoff,
+			)
+			if err != nil {
+				return err
+			}
+			claimed, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if claimed == 0 {
+				return nil
+			}
+
+			_, err = conn(ctx, service.DB).ExecContext(ctx, `
+				UPDATE notifications
+				SET digested_at = NOW()
+				WHERE user_id = $1 AND id <= $2 AND digested_at IS NULL;`,
+				userID, lastID,
+			)
+			if err != nil {
+				return err
+			}
+			queued = true
+			return service.EmailService.Digest(ctx, fmt.Sprintf("%d:%d", userID, lastID), d.email, DigestEmail{
+				Items:          d.items,
+				UnsubscribeURL: service.unsubscribeURL(userID, ""),
+				PreferencesURL: notificationPreferencesURL,
+			})
+		})
+		if err != nil {
+			return sent, fmt.Errorf("models.NotificationService.SendDigests: %w", err)
+		}
+		if queued {
+			sent++
+		}
+	}
+
+	return sent, nil
+}
+
+// Unsubscribe turns off the event the token was issued for. Tokens issued for
+// no event in particular turn off every notification.
+func (service *NotificationService) Unsubscribe(ctx context.Context, token string) error {
+	userID, event, err := service.verifyUnsubscribeToken(token)
+	if err != nil {
+		return fmt.Errorf("models.NotificationService.Unsubscribe: %w", err)
+	}
+
+	events := []string{event}
+	if event == "" {
+		events = NotificationEvents
+	}
+	for _, event := range events {
+		err = service.SetPreference(ctx, userID, event, DeliveryOff)
+		if err != nil {
+			return fmt.Errorf("models.NotificationService.Unsubscribe: %w", err)
+		}
+	}
+	return nil
+}
+
+const notificationPreferencesURL = "https://www.gallery-app.com/users/me/notifications"
+
+func (service *NotificationService) unsubscribeURL(userID int, event string) string {
+	vals := url.Values{
+		"token": {service.unsubscribeToken(userID, event)},
+	}
+	return "https://www.gallery-app.com/unsubscribe?" + vals.Encode()
+}
+
+// unsubscribeToken is "<user id>:<event>" followed by its HMAC. The tokens
+// don't expire, since unsubscribe links have to keep working in old emails.
+func (service *NotificationService) unsubscribeToken(userID int, event string) string {
+	payload := strconv.Itoa(userID) + ":" + event
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + service.sign(payload)
+}
+
+func (service *NotificationService) verifyUnsubscribeToken(token string) (int, string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrNotFound
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, "", ErrNotFound
+	}
+	if !hmac.Equal([]byte(service.sign(string(payload))), []byte(parts[1])) {
+		return 0, "", ErrNotFound
+	}
+
+	fields := strings.SplitN(string(payload), ":", 2)
+	if len(fields) != 2 {
+		return 0, "", ErrNotFound
+	}
+	userID, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, "", ErrNotFound
+	}
+	if fields[1] != "" && !contains(NotificationEvents, fields[1]) {
+		return 0, "", errors.New("unknown notification event")
+	}
+	return userID, fields[1], nil
+}
+
+func (service *NotificationService) sign(payload string) string {
+	mac := hmac.New(sha256.New, service.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUnsubscribeToken(t *testing.T) {
+	service := &NotificationService{Secret: []byte("test secret")}
+
+	for _, event := range []string{NotificationImagesAdded, ""} {
+		token := service.unsubscribeToken(42, event)
+		userID, got, err := service.verifyUnsubscribeToken(token)
+		if err != nil {
+			t.Fatalf("verifyUnsubscribeToken(%q): %v", token, err)
+		}
+		if userID != 42 || got != event {
+			t.Errorf("verifyUnsubscribeToken(%q) = %d, %q, want 42, %q", token, userID, got, event)
+		}
+	}
+}
+
+func TestUnsubscribeTokenInvalid(t *testing.T) {
+	service := &NotificationService{Secret: []byte("test secret")}
+	token := service.unsubscribeToken(42, NotificationImagesAdded)
+	payload, mac, _ := strings.Cut(token, ".")
+	otherUser := base64.RawURLEncoding.EncodeToString([]byte("43:" + NotificationImagesAdded))
+	otherSecret := &NotificationService{Secret: []byte("other secret")}
+
+	tests := map[string]string{
+		"empty":          "",
+		"no mac":         payload,
+		"tampered mac":   payload + "." + strings.ToUpper(mac),
+		"tampered user":  otherUser + "." + mac,
+		"other secret":   otherSecret.unsubscribeToken(42, NotificationImagesAdded),
+		"invalid base64": "!!!." + mac,
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := service.verifyUnsubscribeToken(token)
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("verifyUnsubscribeToken(%q) error = %v, want ErrNotFound", token, err)
+			}
+		})
+	}
+}
+
+func TestUnsubscribeTokenUnknownEvent(t *testing.T) {
+	service := &NotificationService{Secret: []byte("test secret")}
+	// signed, but for an event that was removed since
+	token := service.unsubscribeToken(42, "comments")
+
+	_, _, err := service.verifyUnsubscribeToken(token)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("verifyUnsubscribeToken(%q) error = %v, want an unknown event error", token, err)
+	}
+}
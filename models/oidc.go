@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type OIDCConfig struct {
+	// Name identifies the provider in URLs and in the user_identities table, so
+	// it should not change once users have signed in with it.
+	Name         string
+	DisplayName  string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	// Scopes requested in addition to openid. Defaults to email and profile.
+	Scopes []string
+}
+
+// OIDCClaims are the claims of a verified ID token that we use to link the
+// identity to a user.
+type OIDCClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Nonce         string `json:"nonce"`
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against a single
+// OpenID Connect provider.
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCProvider fetches the discovery document of the issuer, so the issuer
+// has to be reachable when this is called.
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("models.NewOIDCProvider %s: %w", config.Name, err)
+	}
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+
+	displayName := config.DisplayName
+	if displayName == "" {
+		displayName = config.Name
+	}
+
+	return &OIDCProvider{
+		Name:        config.Name,
+		DisplayName: displayName,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+// AuthCodeURL returns the URL to send the user to. The caller has to keep the
+// state, the nonce and the PKCE verifier to check them in the callback.
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange trades the authorization code for tokens and verifies the ID token
+// signature, issuer, audience, expiry and nonce.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce, verifier string) (*OIDCClaims, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("models.OIDCProvider.Exchange: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("models.OIDCProvider.Exchange: no id_token in token response")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.OIDCProvider.Exchange: %w", err)
+	}
+
+	var claims OIDCClaims
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("models.OIDCProvider.Exchange: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("models.OIDCProvider.Exchange: nonce mismatch")
+	}
+
+	return &claims, nil
+}
+
+// IdentityService links users to the accounts they have at external identity
+// providers.
+type IdentityService struct {
+	DB *sql.DB
+}
+
+// User returns the user linked to the identity. Identities are linked the
+// first time they are used, to the user with the same email address, and only
+// if the provider verified that email address.
+func (service *IdentityService) User(ctx context.Context, provider string, claims *OIDCClaims) (*User, error) {
+	var user User
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT users.id, users.email, users.password_hash
+		FROM user_identities
+			JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2;`,
+		provider, claims.Subject,
+	)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("models.IdentityService.User: %w", err)
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, fmt.Errorf("models.IdentityService.User: %w", ErrEmailNotVerified)
+	}
+
+	user.Email = strings.ToLower(claims.Email)
+	row = conn(ctx, service.DB).QueryRowContext(ctx, `SELECT id, password_hash FROM users WHERE email = $1;`, user.Email)
+	err = row.Scan(&user.ID, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.IdentityService.User: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.IdentityService.User: %w", err)
+	}
+
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
+		INSERT INTO user_identities (user_id, provider, subject)
+		VALUES ($1, $2, $3);`,
+		user.ID, provider, claims.Subject,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.IdentityService.User: %w", err)
+	}
+
+	return &user, nil
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is a minimal OpenID Connect provider. It hands out authorization
+// codes for the parameters of an auth code URL and checks the PKCE verifier
+// when the code is exchanged.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &mockIssuer{
+		key:   key,
+		codes: make(map[string]mockAuthorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/keys", issuer.keys)
+	mux.HandleFunc("/token", issuer.token)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (issuer *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer.URL,
+		"authorization_endpoint":                issuer.URL + "/authorize",
+		"token_endpoint":                        issuer.URL + "/token",
+		"jwks_uri":                              issuer.URL + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (issuer *mockIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(issuer.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (issuer *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	issuer.mu.Lock()
+	auth, ok := issuer.codes[r.FormValue("code")]
+	delete(issuer.codes, r.FormValue("code"))
+	issuer.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != auth.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+	}
+	claims := map[string]interface{}{
+		"iss":   issuer.URL,
+		"aud":   clientID,
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": auth.nonce,
+	}
+	for k, v := range auth.claims {
+		claims[k] = v
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     issuer.sign(claims),
+	})
+}
+
+// authorize plays the part of the user signing in at the provider and returns
+// the code the provider would redirect back with.
+func (issuer *mockIssuer) authorize(t *testing.T, authCodeURL string, claims map[string]interface{}) string {
+	t.Helper()
+	u, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if got := query.Get("code_challenge_method"); got != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", got)
+	}
+
+	code := "code-" + query.Get("state")
+	issuer.mu.Lock()
+	issuer.codes[code] = mockAuthorization{
+		challenge: query.Get("code_challenge"),
+		nonce:     query.Get("nonce"),
+		claims:    claims,
+	}
+	issuer.mu.Unlock()
+	return code
+}
+
+func (issuer *mockIssuer) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestOIDCProvider(t *testing.T, issuer *mockIssuer) *OIDCProvider {
+	t.Helper()
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Name:         "mock",
+		IssuerURL:    issuer.URL,
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		RedirectURL:  "http://localhost:3000/oauth/mock/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(t, issuer)
+
+	authCodeURL := provider.AuthCodeURL("state", "nonce", "verifier-verifier-verifier-verifier-verifier")
+	if !strings.HasPrefix(authCodeURL, issuer.URL+"/authorize?") {
+		t.Fatalf("AuthCodeURL() = %q, want the issuer's authorization endpoint", authCodeURL)
+	}
+	code := issuer.authorize(t, authCodeURL, map[string]interface{}{
+		"sub":            "subject-1",
+		"email":          "Jon@Example.com",
+		"email_verified": true,
+	})
+
+	claims, err := provider.Exchange(context.Background(), code, "nonce", "verifier-verifier-verifier-verifier-verifier")
+	if err != nil {
+		t.Fatalf("Exchange() err = %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "Jon@Example.com" || !claims.EmailVerified {
+		t.Errorf("Exchange() claims = %+v", claims)
+	}
+}
+
+func TestOIDCProviderExchangeWrongVerifier(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(t, issuer)
+
+	authCodeURL := provider.AuthCodeURL("state", "nonce", "verifier-verifier-verifier-verifier-verifier")
+	code := issuer.authorize(t, authCodeURL, map[string]interface{}{"sub": "subject-1"})
+
+	_, err := provider.Exchange(context.Background(), code, "nonce", "another-verifier-another-verifier-another")
+	if err == nil {
+		t.Fatal("Exchange() with the wrong PKCE verifier succeeded")
+	}
+}
+
+func TestOIDCProviderExchangeWrongNonce(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(t, issuer)
+
+	authCodeURL := provider.AuthCodeURL("state", "nonce", "verifier-verifier-verifier-verifier-verifier")
+	code := issuer.authorize(t, authCodeURL, map[string]interface{}{"sub": "subject-1"})
+
+	_, err := provider.Exchange(context.Background(), code, "other-nonce", "verifier-verifier-verifier-verifier-verifier")
+	if err == nil {
+		t.Fatal("Exchange() with the wrong nonce succeeded")
+	}
+}
+
+func TestOIDCProviderExchangeWrongIssuer(t *testing.T) {
+	issuer := newMockIssuer(t)
+	provider := newTestOIDCProvider(t, issuer)
+
+	authCodeURL := provider.AuthCodeURL("state", "nonce", "verifier-verifier-verifier-verifier-verifier")
+	code := issuer.authorize(t, authCodeURL, map[string]interface{}{
+		"sub": "subject-1",
+		"iss": "https://evil.example.com",
+	})
+
+	_, err := provider.Exchange(context.Background(), code, "nonce", "verifier-verifier-verifier-verifier-verifier")
+	if err == nil {
+		t.Fatal("Exchange() of an ID token from another issuer succeeded")
+	}
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"github.com/taherk/galleryapp/errors"
+)
+
+const (
+	DefaultMinPasswordLength = 8
+	// bcrypt ignores everything after the first 72 bytes of a password, so
+	// longer passwords are rejected instead of being silently truncated.
+	MaxPasswordBytes = 72
+
+	// length of the hash prefix a breached password range is looked up by
+	breachedPrefixLength = 5
+)
+
+// PasswordPolicy decides which passwords users are allowed to use.
+type PasswordPolicy struct {
+	// minimum number of characters. Defaults to DefaultMinPasswordLength
+	MinLength int
+	// passwords that appear in this corpus are rejected. The check is skipped
+	// when it is nil.
+	Breached *BreachedPasswords
+}
+
+// Validate returns an errors.Public error explaining why the password is not
+// allowed, or nil if it is.
+func (policy *PasswordPolicy) Validate(password string) error {
+	minLength := policy.MinLength
+	if minLength <= 0 {
+		minLength = DefaultMinPasswordLength
+	}
+
+	if len([]rune(password)) < minLength {
+		return errors.Public(ErrPasswordTooShort,
+			fmt.Sprintf("Your password must be at least %d characters long", minLength))
+	}
+	if len(password) > MaxPasswordBytes {
+		return errors.Public(ErrPasswordTooLong,
+			fmt.Sprintf("Your password must be at most %d bytes long", MaxPasswordBytes))
+	}
+	if policy.Breached != nil && policy.Breached.Contains(password) {
+		return errors.Public(ErrPasswordBreached,
+			"That password has appeared in a data breach, please choose a different one")
+	}
+
+	return nil
+}
+
+// BreachedPasswords is a locally stored corpus of breached password hashes.
+// Hashes are grouped by their first characters like the k-anonymity range
+// API of Pwned Passwords, so lookups only ever deal with a hash prefix and
+// the suffixes in its range.
+type BreachedPasswords struct {
+	// hash prefix -> hash suffixes in that range
+	ranges map[string]map[string]bool
+}
+
+// LoadBreachedPasswords reads a corpus in the format of the Pwned Passwords
+// k-anonymity range API: one file per hash prefix, named "<PREFIX>.txt", in
+// the root of fsys. Every line of a file is the rest of a SHA-1 hash and how
+// often it was breached, "<SUFFIX>:<COUNT>". Blank lines are ignored.
+func LoadBreachedPasswords(fsys fs.FS) (*BreachedPasswords, error) {
+	bp := BreachedPasswords{
+		ranges: make(map[string]map[string]bool),
+	}
+
+	names, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("models.LoadBreachedPasswords: %w", err)
+	}
+	for _, name := range names {
+		prefix := strings.ToUpper(strings.TrimSuffix(name, ".txt"))
+		if !isHex(prefix, breachedPrefixLength) {
+			return nil, fmt.Errorf("models.LoadBreachedPasswords: %v is not named after a hash prefix", name)
+		}
+		suffixes, err := readBreachedRange(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("models.LoadBreachedPasswords: %w", err)
+		}
+		bp.ranges[prefix] = suffixes
+	}
+
+	return &bp, nil
+}
+
+func readBreachedRange(fsys fs.FS, name string) (map[string]bool, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	suffixes := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		suffix, count, ok := strings.Cut(line, ":")
+		suffix = strings.ToUpper(suffix)
+		if !ok || !isHex(suffix, sha1.Size*2-breachedPrefixLength) {
+			return nil, fmt.Errorf("%v: invalid hash suffix on line %d", name, lineNum)
+		}
+		if _, err := strconv.ParseUint(count, 10, 64); err != nil {
+			return nil, fmt.Errorf("%v: invalid count on line %d", name, lineNum)
+		}
+		suffixes[suffix] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return suffixes, nil
+}
+
+// isHex reports whether s has length upper case hex digits.
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether the password is in the corpus.
+func (bp *BreachedPasswords) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return bp.Range(hash[:breachedPrefixLength])[hash[breachedPrefixLength:]]
+}
+
+// Range returns the hash suffixes of every breached password whose hash
+// starts with prefix.
+func (bp *BreachedPasswords) Range(prefix string) map[string]bool {
+	return bp.ranges[strings.ToUpper(prefix)]
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
@@ -34,13 +35,16 @@ type PasswordResetService struct {
 	Duration time.Duration
 }
 
-func (service *PasswordResetService) Create(email string) (*PasswordReset, error) {
+// Create issues a password reset for the user with the email address. notify
+// is called in the same transaction, e.g. to queue the email with the reset
+// link, and the reset is only stored if it succeeds. notify can be nil.
+func (service *PasswordResetService) Create(ctx context.Context, email string, notify func(ctx context.Context, pwReset *PasswordReset) error) (*PasswordReset, error) {
 
 	// verify we have a valid email and get user's id
 	email = strings.ToLower(email)
 
 	var userID int
-	row := service.DB.QueryRow(`SELECT id from users WHERE email = $1;`, email)
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `SELECT id from users WHERE email = $1;`, email)
 	err := row.Scan(&userID)
 	if err != nil {
 		return nil, fmt.Errorf("models.passwordResetService.Create: %w", err)
@@ -70,17 +74,21 @@ func (service *PasswordResetService) Create(email string) (*PasswordReset, error
 	}
 
 	// insert the password reset into the db
-	row = service.DB.QueryRow(`
-		INSERT INTO password_resets (user_id, token_hash, expires_at)
-		VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
-		UPDATE
-		SET token_hash = $2, expires_at = $3
-		RETURNING id;`,
-		pwReset.UserID, pwReset.TokenHash, pwReset.ExpiresAt,
-	)
-
-	err = row.Scan(&pwReset.ID)
-
+	err = WithTx(ctx, service.DB, func(ctx context.Context) error {
+		row := conn(ctx, service.DB).QueryRowContext(ctx, `
+			INSERT INTO password_resets (user_id, token_hash, expires_at)
+			VALUES ($1, $2, $3) ON CONFLICT (user_id) DO
+			UPDATE
+			SET token_hash = $2, expires_at = $3
+			RETURNING id;`,
+			pwReset.UserID, pwReset.TokenHash, pwReset.ExpiresAt,
+		)
+		err := row.Scan(&pwReset.ID)
+		if err != nil || notify == nil {
+			return err
+		}
+		return notify(ctx, &pwReset)
+	})
 	if err != nil {
 		return nil, fmt.Errorf("models.passwordResetService.Create: %w", err)
 	}
@@ -88,12 +96,12 @@ func (service *PasswordResetService) Create(email string) (*PasswordReset, error
 	return &pwReset, nil
 }
 
-func (service *PasswordResetService) Consume(token string) (*User, error) {
+func (service *PasswordResetService) Consume(ctx context.Context, token string) (*User, error) {
 	tokenHash := service.hash(token)
 	var user User
 	var pwReset PasswordReset
 
-	row := service.DB.QueryRow(`
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
 		SELECT password_resets.id,
 			password_resets.expires_at,
 			users.id,
@@ -101,7 +109,8 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 			users.password_hash
 		FROM password_resets
 			JOIN users ON users.id = password_resets.user_id
-		WHERE password_resets.token_hash = $1;`,
+		WHERE password_resets.token_hash = $1
+		FOR UPDATE OF password_resets;`,
 		tokenHash,
 	)
 	err := row.Scan(&pwReset.ID, &pwReset.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
@@ -112,7 +121,7 @@ func (service *PasswordResetService) Consume(token string) (*User, error) {
 		return nil, fmt.Errorf("token expired: %v", token)
 	}
 
-	err = service.delete(pwReset.ID)
+	err = service.delete(ctx, pwReset.ID)
 	if err != nil {
 		return nil, fmt.Errorf("models.PasswordResetService.Consume: %w", err)
 	}
@@ -125,8 +134,8 @@ func (service *PasswordResetService) hash(token string) string {
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
 }
 
-func (service *PasswordResetService) delete(id int) error {
-	_, err := service.DB.Exec(`
+func (service *PasswordResetService) delete(ctx context.Context, id int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
 	DELETE FROM password_resets
 	WHERE id = $1;
 	`, id)
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/taherk/galleryapp/passwords"
+)
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8, ranges
+	// are served with CRLF line endings
+	fsys := fstest.MapFS{
+		"5BAA6.txt": {Data: []byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:10434004\r\n")},
+		"5baa7.txt": {Data: []byte("\n0000000000000000000000000000000000A:1\n")},
+		"README.md": {Data: []byte("not a range")},
+	}
+	bp, err := LoadBreachedPasswords(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bp.Contains("password") {
+		t.Errorf("Contains(%q) = false, want true", "password")
+	}
+	if bp.Contains("correct horse battery") {
+		t.Errorf("Contains(%q) = true, want false", "correct horse battery")
+	}
+	if got := bp.Range("5baa7"); len(got) != 1 || !got["0000000000000000000000000000000000A"] {
+		t.Errorf("Range(%q) = %v, want the suffix of the lower case file", "5baa7", got)
+	}
+}
+
+func TestLoadBreachedPasswordsInvalid(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"file not named after a prefix": {"5BAA.txt": {Data: []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:1\n")}},
+		"file named after a non hex":    {"5BAAX.txt": {Data: []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:1\n")}},
+		"full hash instead of suffix":   {"5BAA6.txt": {Data: []byte("5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:1\n")}},
+		"no count":                      {"5BAA6.txt": {Data: []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8\n")}},
+		"invalid count":                 {"5BAA6.txt": {Data: []byte("1E4C9B93F3F0682250B6CF8331B7EE68FD8:many\n")}},
+		"non hex suffix":                {"5BAA6.txt": {Data: []byte("1E4C9B93F3F0682250B6CF8331B7EE68FDX:1\n")}},
+	}
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadBreachedPasswords(fsys)
+			if err == nil {
+				t.Errorf("LoadBreachedPasswords() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestBundledBreachedPasswords(t *testing.T) {
+	bp, err := LoadBreachedPasswords(passwords.Breached)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range []string{"password", "123456"} {
+		if !bp.Contains(password) {
+			t.Errorf("Contains(%q) = false, want the bundled corpus to have it", password)
+		}
+	}
+
+	policy := PasswordPolicy{Breached: bp}
+	err = policy.Validate("password")
+	if err == nil || !strings.Contains(err.Error(), ErrPasswordBreached.Error()) {
+		t.Errorf("Validate(%q) = %v, want %v", "password", err, ErrPasswordBreached)
+	}
+}
@@ -0,0 +1,114 @@
+// Package pgtest gives tests their own Postgres database, so they can run
+// against the real schema without stepping on each other or on a development
+// database.
+//
+// The server is the one from docker-compose.yml unless the PSQL_HOST,
+// PSQL_PORT, PSQL_USER, PSQL_PASSWORD and PSQL_SSLMODE environment variables
+// say otherwise. Tests are skipped when it is not running, or fail instead
+// when PGTEST_REQUIRED is set, so CI does not pass by skipping everything.
+package pgtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/taherk/galleryapp/migrations"
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/rand"
+)
+
+var (
+	serverOnce sync.Once
+	server     *sql.DB
+	serverErr  error
+)
+
+// Config returns the config of the Postgres server, with the maintenance
+// database that new databases are created from.
+func Config() models.PostgresConfig {
+	cfg := models.DefaultPostgresConfig()
+	for env, value := range map[string]*string{
+		"PSQL_HOST":     &cfg.Host,
+		"PSQL_PORT":     &cfg.Port,
+		"PSQL_USER":     &cfg.User,
+		"PSQL_PASSWORD": &cfg.Password,
+		"PSQL_SSLMODE":  &cfg.SSLMode,
+	} {
+		if v, ok := os.LookupEnv(env); ok {
+			*value = v
+		}
+	}
+	return cfg
+}
+
+// connect opens the connection to the maintenance database once, and reports
+// whether the server is reachable at all.
+func connect() (*sql.DB, error) {
+	serverOnce.Do(func() {
+		server, serverErr = models.Open(Config())
+		if serverErr != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		serverErr = server.PingContext(ctx)
+	})
+	return server, serverErr
+}
+
+// Empty returns a connection to a new database without any tables. The
+// database is dropped when the test finishes.
+func Empty(t testing.TB) *sql.DB {
+	t.Helper()
+	server, err := connect()
+	if err != nil {
+		if os.Getenv("PGTEST_REQUIRED") != "" {
+			t.Fatalf("pgtest: postgres is not available: %v", err)
+		}
+		t.Skipf("pgtest: postgres is not available: %v", err)
+	}
+
+	suffix, err := rand.RandBytes(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fmt.Sprintf("gallery_test_%x", suffix)
+	ctx := context.Background()
+	// identifiers can't be query parameters, name is safe to format in
+	_, err = server.ExecContext(ctx, "CREATE DATABASE "+name)
+	if err != nil {
+		t.Fatalf("pgtest: creating database: %v", err)
+	}
+
+	cfg := Config()
+	cfg.Database = name
+	db, err := models.Open(cfg)
+	if err != nil {
+		t.Fatalf("pgtest: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		_, err := server.ExecContext(ctx, "DROP DATABASE IF EXISTS "+name+" WITH (FORCE)")
+		if err != nil {
+			t.Errorf("pgtest: dropping database %s: %v", name, err)
+		}
+	})
+	return db
+}
+
+// New returns a connection to a new database with every migration applied.
+// The database is dropped when the test finishes.
+func New(t testing.TB) *sql.DB {
+	t.Helper()
+	db := Empty(t)
+	err := models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatalf("pgtest: %v", err)
+	}
+	return db
+}
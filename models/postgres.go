@@ -1,9 +1,12 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/fs"
+	"path"
+	"strings"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/pressly/goose/v3"
@@ -66,3 +69,113 @@ func MigrateFS(db *sql.DB, migrationFS fs.FS, dir string) error {
 	}()
 	return Migrate(db, dir)
 }
+
+// LatestMigration returns the version of the newest migration in dir of
+// migrationFS, i.e. the version the database is at after MigrateFS.
+func LatestMigration(migrationFS fs.FS, dir string) (int64, error) {
+	files, err := fs.Glob(migrationFS, path.Join(dir, "*.sql"))
+	if err != nil {
+		return 0, fmt.Errorf("models.postgres.LatestMigration: %w", err)
+	}
+	var latest int64
+	for _, file := range files {
+		version, err := goose.NumericComponent(file)
+		if err != nil {
+			return 0, fmt.Errorf("models.postgres.LatestMigration: %w", err)
+		}
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest, nil
+}
+
+// CheckMigrations returns an error unless the database is migrated to
+// version.
+func CheckMigrations(ctx context.Context, db *sql.DB, version int64) error {
+	var current int64
+	row := db.QueryRowContext(ctx, `
+		SELECT version_id FROM goose_db_version
+		WHERE is_applied
+		ORDER BY id DESC
+		LIMIT 1;`)
+	err := row.Scan(&current)
+	if err != nil {
+		return fmt.Errorf("models.postgres.CheckMigrations: %w", err)
+	}
+	if current != version {
+		return fmt.Errorf("models.postgres.CheckMigrations: database is at version %d, want %d", current, version)
+	}
+	return nil
+}
+
+type txKey struct{}
+
+// WithTx runs fn in a transaction, which is committed if fn succeeds and
+// rolled back otherwise. Service methods called with the ctx passed to fn run
+// in the transaction, so several services can make one atomic change:
+//
+//	err := models.WithTx(ctx, db, func(ctx context.Context) error {
+//		user, err := pwResetService.Consume(ctx, token)
+//		if err != nil {
+//			return err
+//		}
+//		return userService.UpdatePassword(ctx, int(user.ID), password)
+//	})
+//
+// Called inside another WithTx, fn joins the outer transaction.
+func WithTx(ctx context.Context, db *sql.DB, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("models.WithTx: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = fn(context.WithValue(ctx, txKey{}, tx))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("models.WithTx: %w", err)
+	}
+	return nil
+}
+
+// Transactor runs transactions on DB for callers that don't know which
+// backend they use, see MemoryStore.WithTx for the in-memory one.
+type Transactor struct {
+	DB *sql.DB
+}
+
+func (t Transactor) WithTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	return WithTx(ctx, t.DB, fn)
+}
+
+// dbConn is implemented by both *sql.DB and *sql.Tx.
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn returns the transaction of WithTx if ctx has one, and db otherwise.
+func conn(ctx context.Context, db *sql.DB) dbConn {
+	if tx, ok := ctx.Value(txKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return db
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns, for queries that use
+// ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// containsPattern returns a LIKE pattern that matches values containing s.
+func containsPattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
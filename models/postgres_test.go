@@ -0,0 +1,677 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/taherk/galleryapp/models"
+	"github.com/taherk/galleryapp/models/pgtest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct horse battery"
+
+func newUserService(t *testing.T) *models.UserService {
+	t.Helper()
+	return &models.UserService{
+		DB:             pgtest.New(t),
+		PasswordHasher: &models.BcryptHasher{Cost: bcrypt.MinCost},
+	}
+}
+
+func createUser(t *testing.T, us *models.UserService, email string) *models.User {
+	t.Helper()
+	user, err := us.Create(context.Background(), email, testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestPostgresUserService(t *testing.T) {
+	us := newUserService(t)
+	ctx := context.Background()
+	user := createUser(t, us, "Alice@Example.com")
+
+	_, err := us.Create(ctx, "alice@EXAMPLE.com", testPassword)
+	if !errors.Is(err, models.ErrEmailToken) {
+		t.Errorf("creating a user with a taken email: err = %v, want %v", err, models.ErrEmailToken)
+	}
+
+	got, err := us.Authenticate(ctx, "ALICE@example.com", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID || got.Email != "alice@example.com" {
+		t.Errorf("Authenticate() = %+v, want user %d with the lower case email", got, user.ID)
+	}
+	_, err = us.Authenticate(ctx, "alice@example.com", "wrong password")
+	if err == nil {
+		t.Errorf("authenticated with the wrong password")
+	}
+
+	err = us.UpdateEmail(ctx, int(user.ID), "alice@new.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = us.ByID(ctx, int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "alice@new.example.com" || got.Role != models.RoleUser {
+		t.Errorf("ByID() = %+v, want the new email and role %q", got, models.RoleUser)
+	}
+
+	_, err = us.ByID(ctx, int(user.ID)+1)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ByID() of a missing user: err = %v, want %v", err, models.ErrNotFound)
+	}
+
+	err = us.SetRole(ctx, int(user.ID), models.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = us.ByEmail(ctx, "Alice@New.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID || !got.IsAdmin() {
+		t.Errorf("ByEmail() = %+v, want user %d as an admin", got, user.ID)
+	}
+	_, err = us.ByEmail(ctx, "alice@example.com")
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ByEmail() of the old email: err = %v, want %v", err, models.ErrNotFound)
+	}
+	err = us.SetRole(ctx, int(user.ID)+1, models.RoleAdmin)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("SetRole() of a missing user: err = %v, want %v", err, models.ErrNotFound)
+	}
+}
+
+func TestPostgresSessionService(t *testing.T) {
+	us := newUserService(t)
+	ss := &models.SessionService{DB: us.DB}
+	ctx := context.Background()
+	user := createUser(t, us, "alice@example.com")
+
+	first, err := ss.Create(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ss.User(ctx, first.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("User() = %+v, want user %d", got, user.ID)
+	}
+
+	// a user has one session, signing in again replaces it
+	second, err := ss.Create(ctx, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ss.User(ctx, first.Token)
+	if err == nil {
+		t.Errorf("the replaced session still works")
+	}
+
+	err = us.SetDisabled(ctx, int(user.ID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ss.User(ctx, second.Token)
+	if err == nil {
+		t.Errorf("the session of a disabled user still works")
+	}
+	_, err = ss.Create(ctx, user.ID)
+	if !errors.Is(err, models.ErrAccountDisabled) {
+		t.Errorf("creating a session for a disabled user: err = %v, want %v", err, models.ErrAccountDisabled)
+	}
+
+	err = us.SetDisabled(ctx, int(user.ID), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ss.Delete(ctx, second.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ss.User(ctx, second.Token)
+	if err == nil {
+		t.Errorf("the deleted session still works")
+	}
+}
+
+func TestPostgresSessionServicePrune(t *testing.T) {
+	us := newUserService(t)
+	ss := &models.SessionService{DB: us.DB}
+	ctx := context.Background()
+	alice := createUser(t, us, "alice@example.com")
+	bob := createUser(t, us, "bob@example.com")
+
+	for _, user := range []*models.User{alice, bob} {
+		_, err := ss.Create(ctx, user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := us.SetDisabled(ctx, int(bob.ID), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := ss.Prune(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("Prune() = %d, want only the session of the disabled user", pruned)
+	}
+	pruned, err = ss.Prune(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Errorf("Prune() = %d, want the session created before the cutoff", pruned)
+	}
+}
+
+func TestPostgresGalleryService(t *testing.T) {
+	us := newUserService(t)
+	gs := &models.GalleryService{DB: us.DB, ImagesDir: t.TempDir()}
+	ctx := context.Background()
+	alice := createUser(t, us, "alice@example.com")
+	bob := createUser(t, us, "bob@example.com")
+
+	holidays, err := gs.Create(ctx, "Holidays", int(alice.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pets, err := gs.Create(ctx, "Pets", int(alice.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gs.Create(ctx, "Bob's", int(bob.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holidays.Title = "Summer"
+	err = gs.UpdateTitle(ctx, holidays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{holidays.ID: "Summer", pets.ID: "Pets"}
+	galleries, err := gs.ByUserID(ctx, int(alice.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != len(want) {
+		t.Fatalf("ByUserID() = %+v, want the galleries %v", galleries, want)
+	}
+	for _, gallery := range galleries {
+		if gallery.Title != want[gallery.ID] {
+			t.Errorf("title of gallery %d = %q, want %q", gallery.ID, gallery.Title, want[gallery.ID])
+		}
+	}
+
+	err = gs.SetTakenDown(ctx, pets.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gs.ByID(ctx, pets.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TakenDownAt == nil {
+		t.Errorf("gallery %d is not taken down", pets.ID)
+	}
+
+	err = gs.Transfer(ctx, pets.ID, int(bob.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = gs.ByID(ctx, pets.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != int(bob.ID) {
+		t.Errorf("owner of the transferred gallery = %d, want %d", got.UserID, bob.ID)
+	}
+	err = gs.Transfer(ctx, pets.ID+1000, int(bob.ID))
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Transfer() of a missing gallery: err = %v, want %v", err, models.ErrNotFound)
+	}
+
+	_, err = gs.CreateImage(ctx, holidays.ID, "beach.png", strings.NewReader("png data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := gs.StoredGalleryIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != holidays.ID {
+		t.Errorf("StoredGalleryIDs() = %v, want [%d]", ids, holidays.ID)
+	}
+	err = gs.Delete(ctx, holidays.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gs.ByID(ctx, holidays.ID)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ByID() of a deleted gallery: err = %v, want %v", err, models.ErrNotFound)
+	}
+	ids, err = gs.StoredGalleryIDs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("StoredGalleryIDs() = %v, the images of the deleted gallery are left", ids)
+	}
+}
+
+func TestPostgresPasswordResetService(t *testing.T) {
+	us := newUserService(t)
+	prs := &models.PasswordResetService{DB: us.DB}
+	ctx := context.Background()
+	user := createUser(t, us, "alice@example.com")
+
+	// a reset that could not be sent is not kept
+	notifyErr := errors.New("mail server is down")
+	unsent, err := prs.Create(ctx, "alice@example.com", func(ctx context.Context, pwReset *models.PasswordReset) error {
+		return notifyErr
+	})
+	if !errors.Is(err, notifyErr) {
+		t.Fatalf("Create() = %+v, %v, want the notify error", unsent, err)
+	}
+
+	var sent *models.PasswordReset
+	pwReset, err := prs.Create(ctx, "Alice@example.com", func(ctx context.Context, pwReset *models.PasswordReset) error {
+		sent = pwReset
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent == nil || sent.Token != pwReset.Token {
+		t.Errorf("notify got %+v, want the created reset", sent)
+	}
+
+	got, err := prs.Consume(ctx, pwReset.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("Consume() = %+v, want user %d", got, user.ID)
+	}
+	_, err = prs.Consume(ctx, pwReset.Token)
+	if err == nil {
+		t.Errorf("the reset token was consumed twice")
+	}
+}
+
+func TestPostgresWithTx(t *testing.T) {
+	us := newUserService(t)
+	gs := &models.GalleryService{DB: us.DB, ImagesDir: t.TempDir()}
+	ctx := context.Background()
+	user := createUser(t, us, "alice@example.com")
+
+	rollback := errors.New("rollback")
+	err := models.WithTx(ctx, us.DB, func(ctx context.Context) error {
+		_, err := us.Create(ctx, "bob@example.com", testPassword)
+		if err != nil {
+			return err
+		}
+		// joins the outer transaction instead of committing on its own
+		return models.WithTx(ctx, us.DB, func(ctx context.Context) error {
+			_, err := gs.Create(ctx, "Holidays", int(user.ID))
+			if err != nil {
+				return err
+			}
+			return rollback
+		})
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("WithTx() err = %v, want %v", err, rollback)
+	}
+
+	_, err = us.Authenticate(ctx, "bob@example.com", testPassword)
+	if err == nil {
+		t.Errorf("the user created in the rolled back transaction exists")
+	}
+	galleries, err := gs.ByUserID(ctx, int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 0 {
+		t.Errorf("galleries = %+v, created in the rolled back transaction", galleries)
+	}
+
+	err = models.WithTx(ctx, us.DB, func(ctx context.Context) error {
+		_, err := gs.Create(ctx, "Holidays", int(user.ID))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	galleries, err = gs.ByUserID(ctx, int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(galleries) != 1 {
+		t.Errorf("galleries = %+v, want the committed one", galleries)
+	}
+}
+
+func TestPostgresEmailOutboxDeliver(t *testing.T) {
+	outbox := &models.EmailOutboxService{DB: pgtest.New(t)}
+	ctx := context.Background()
+	for _, to := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		err := outbox.Queue(ctx, to, models.Email{To: to, Subject: "Hello", Plaintext: "Your token is abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the mail server rejects bob, the others are sent and not sent again
+	var attempts []string
+	send := func(ctx context.Context, email models.Email) error {
+		attempts = append(attempts, email.To)
+		if email.To == "bob@example.com" {
+			return errors.New("mailbox unavailable")
+		}
+		return nil
+	}
+	sent, err := outbox.Deliver(ctx, send, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || len(attempts) != 3 {
+		t.Errorf("Deliver() = %d after %v, want 2 sent of 3 attempts", sent, attempts)
+	}
+
+	// bob is claimed but not due yet, so nothing is attempted
+	attempts = nil
+	sent, err = outbox.Deliver(ctx, send, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 || len(attempts) != 0 {
+		t.Errorf("Deliver() = %d after %v, want no attempts before the backoff", sent, attempts)
+	}
+
+	messages, err := outbox.Messages(ctx, models.OutboxStatusPending, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Email.To != "bob@example.com" {
+		t.Fatalf("pending messages = %+v, want bob's", messages)
+	}
+	if messages[0].Attempts != 1 || messages[0].LastError != "mailbox unavailable" {
+		t.Errorf("bob's message = %+v, want one attempt with the error", messages[0])
+	}
+
+	// a retried message starts over, and dies after its last attempt
+	outbox.MaxAttempts = 1
+	err = outbox.Retry(ctx, messages[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = outbox.Deliver(ctx, send, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err = outbox.Messages(ctx, models.OutboxStatusDead, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 1 || messages[0].Email.To != "bob@example.com" {
+		t.Errorf("dead messages = %+v, want bob's", messages)
+	}
+
+	// sent messages don't keep the tokens in their bodies
+	messages, err = outbox.Messages(ctx, models.OutboxStatusSent, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		if msg.Email.Plaintext != "" || msg.Email.HTML != "" {
+			t.Errorf("sent message %d kept its body %q", msg.ID, msg.Email.Plaintext)
+		}
+	}
+
+	purged, err := outbox.Purge(ctx, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 3 {
+		t.Errorf("Purge() = %d, want the 2 sent and 1 dead message", purged)
+	}
+}
+
+func TestPostgresInviteQuota(t *testing.T) {
+	us := newUserService(t)
+	ctx := context.Background()
+	inviter := createUser(t, us, "alice@example.com")
+	quota := 2
+	is := &models.InviteService{DB: us.DB, Quota: &quota}
+
+	// concurrent invites cannot exceed the quota together
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			_, err := is.Create(ctx, inviter, fmt.Sprintf("friend%d@example.com", i), nil)
+			errs <- err
+		}(i)
+	}
+	created := 0
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, models.ErrInviteQuotaExceeded):
+			t.Errorf("Create() err = %v, want %v", err, models.ErrInviteQuotaExceeded)
+		}
+	}
+	if created != quota {
+		t.Errorf("created %d invites, want the quota of %d", created, quota)
+	}
+
+	quota = 0
+	_, err := is.Create(ctx, createUser(t, us, "bob@example.com"), "friend@example.com", nil)
+	if !errors.Is(err, models.ErrInviteQuotaExceeded) {
+		t.Errorf("Create() with a quota of 0: err = %v, want %v", err, models.ErrInviteQuotaExceeded)
+	}
+}
+
+func TestPostgresSearchEscapesWildcards(t *testing.T) {
+	us := newUserService(t)
+	ses := &models.SecurityEventService{DB: us.DB}
+	ctx := context.Background()
+	for _, email := range []string{"a_b@example.com", "axb@example.com", "100%@example.com", `back\slash@example.com`} {
+		createUser(t, us, email)
+		err := ses.Record(ctx, models.SecurityEvent{Event: models.SecurityEventSignInFailed, ActorEmail: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := map[string]string{
+		"a_b": "a_b@example.com",
+		"%":   "100%@example.com",
+		`\s`:  `back\slash@example.com`,
+	}
+	for query, want := range tests {
+		users, err := us.Search(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(users) != 1 || users[0].Email != want {
+			t.Errorf("UserService.Search(%q) = %+v, want only %s", query, users, want)
+		}
+
+		events, err := ses.Search(ctx, models.SecurityEventFilter{Email: query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].ActorEmail != want {
+			t.Errorf("SecurityEventService.Search(%q) = %+v, want only the event of %s", query, events, want)
+		}
+	}
+}
+
+func TestPostgresNotifyOnce(t *testing.T) {
+	us := newUserService(t)
+	ctx := context.Background()
+	alice := createUser(t, us, "alice@example.com")
+	bob := createUser(t, us, "bob@example.com")
+
+	es, err := models.NewEmailService(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.Outbox = &models.EmailOutboxService{DB: us.DB}
+	ns := &models.NotificationService{DB: us.DB, EmailService: es, Secret: []byte("test secret")}
+	err = ns.SetPreference(ctx, int(bob.ID), models.NotificationImagesAdded, models.DeliveryDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a retried request notifies with the same key again
+	for _, user := range []*models.User{alice, alice, bob, bob} {
+		err := ns.Notify(ctx, int(user.ID), models.NotificationImagesAdded, "gallery:1:abc", "New images", "photo.png was added", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var emails, digested int
+	err = us.DB.QueryRow(`SELECT COUNT(*) FROM email_outbox WHERE to_address = $1;`, alice.Email).Scan(&emails)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = us.DB.QueryRow(`SELECT COUNT(*) FROM notifications WHERE user_id = $1;`, bob.ID).Scan(&digested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if emails != 1 || digested != 1 {
+		t.Errorf("queued %d emails and %d digest notifications, want one each", emails, digested)
+	}
+}
+
+func TestPostgresShareLinkService(t *testing.T) {
+	us := newUserService(t)
+	gs := &models.GalleryService{DB: us.DB, ImagesDir: t.TempDir()}
+	sls := &models.ShareLinkService{DB: us.DB}
+	ctx := context.Background()
+	user := createUser(t, us, "alice@example.com")
+	gallery, err := gs.Create(ctx, "Holidays", int(user.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := sls.Create(ctx, gallery.ID, "Grandma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		first, err := sls.MarkOpened(ctx, link.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != want {
+			t.Errorf("MarkOpened() #%d = %v, want %v", i+1, first, want)
+		}
+	}
+	opened, err := sls.ByToken(ctx, link.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened.ID != link.ID || opened.FirstOpenedAt == nil {
+		t.Errorf("ByToken() = %+v, want the opened link", opened)
+	}
+
+	err = sls.Delete(ctx, gallery.ID+1, link.ID)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("Delete() of another gallery err = %v, want %v", err, models.ErrNotFound)
+	}
+	err = gs.Delete(ctx, gallery.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sls.ByToken(ctx, link.Token)
+	if !errors.Is(err, models.ErrNotFound) {
+		t.Errorf("ByToken() after deleting the gallery err = %v, want %v", err, models.ErrNotFound)
+	}
+}
+
+func TestPostgresAccountServiceExport(t *testing.T) {
+	us := newUserService(t)
+	gs := &models.GalleryService{DB: us.DB, ImagesDir: t.TempDir()}
+	accounts := &models.AccountService{
+		DB:             us.DB,
+		UserService:    us,
+		GalleryService: gs,
+		SessionService: &models.SessionService{DB: us.DB},
+	}
+	ctx := context.Background()
+	user := createUser(t, us, "alice@example.com")
+	userID := int(user.ID)
+
+	gallery, err := gs.Create(ctx, "Holidays", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&models.ShareLinkService{DB: us.DB}).Create(ctx, gallery.ID, "Grandma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&models.APITokenService{DB: us.DB}).Create(ctx, userID, "backup", []string{models.ScopeGalleriesRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&models.InviteService{DB: us.DB}).Create(ctx, user, "bob@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = us.DB.Exec(`INSERT INTO user_identities (user_id, provider, subject) VALUES ($1, 'google', '123');`, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &models.NotificationService{DB: us.DB}
+	err = ns.SetPreference(ctx, userID, models.NotificationShareLinkOpened, models.DeliveryDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ns.Notify(ctx, userID, models.NotificationShareLinkOpened, "share_link:1", "Holidays was opened", "The share link was opened.", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&models.SecurityEventService{DB: us.DB}).Record(ctx, models.SecurityEvent{Event: models.SecurityEventSignIn, UserID: &userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	export, err := accounts.Export(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Galleries) != 1 || len(export.Galleries[0].ShareLinks) != 1 {
+		t.Errorf("galleries = %+v, want Holidays with its share link", export.Galleries)
+	}
+	if len(export.APITokens) != 1 || len(export.Invites) != 1 || len(export.Identities) != 1 {
+		t.Errorf("api tokens = %+v, invites = %+v, identities = %+v, want one each", export.APITokens, export.Invites, export.Identities)
+	}
+	if export.NotificationPreferences[models.NotificationShareLinkOpened] != models.DeliveryDigest || len(export.Notifications) != 1 {
+		t.Errorf("notification preferences = %v, notifications = %+v, want the digest and its notification", export.NotificationPreferences, export.Notifications)
+	}
+	if len(export.SecurityEvents) != 1 || export.SecurityEvents[0].Event != models.SecurityEventSignIn {
+		t.Errorf("security events = %+v, want the sign in", export.SecurityEvents)
+	}
+}
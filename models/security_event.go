@@ -0,0 +1,169 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Security events are recorded for sign ins, account changes, galleries and
+// the use of their share links.
+const (
+	SecurityEventSignIn                 = "sign_in"
+	SecurityEventSignInFailed           = "sign_in_failed"
+	SecurityEventSignOut                = "sign_out"
+	SecurityEventPasswordResetRequested = "password_reset_requested"
+	SecurityEventPasswordReset          = "password_reset"
+	SecurityEventPasswordChanged        = "password_changed"
+	SecurityEventSessionsRevoked        = "sessions_revoked"
+	SecurityEventGalleryCreated         = "gallery_created"
+	SecurityEventGalleryUpdated         = "gallery_updated"
+	SecurityEventGalleryDeleted         = "gallery_deleted"
+	SecurityEventShareLinkUsed          = "share_link_used"
+)
+
+// SecurityEvents lists every kind of security event, e.g. for filters.
+var SecurityEvents = []string{
+	SecurityEventSignIn,
+	SecurityEventSignInFailed,
+	SecurityEventSignOut,
+	SecurityEventPasswordResetRequested,
+	SecurityEventPasswordReset,
+	SecurityEventPasswordChanged,
+	SecurityEventSessionsRevoked,
+	SecurityEventGalleryCreated,
+	SecurityEventGalleryUpdated,
+	SecurityEventGalleryDeleted,
+	SecurityEventShareLinkUsed,
+}
+
+// SecurityEvent is an entry of the security audit trail.
+type SecurityEvent struct {
+	ID    int
+	Event string
+	// UserID is the account the event happened to. It is nil for failed sign
+	// ins with an unknown email address.
+	UserID *int
+	// ActorID is who caused the event. It differs from UserID when an admin
+	// acts on someone else's account.
+	ActorID *int
+	// ActorEmail is kept even if the actor's account is deleted. For failed
+	// sign ins it is the email address that was tried.
+	ActorEmail string
+	GalleryID  *int
+	IP         string
+	UserAgent  string
+	RequestID  string
+	Details    string
+	CreatedAt  time.Time
+}
+
+// SecurityEventFilter narrows down SecurityEventService.Search. Zero values
+// don't filter.
+type SecurityEventFilter struct {
+	UserID int
+	// matches part of the actor's email address
+	Email string
+	Event string
+	Since time.Time
+	Until time.Time
+	// Defaults to 200
+	Limit int
+}
+
+// SecurityEventService records the security audit trail. Entries can only be
+// added, the database rejects updates and deletes.
+type SecurityEventService struct {
+	DB *sql.DB
+}
+
+func (service *SecurityEventService) Record(ctx context.Context, event SecurityEvent) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+		INSERT INTO security_events (event, user_id, actor_id, actor_email, gallery_id, ip, user_agent, request_id, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9);`,
+		event.Event, event.UserID, event.ActorID, event.ActorEmail, event.GalleryID,
+		event.IP, event.UserAgent, event.RequestID, event.Details,
+	)
+	if err != nil {
+		return fmt.Errorf("models.SecurityEventService.Record: %w", err)
+	}
+	return nil
+}
+
+// ByUserID returns the latest events of the user's account, newest first.
+func (service *SecurityEventService) ByUserID(ctx context.Context, userID int, limit int) ([]SecurityEvent, error) {
+	events, err := service.Search(ctx, SecurityEventFilter{
+		UserID: userID,
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.SecurityEventService.ByUserID: %w", err)
+	}
+	return events, nil
+}
+
+// Search returns the events matching the filter, newest first.
+func (service *SecurityEventService) Search(ctx context.Context, filter SecurityEventFilter) ([]SecurityEvent, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.UserID != 0 {
+		where("user_id = $%d", filter.UserID)
+	}
+	if filter.Email != "" {
+		where(`actor_email LIKE $%d ESCAPE '\'`, containsPattern(strings.ToLower(filter.Email)))
+	}
+	if filter.Event != "" {
+		where("event = $%d", filter.Event)
+	}
+	if !filter.Since.IsZero() {
+		where("created_at >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("created_at < $%d", filter.Until)
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 200
+	}
+
+	query := `
+		SELECT id, event, user_id, actor_id, actor_email, gallery_id, ip, user_agent, request_id, details, created_at
+		FROM security_events`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf("\n\t\tORDER BY id DESC\n\t\tLIMIT $%d;", len(args))
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("models.SecurityEventService.Search: %w", err)
+	}
+	defer rows.Close()
+
+	var events []SecurityEvent
+	for rows.Next() {
+		var event SecurityEvent
+		var userID, actorID, galleryID sql.NullInt64
+		err := rows.Scan(&event.ID, &event.Event, &userID, &actorID, &event.ActorEmail, &galleryID,
+			&event.IP, &event.UserAgent, &event.RequestID, &event.Details, &event.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.SecurityEventService.Search: %w", err)
+		}
+		event.UserID = nullIntPtr(userID)
+		event.ActorID = nullIntPtr(actorID)
+		event.GalleryID = nullIntPtr(galleryID)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.SecurityEventService.Search: %w", err)
+	}
+
+	return events, nil
+}
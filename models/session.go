@@ -1,10 +1,13 @@
 package models
 
 import (
+	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/taherk/galleryapp/rand"
 )
@@ -34,7 +37,10 @@ func (service *SessionService) hash(token string) string {
 	return base64.URLEncoding.EncodeToString(tokenHash[:])
 }
 
-func (service *SessionService) Create(userID uint) (*Session, error) {
+func (service *SessionService) Create(ctx context.Context, userID uint) (_ *Session, err error) {
+	ctx, span := startQuerySpan(ctx, "SessionService.Create")
+	defer endSpan(span, &err)
+
 	bytesPerToken := service.BytesPerToken
 	if bytesPerToken < MinSessionTokenBytes {
 		bytesPerToken = MinSessionTokenBytes
@@ -53,11 +59,13 @@ func (service *SessionService) Create(userID uint) (*Session, error) {
 		TokenHash: tokenHash,
 	}
 
-	row := service.DB.QueryRow(`
+	// disabled users cannot sign in, so no session is created for them
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
 		INSERT INTO sessions (user_id, token_hash)
-		VALUES ($1, $2) ON CONFLICT (user_id) DO
+		SELECT id, $2 FROM users WHERE id = $1 AND disabled_at IS NULL
+		ON CONFLICT (user_id) DO
 		UPDATE
-		SET token_hash = $2
+		SET token_hash = $2, created_at = now()
 		RETURNING id;`,
 		userID, tokenHash,
 	)
@@ -65,28 +73,33 @@ func (service *SessionService) Create(userID uint) (*Session, error) {
 	err = row.Scan(&session.ID)
 
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.session.create: %w", ErrAccountDisabled)
+		}
 		return nil, fmt.Errorf("models.session.create: %w", err)
 	}
 
 	return &session, nil
 }
 
-func (service *SessionService) User(token string) (*User, error) {
+func (service *SessionService) User(ctx context.Context, token string) (_ *User, err error) {
+	ctx, span := startQuerySpan(ctx, "SessionService.User")
+	defer endSpan(span, &err)
 
 	// hash the session token
 	tokenHash := service.hash(token)
 
 	// query that session with the hash
-	row := service.DB.QueryRow(`
-		SELECT users.id, users.email, users.password_hash
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT users.id, users.email, users.password_hash, users.role
 		FROM sessions
 		JOIN users ON users.id = sessions.user_id
-		WHERE sessions.token_hash=$1;`,
+		WHERE sessions.token_hash=$1 AND users.disabled_at IS NULL;`,
 		tokenHash,
 	)
 
 	var user User
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err = row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role)
 	if err != nil {
 		return nil, fmt.Errorf("models.session.user: %w", err)
 	}
@@ -94,10 +107,13 @@ func (service *SessionService) User(token string) (*User, error) {
 	return &user, nil
 }
 
-func (service *SessionService) Delete(token string) error {
+func (service *SessionService) Delete(ctx context.Context, token string) (err error) {
+	ctx, span := startQuerySpan(ctx, "SessionService.Delete")
+	defer endSpan(span, &err)
+
 	tokenHash := service.hash(token)
 
-	_, err := service.DB.Exec(`
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
 		DELETE FROM sessions
 		WHERE token_hash=$1;
 	`, tokenHash)
@@ -107,3 +123,75 @@ func (service *SessionService) Delete(token string) error {
 
 	return nil
 }
+
+func (service *SessionService) ByUserID(ctx context.Context, userID uint) (_ []Session, err error) {
+	ctx, span := startQuerySpan(ctx, "SessionService.ByUserID")
+	defer endSpan(span, &err)
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, token_hash
+		FROM sessions
+		WHERE user_id = $1;`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.session.ByUserID: %w", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session := Session{
+			UserID: userID,
+		}
+		err := rows.Scan(&session.ID, &session.TokenHash)
+		if err != nil {
+			return nil, fmt.Errorf("models.session.ByUserID: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.session.ByUserID: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// DeleteByUserID signs the user out everywhere.
+func (service *SessionService) DeleteByUserID(ctx context.Context, userID uint) (err error) {
+	ctx, span := startQuerySpan(ctx, "SessionService.DeleteByUserID")
+	defer endSpan(span, &err)
+
+	_, err = conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE user_id = $1;
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("models.session.DeleteByUserID: %w", err)
+	}
+
+	return nil
+}
+
+// Prune deletes the sessions created before the cutoff, and those of disabled
+// users, and returns how many it deleted.
+func (service *SessionService) Prune(ctx context.Context, cutoff time.Time) (_ int64, err error) {
+	ctx, span := startQuerySpan(ctx, "SessionService.Prune")
+	defer endSpan(span, &err)
+
+	result, err := conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM sessions
+		WHERE created_at < $1
+			OR user_id IS NULL
+			OR user_id IN (SELECT id FROM users WHERE disabled_at IS NOT NULL);
+	`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("models.session.Prune: %w", err)
+	}
+	pruned, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("models.session.Prune: %w", err)
+	}
+
+	return pruned, nil
+}
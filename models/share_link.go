@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+// ShareLink is a link the owner of a gallery sends to people, so they can
+// tell who looked at the gallery and turn the link off again.
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	// Name tells the links of a gallery apart, e.g. who it was sent to.
+	Name string
+	// Token is kept as is rather than hashed, so the owner can copy the link
+	// again. It only leads to the gallery, which anyone can look at.
+	Token     string
+	CreatedAt time.Time
+	// FirstOpenedAt is nil until someone other than the owner opens the
+	// link.
+	FirstOpenedAt *time.Time
+}
+
+type ShareLinkService struct {
+	DB *sql.DB
+	// how many bytes to use when generating each token. If this value is not
+	// set or is less than the MinSessionTokenBytes const it will be ignored
+	// and MinSessionTokenBytes will be used.
+	BytesPerToken int
+}
+
+func (service *ShareLinkService) Create(ctx context.Context, galleryID int, name string) (_ *ShareLink, err error) {
+	ctx, span := startQuerySpan(ctx, "ShareLinkService.Create")
+	defer endSpan(span, &err)
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinSessionTokenBytes {
+		bytesPerToken = MinSessionTokenBytes
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.ShareLinkService.Create: %w", err)
+	}
+
+	link := ShareLink{
+		GalleryID: galleryID,
+		Name:      name,
+		Token:     token,
+	}
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		INSERT INTO share_links (gallery_id, name, token)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at;`,
+		link.GalleryID, link.Name, link.Token,
+	)
+	err = row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("models.ShareLinkService.Create: %w", err)
+	}
+
+	return &link, nil
+}
+
+// ByGalleryID returns the share links of the gallery, oldest first.
+func (service *ShareLinkService) ByGalleryID(ctx context.Context, galleryID int) (_ []ShareLink, err error) {
+	ctx, span := startQuerySpan(ctx, "ShareLinkService.ByGalleryID")
+	defer endSpan(span, &err)
+
+	rows, err := conn(ctx, service.DB).QueryContext(ctx, `
+		SELECT id, gallery_id, name, token, created_at, first_opened_at
+		FROM share_links
+		WHERE gallery_id = $1
+		ORDER BY id;`, galleryID)
+	if err != nil {
+		return nil, fmt.Errorf("models.ShareLinkService.ByGalleryID: %w", err)
+	}
+	defer rows.Close()
+
+	var links []ShareLink
+	for rows.Next() {
+		var link ShareLink
+		err := rows.Scan(&link.ID, &link.GalleryID, &link.Name, &link.Token, &link.CreatedAt, &link.FirstOpenedAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.ShareLinkService.ByGalleryID: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.ShareLinkService.ByGalleryID: %w", err)
+	}
+	return links, nil
+}
+
+// ByToken returns the share link of the token.
+func (service *ShareLinkService) ByToken(ctx context.Context, token string) (_ *ShareLink, err error) {
+	ctx, span := startQuerySpan(ctx, "ShareLinkService.ByToken")
+	defer endSpan(span, &err)
+
+	var link ShareLink
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT id, gallery_id, name, token, created_at, first_opened_at
+		FROM share_links
+		WHERE token = $1;`, token)
+	err = row.Scan(&link.ID, &link.GalleryID, &link.Name, &link.Token, &link.CreatedAt, &link.FirstOpenedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.ShareLinkService.ByToken: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.ShareLinkService.ByToken: %w", err)
+	}
+	return &link, nil
+}
+
+// MarkOpened records that the share link was opened. It returns true only
+// the very first time, even if the link is opened several times at once.
+func (service *ShareLinkService) MarkOpened(ctx context.Context, id int) (_ bool, err error) {
+	ctx, span := startQuerySpan(ctx, "ShareLinkService.MarkOpened")
+	defer endSpan(span, &err)
+
+	// concurrent updates wait for each other and only the first one matches
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		UPDATE share_links
+		SET first_opened_at = NOW()
+		WHERE id = $1 AND first_opened_at IS NULL;`, id)
+	if err != nil {
+		return false, fmt.Errorf("models.ShareLinkService.MarkOpened: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("models.ShareLinkService.MarkOpened: %w", err)
+	}
+	return n == 1, nil
+}
+
+// Delete turns the share link of the gallery off.
+func (service *ShareLinkService) Delete(ctx context.Context, galleryID int, id int) (err error) {
+	ctx, span := startQuerySpan(ctx, "ShareLinkService.Delete")
+	defer endSpan(span, &err)
+
+	res, err := conn(ctx, service.DB).ExecContext(ctx, `
+		DELETE FROM share_links
+		WHERE id = $1 AND gallery_id = $2;`, id, galleryID)
+	if err != nil {
+		return fmt.Errorf("models.ShareLinkService.Delete: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("models.ShareLinkService.Delete: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("models.ShareLinkService.Delete: %w", ErrNotFound)
+	}
+	return nil
+}
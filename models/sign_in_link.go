@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/taherk/galleryapp/rand"
+)
+
+const (
+	DefaultSignInLinkDuration = 15 * time.Minute
+)
+
+// SignInLink is a one-time token that signs a user in without a password. The
+// link is bound to the browser that requested it with a nonce, which is stored
+// in a cookie and has to be presented together with the token.
+type SignInLink struct {
+	ID     int
+	UserID int
+	// token and nonce are only set when a SignInLink is being created
+	Token     string
+	TokenHash string
+	Nonce     string
+	NonceHash string
+	ExpiresAt time.Time
+}
+
+type SignInLinkService struct {
+	DB *sql.DB
+	// how many bytes to use when generating each token and nonce. If this value is
+	// not set or is less than the MinSessionTokenBytes const it will be ignored and
+	// MinSessionTokenBytes will be used.
+	BytesPerToken int
+	// sign in link expiration duration. Defaults to DefaultSignInLinkDuration
+	Duration time.Duration
+}
+
+// Create issues a sign in link for the user with the email address. Requesting
+// a new link replaces any link the user has not used yet. notify is called in
+// the same transaction, e.g. to queue the email with the link. It can be nil.
+func (service *SignInLinkService) Create(ctx context.Context, email string, notify func(ctx context.Context, link *SignInLink) error) (*SignInLink, error) {
+	email = strings.ToLower(email)
+
+	var userID int
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `SELECT id FROM users WHERE email = $1;`, email)
+	err := row.Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.SignInLinkService.Create: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.SignInLinkService.Create: %w", err)
+	}
+
+	bytesPerToken := service.BytesPerToken
+	if bytesPerToken < MinSessionTokenBytes {
+		bytesPerToken = MinSessionTokenBytes
+	}
+	token, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.SignInLinkService.Create: %w", err)
+	}
+	nonce, err := rand.String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("models.SignInLinkService.Create: %w", err)
+	}
+
+	duration := service.Duration
+	if duration == 0 {
+		duration = DefaultSignInLinkDuration
+	}
+
+	link := SignInLink{
+		UserID:    userID,
+		Token:     token,
+		TokenHash: service.hash(token),
+		Nonce:     nonce,
+		NonceHash: service.hash(nonce),
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	err = WithTx(ctx, service.DB, func(ctx context.Context) error {
+		row := conn(ctx, service.DB).QueryRowContext(ctx, `
+			INSERT INTO sign_in_links (user_id, token_hash, nonce_hash, expires_at)
+			VALUES ($1, $2, $3, $4) ON CONFLICT (user_id) DO
+			UPDATE
+			SET token_hash = $2, nonce_hash = $3, expires_at = $4
+			RETURNING id;`,
+			link.UserID, link.TokenHash, link.NonceHash, link.ExpiresAt,
+		)
+		err := row.Scan(&link.ID)
+		if err != nil || notify == nil {
+			return err
+		}
+		return notify(ctx, &link)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("models.SignInLinkService.Create: %w", err)
+	}
+
+	return &link, nil
+}
+
+// Consume returns the user the link was issued for and deletes the link. The
+// nonce has to match the one the link was created with, otherwise the link is
+// left untouched so it can still be used from the right browser.
+func (service *SignInLinkService) Consume(ctx context.Context, token string, nonce string) (*User, error) {
+	var link SignInLink
+	var user User
+
+	row := conn(ctx, service.DB).QueryRowContext(ctx, `
+		SELECT sign_in_links.id,
+			sign_in_links.nonce_hash,
+			sign_in_links.expires_at,
+			users.id,
+			users.email,
+			users.password_hash
+		FROM sign_in_links
+			JOIN users ON users.id = sign_in_links.user_id
+		WHERE sign_in_links.token_hash = $1;`,
+		service.hash(token),
+	)
+	err := row.Scan(&link.ID, &link.NonceHash, &link.ExpiresAt, &user.ID, &user.Email, &user.PasswordHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.SignInLinkService.Consume: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.SignInLinkService.Consume: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(link.NonceHash), []byte(service.hash(nonce))) != 1 {
+		return nil, fmt.Errorf("models.SignInLinkService.Consume: %w", ErrWrongBrowser)
+	}
+
+	err = service.delete(ctx, link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("models.SignInLinkService.Consume: %w", err)
+	}
+
+	if time.Now().After(link.ExpiresAt) {
+		return nil, fmt.Errorf("models.SignInLinkService.Consume: %w", ErrTokenExpired)
+	}
+
+	return &user, nil
+}
+
+func (service *SignInLinkService) hash(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+func (service *SignInLinkService) delete(ctx context.Context, id int) error {
+	_, err := conn(ctx, service.DB).ExecContext(ctx, `
+	DELETE FROM sign_in_links
+	WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("models.SignInLinkService.delete: %w", err)
+	}
+	return nil
+}
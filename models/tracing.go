@@ -0,0 +1,40 @@
+package models
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer uses the global tracer provider, so spans are exported once the app
+// set it up, and dropped otherwise.
+var tracer = otel.Tracer("github.com/taherk/galleryapp/models")
+
+// startSpan starts a span for an operation of a service, e.g.
+// "GalleryService.Images". It has to be ended with endSpan.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name)
+}
+
+// startQuerySpan starts a span for an operation that queries Postgres.
+func startQuerySpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL),
+	)
+}
+
+// endSpan records *err on the span and ends it. It is meant to be deferred
+// with a pointer to the named error result. ErrNotFound is not a failure of
+// the operation, so it is not recorded.
+func endSpan(span trace.Span, err *error) {
+	if *err != nil && !errors.Is(*err, ErrNotFound) {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
@@ -1,49 +1,75 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
-	"golang.org/x/crypto/bcrypt"
 )
 
-var ()
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
 
 type User struct {
 	ID           uint
 	Email        string
 	PasswordHash string
+	Role         string
+	// DisabledAt is set when an admin disabled the account. Disabled users
+	// cannot sign in.
+	DisabledAt *time.Time
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
 }
 
 type UserService struct {
 	DB *sql.DB
+	// PasswordPolicy is checked whenever a password is set. The defaults of
+	// PasswordPolicy are used when it is nil.
+	PasswordPolicy *PasswordPolicy
+	// PasswordHasher hashes new passwords. Existing hashes made by another
+	// hasher, or with outdated parameters, are replaced on the next successful
+	// sign in. Defaults to a BcryptHasher with bcrypt.DefaultCost.
+	PasswordHasher PasswordHasher
 }
 
 // here to if you have a lot many fields what you could define a
 // new type with all the fields and accept it as parameter
 // If you are working on a code with a particular style keep it
 // consistent
-func (us *UserService) Create(email string, password string) (*User, error) {
+func (us *UserService) Create(ctx context.Context, email string, password string) (_ *User, err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.Create")
+	defer endSpan(span, &err)
+
 	// emails are case insensitive
 	// if not done it could lead to duplicate users with the same email
 	email = strings.ToLower(email)
 
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	err = us.ValidatePassword(password)
 	if err != nil {
 		return nil, fmt.Errorf("models.user.create: %w", err)
 	}
 
-	passwordHash := string(hashedBytes)
+	passwordHash, err := us.hasher().Hash(password)
+	if err != nil {
+		return nil, fmt.Errorf("models.user.create: %w", err)
+	}
 
 	user := User{
 		Email:        email,
 		PasswordHash: passwordHash,
 	}
-	row := us.DB.QueryRow(`
+	row := conn(ctx, us.DB).QueryRowContext(ctx, `
 		INSERT INTO users (email, password_hash)
 		VALUES ($1, $2) RETURNING id;`, email, passwordHash)
 
@@ -61,37 +87,102 @@ func (us *UserService) Create(email string, password string) (*User, error) {
 	return &user, nil
 }
 
-func (us *UserService) Authenticate(email string, password string) (*User, error) {
+func (us *UserService) Authenticate(ctx context.Context, email string, password string) (_ *User, err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.Authenticate")
+	defer endSpan(span, &err)
+
 	email = strings.ToLower(email)
 	user := User{
 		Email: email,
 	}
 
-	row := us.DB.QueryRow(`SELECT id, password_hash FROM users WHERE email=$1`, email)
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	row := conn(ctx, us.DB).QueryRowContext(ctx, `SELECT id, password_hash FROM users WHERE email=$1`, email)
+	err = row.Scan(&user.ID, &user.PasswordHash)
 	if err != nil {
 		return nil, fmt.Errorf("models.user.Authenicate user not found: %w", err)
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	hasher, err := us.hasherFor(user.PasswordHash)
+	if err != nil {
+		return nil, fmt.Errorf("models.user.Authenticate: %w", err)
+	}
+	err = hasher.Compare(user.PasswordHash, password)
 	if err != nil {
-		fmt.Printf("Password is invalid: %v\n", password)
 		return nil, fmt.Errorf("models.user.Authenticate: %w", err)
 	}
 
+	// the password is only known right now, so this is the one chance to
+	// move the hash to the current algorithm and parameters
+	current := us.hasher()
+	if !current.Handles(user.PasswordHash) || current.Outdated(user.PasswordHash) {
+		err = us.rehash(ctx, &user, password)
+		if err != nil {
+			// the user is still signed in with the old hash
+			slog.ErrorContext(ctx, "rehashing password", "user_id", user.ID, "err", err)
+		}
+	}
+
 	return &user, nil
 }
 
-func (us *UserService) UpdatePassword(userID int, password string) error {
+func (us *UserService) rehash(ctx context.Context, user *User, password string) (err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.rehash")
+	defer endSpan(span, &err)
 
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	passwordHash, err := us.hasher().Hash(password)
+	if err != nil {
+		return fmt.Errorf("models.user.rehash: %w", err)
+	}
+
+	// only replace the hash that was verified, in case the password was
+	// changed in the meantime
+	_, err = conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET password_hash = $3
+		WHERE id = $1 AND password_hash = $2;
+	`, user.ID, user.PasswordHash, passwordHash)
+	if err != nil {
+		return fmt.Errorf("models.user.rehash: %w", err)
+	}
+	user.PasswordHash = passwordHash
+
+	return nil
+}
+
+func (us *UserService) hasher() PasswordHasher {
+	if us.PasswordHasher == nil {
+		return &BcryptHasher{}
+	}
+	return us.PasswordHasher
+}
+
+// hasherFor returns the hasher that can verify the hash, whichever hasher
+// is currently used for new passwords.
+func (us *UserService) hasherFor(hash string) (PasswordHasher, error) {
+	hashers := []PasswordHasher{us.hasher(), &BcryptHasher{}, &Argon2idHasher{}}
+	for _, hasher := range hashers {
+		if hasher.Handles(hash) {
+			return hasher, nil
+		}
+	}
+	return nil, fmt.Errorf("models.user.hasherFor: unknown password hash format")
+}
+
+func (us *UserService) UpdatePassword(ctx context.Context, userID int, password string) (err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.UpdatePassword")
+	defer endSpan(span, &err)
+
+	err = us.ValidatePassword(password)
 	if err != nil {
 		return fmt.Errorf("models.user.UpdatePassword: %w", err)
 	}
 
-	passwordHash := string(hashedBytes)
+	passwordHash, err := us.hasher().Hash(password)
+	if err != nil {
+		return fmt.Errorf("models.user.UpdatePassword: %w", err)
+	}
 
-	_, err = us.DB.Exec(`
+	_, err = conn(ctx, us.DB).ExecContext(ctx, `
 		UPDATE users
 		SET password_hash = $2
 		where id = $1;
@@ -102,3 +193,166 @@ func (us *UserService) UpdatePassword(userID int, password string) error {
 
 	return nil
 }
+
+// ValidatePassword checks the password against the password policy. Errors
+// are errors.Public, so their message can be shown to the user.
+func (us *UserService) ValidatePassword(password string) error {
+	policy := us.PasswordPolicy
+	if policy == nil {
+		policy = &PasswordPolicy{}
+	}
+	return policy.Validate(password)
+}
+
+func (us *UserService) UpdateEmail(ctx context.Context, userID int, email string) (err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.UpdateEmail")
+	defer endSpan(span, &err)
+
+	email = strings.ToLower(email)
+
+	_, err = conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET email = $2
+		WHERE id = $1;
+	`, userID, email)
+	if err != nil {
+		var pgError *pgconn.PgError
+		if errors.As(err, &pgError) {
+			if pgError.Code == pgerrcode.UniqueViolation {
+				return ErrEmailToken
+			}
+		}
+		return fmt.Errorf("models.user.UpdateEmail: %w", err)
+	}
+
+	return nil
+}
+
+func (us *UserService) ByID(ctx context.Context, id int) (_ *User, err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.ByID")
+	defer endSpan(span, &err)
+
+	user := User{
+		ID: uint(id),
+	}
+
+	var disabledAt sql.NullTime
+	row := conn(ctx, us.DB).QueryRowContext(ctx, `SELECT email, password_hash, role, disabled_at FROM users WHERE id = $1;`, id)
+	err = row.Scan(&user.Email, &user.PasswordHash, &user.Role, &disabledAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.user.ByID: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.user.ByID: %w", err)
+	}
+	user.DisabledAt = nullTimePtr(disabledAt)
+
+	return &user, nil
+}
+
+// ByEmail returns the user with the email address, which is case insensitive.
+func (us *UserService) ByEmail(ctx context.Context, email string) (_ *User, err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.ByEmail")
+	defer endSpan(span, &err)
+
+	user := User{
+		Email: strings.ToLower(email),
+	}
+
+	var disabledAt sql.NullTime
+	row := conn(ctx, us.DB).QueryRowContext(ctx, `SELECT id, password_hash, role, disabled_at FROM users WHERE email = $1;`, user.Email)
+	err = row.Scan(&user.ID, &user.PasswordHash, &user.Role, &disabledAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("models.user.ByEmail: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("models.user.ByEmail: %w", err)
+	}
+	user.DisabledAt = nullTimePtr(disabledAt)
+
+	return &user, nil
+}
+
+// Search returns the users whose email address contains the query. An empty
+// query returns every user.
+func (us *UserService) Search(ctx context.Context, query string) (_ []User, err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.Search")
+	defer endSpan(span, &err)
+
+	rows, err := conn(ctx, us.DB).QueryContext(ctx, `
+		SELECT id, email, role, disabled_at
+		FROM users
+		WHERE email LIKE $1 ESCAPE '\'
+		ORDER BY id;`,
+		containsPattern(strings.ToLower(query)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("models.user.Search: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var user User
+		var disabledAt sql.NullTime
+		err := rows.Scan(&user.ID, &user.Email, &user.Role, &disabledAt)
+		if err != nil {
+			return nil, fmt.Errorf("models.user.Search: %w", err)
+		}
+		user.DisabledAt = nullTimePtr(disabledAt)
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("models.user.Search: %w", err)
+	}
+
+	return users, nil
+}
+
+// SetDisabled disables or re-enables the account. The sessions of a disabled
+// user stop working immediately.
+func (us *UserService) SetDisabled(ctx context.Context, userID int, disabled bool) (err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.SetDisabled")
+	defer endSpan(span, &err)
+
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+
+	_, err = conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET disabled_at = $2
+		WHERE id = $1;
+	`, userID, disabledAt)
+	if err != nil {
+		return fmt.Errorf("models.user.SetDisabled: %w", err)
+	}
+
+	return nil
+}
+
+// SetRole changes the role of the user, e.g. to make them an admin.
+func (us *UserService) SetRole(ctx context.Context, userID int, role string) (err error) {
+	ctx, span := startQuerySpan(ctx, "UserService.SetRole")
+	defer endSpan(span, &err)
+
+	result, err := conn(ctx, us.DB).ExecContext(ctx, `
+		UPDATE users
+		SET role = $2
+		WHERE id = $1;
+	`, userID, role)
+	if err != nil {
+		return fmt.Errorf("models.user.SetRole: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("models.user.SetRole: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("models.user.SetRole: %w", ErrNotFound)
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package passwords
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed breached
+var files embed.FS
+
+// Breached holds the SHA-1 hashes of commonly breached passwords in the
+// format of the Pwned Passwords k-anonymity range API: one file per 5
+// character hash prefix, e.g. "00619.txt", with a "<SUFFIX>:<COUNT>" line
+// for every hash in the range. A corpus downloaded with the Pwned Passwords
+// downloader can be dropped into the breached directory as it is.
+//
+// The bundled ranges come from a list of common passwords without breach
+// counts, so all of their counts are 1.
+var Breached fs.FS
+
+func init() {
+	var err error
+	Breached, err = fs.Sub(files, "breached")
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate in certFile and keyFile, and reloads it
+// when either file changes, e.g. after a renewal. If the new files cannot be
+// loaded the previous certificate is kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.checkedAt) > certCheckInterval {
+		cr.checkedAt = time.Now()
+		modTime, err := cr.latestModTime()
+		if err != nil {
+			slog.Error("checking TLS certificate", "err", err)
+		} else if modTime.After(cr.modTime) {
+			err = cr.reload()
+			if err != nil {
+				slog.Error("reloading TLS certificate", "err", err)
+			} else {
+				slog.Info("reloaded TLS certificate", "file", cr.certFile)
+			}
+		}
+	}
+
+	return cr.cert, nil
+}
+
+// reload has to be called with mu held, or before cr is shared.
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.checkedAt = time.Now()
+	return nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
@@ -7,15 +7,21 @@ import (
 	"html/template"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
 	"net/http"
 	"path"
 
 	"github.com/gorilla/csrf"
 	"github.com/taherk/galleryapp/context"
 	"github.com/taherk/galleryapp/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/taherk/galleryapp/views")
+
 type public interface {
 	Public() string
 }
@@ -37,6 +43,9 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 			"currentUser": func() (template.HTML, error) {
 				return "", fmt.Errorf("current user not implemented")
 			},
+			"impersonator": func() (template.HTML, error) {
+				return "", fmt.Errorf("impersonator not implemented")
+			},
 			"errors": func() []string {
 				return nil
 			},
@@ -67,13 +76,19 @@ type Template struct {
 }
 
 func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error) {
+	_, span := tracer.Start(r.Context(), "views.Template.Execute",
+		trace.WithAttributes(attribute.String("template", t.htmlTpl.Name())),
+	)
+	defer span.End()
+
 	// If there multiple web reqs then all will be pointing to the same
 	// template and if two requests come simultaneously then they will
 	// share the token which is not good
 	tpl, err := t.htmlTpl.Clone()
 	if err != nil {
-		fmt.Printf("cloning template: %v", err)
+		slog.ErrorContext(r.Context(), "cloning template", "err", err)
 		http.Error(w, "There was an error cloning the template", http.StatusInternalServerError)
+		return
 	}
 	errMsgs := errMessages(errs...)
 	tpl = tpl.Funcs(
@@ -84,6 +99,9 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 			"currentUser": func() *models.User {
 				return context.User(r.Context())
 			},
+			"impersonator": func() *models.User {
+				return context.Impersonator(r.Context())
+			},
 			"errors": func() []string {
 				return errMsgs
 			},
@@ -99,7 +117,9 @@ func (t Template) Execute(w http.ResponseWriter, r *http.Request, data interface
 	// the error occurs resulting in half rendered page.
 	err = tpl.Execute(&buf, data)
 	if err != nil {
-		log.Printf("executing template: %v", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(r.Context(), "executing template", "err", err)
 		http.Error(w, "There was an error executing the template.", http.StatusInternalServerError)
 		return
 	}